@@ -0,0 +1,466 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"medical-vitals-management-system/models"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// aggregationPlan is a validated aggregate request: the series to summarize,
+// the unit each is reported in and, for bucketed requests, the buckets.
+type aggregationPlan struct {
+	statistics statisticSet
+	vitalIDs   []string
+	series     []vitalSeries
+	units      map[string]string
+	interval   string
+	location   *time.Location
+	boundaries []time.Time
+}
+
+// aggregateKey identifies the statistics of one series, in one bucket for
+// bucketed queries.
+type aggregateKey struct {
+	series string
+	bucket int
+}
+
+// AggregateVitals calculates the requested statistics for each requested vital, the mean if none are named.
+// Composite vitals get statistics per component, keyed as "VitalID.component". Statistics are reported in the
+// unit requested for each vital, or its canonical unit. If an interval is requested, a series of statistics per
+// bucket is returned as well, with buckets aligned to the requested timezone. Readings recorded before units
+// were tracked are left out, since their unit is unknown. Vitals may be named by vital ID or LOINC code, and
+// statistics carry the LOINC code of their series and the UCUM code of their unit. Readings can be narrowed by
+// provenance with the request's source filter, for example to leave out manual entries.
+//
+// On PostgreSQL the statistics are computed by the database, so only the results are transferred; other
+// dialects fall back to loading the requested readings and computing them in memory.
+func AggregateVitals(db *gorm.DB, request models.AggregateRequest) (models.AggregateData, error) {
+	data := models.AggregateData{Username: request.Username, Aggregates: make(map[string]models.VitalStatistics)}
+
+	plan, err := planAggregation(db, request)
+	if err != nil {
+		return data, err
+	}
+	request.VitalIDs = plan.vitalIDs
+	if plan.boundaries != nil {
+		data.Interval = plan.interval
+		data.Timezone = plan.location.String()
+		data.Series = make(map[string][]models.AggregateBucket)
+	}
+
+	if db.Dialect().GetName() == "postgres" {
+		err = aggregateInDatabase(db, request, plan, &data)
+	} else {
+		err = aggregateInMemory(db, request, plan, &data)
+	}
+	if err != nil {
+		return data, err
+	}
+
+	if len(data.Aggregates) == 0 {
+		return data, fmt.Errorf("no vitals found for the specified user and time range")
+	}
+	for _, series := range plan.series {
+		if stats, ok := data.Aggregates[series.Key()]; ok {
+			stats.LoincCode = series.LOINC
+			stats.UCUMUnit = UCUMCode(stats.Unit)
+			data.Aggregates[series.Key()] = stats
+		}
+	}
+	return data, nil
+}
+
+func planAggregation(db *gorm.DB, request models.AggregateRequest) (aggregationPlan, error) {
+	statistics, err := parseStatistics(request.Statistics)
+	if err != nil {
+		return aggregationPlan{}, err
+	}
+	if len(request.VitalIDs) == 0 {
+		return aggregationPlan{}, validationErrorf("vital_ids is required")
+	}
+	if err := validateSourceFilter(request.SourceFilter); err != nil {
+		return aggregationPlan{}, err
+	}
+
+	plan := aggregationPlan{statistics: statistics, units: make(map[string]string)}
+	if request.Interval != "" {
+		plan.interval = request.Interval
+		if plan.location, err = loadLocation(request.Timezone); err != nil {
+			return aggregationPlan{}, err
+		}
+		plan.boundaries, err = bucketBoundaries(request.StartTimestamp, request.EndTimestamp, request.Interval, plan.location)
+		if err != nil {
+			return aggregationPlan{}, err
+		}
+	}
+
+	planned := make(map[string]bool)
+	for _, vitalID := range request.VitalIDs {
+		vitalType, err := GetVitalType(db, vitalID)
+		if err != nil {
+			return aggregationPlan{}, err
+		}
+		if planned[vitalType.VitalID] {
+			continue
+		}
+		planned[vitalType.VitalID] = true
+		plan.vitalIDs = append(plan.vitalIDs, vitalType.VitalID)
+
+		for _, series := range seriesOf(vitalType) {
+			requested, ok := request.Units[series.Key()]
+			if !ok {
+				requested, ok = request.Units[vitalType.VitalID]
+			}
+			if !ok {
+				requested = request.Units[vitalID]
+			}
+			if plan.units[series.Key()], err = resolveUnit(series, requested); err != nil {
+				return aggregationPlan{}, err
+			}
+			plan.series = append(plan.series, series)
+		}
+	}
+	return plan, nil
+}
+
+// bucketEpochs returns the bucket boundaries as Unix times in seconds, the
+// thresholds width_bucket places each reading's instant between. Bucketing
+// by instant rather than by local wall clock time keeps apart the two hours
+// that share a wall clock time when clocks go back.
+func (p aggregationPlan) bucketEpochs() []float64 {
+	epochs := make([]float64, len(p.boundaries))
+	for i, boundary := range p.boundaries {
+		epochs[i] = float64(boundary.UnixNano()) / float64(time.Second)
+	}
+	return epochs
+}
+
+// bucketIndex turns the 1-based result of width_bucket into the index of a
+// bucket, reporting false for readings outside every bucket.
+func (p aggregationPlan) bucketIndex(bucket int) (int, bool) {
+	index := bucket - 1
+	return index, index >= 0 && index+1 < len(p.boundaries)
+}
+
+// aggregateInMemory loads the requested readings in time order and computes
+// the statistics in Go.
+func aggregateInMemory(db *gorm.DB, request models.AggregateRequest, plan aggregationPlan, data *models.AggregateData) error {
+	query := db.Where("username = ? AND vital_id IN (?) AND timestamp BETWEEN ? AND ?",
+		request.Username, request.VitalIDs, request.StartTimestamp, request.EndTimestamp)
+	if condition, args := sourceCondition(request.SourceFilter); condition != "" {
+		query = query.Where(condition, args...)
+	}
+
+	var vitals []models.Vital
+	err := query.Order("timestamp, id").Find(&vitals).Error
+	if err != nil {
+		return fmt.Errorf("failed to get vitals: %v", err)
+	}
+	return summarizeVitals(vitals, plan, data)
+}
+
+// summarizeVitals computes the statistics of the series of plan from
+// readings in time order, skipping readings of other series.
+func summarizeVitals(vitals []models.Vital, plan aggregationPlan, data *models.AggregateData) error {
+	valuesBySeries := make(map[string][]timedValue)
+	for _, vital := range vitals {
+		key := seriesKey(vital.VitalID, vital.Component)
+		unit, requested := plan.units[key]
+		if !requested || vital.Unit == "" {
+			continue
+		}
+
+		value, err := ConvertValue(vital.Value, vital.Unit, unit)
+		if err != nil {
+			return err
+		}
+		valuesBySeries[key] = append(valuesBySeries[key], timedValue{Timestamp: vital.Timestamp, Value: value})
+	}
+
+	for _, series := range plan.series {
+		key := series.Key()
+		timedValues := valuesBySeries[key]
+
+		values := make([]float64, len(timedValues))
+		for i, timed := range timedValues {
+			values[i] = timed.Value
+		}
+
+		if stats, ok := computeStatistics(values, plan.statistics, plan.units[key]); ok {
+			data.Aggregates[key] = stats
+		}
+		if plan.boundaries != nil {
+			data.Series[key] = bucketSeries(timedValues, plan.boundaries, plan.statistics, plan.units[key])
+		}
+	}
+	return nil
+}
+
+// aggregateInDatabase computes the statistics with GROUP BY queries over the
+// requested vital IDs, converting values to the output units in SQL.
+func aggregateInDatabase(db *gorm.DB, request models.AggregateRequest, plan aggregationPlan, data *models.AggregateData) error {
+	totals, err := queryStatistics(db, request, plan, false)
+	if err != nil {
+		return err
+	}
+	for key, stats := range totals {
+		data.Aggregates[key.series] = *stats
+	}
+
+	if plan.boundaries == nil {
+		return nil
+	}
+
+	buckets, err := queryStatistics(db, request, plan, true)
+	if err != nil {
+		return err
+	}
+	for _, series := range plan.series {
+		key := series.Key()
+		seriesBuckets := make([]models.AggregateBucket, 0, len(plan.boundaries)-1)
+		for i := 0; i+1 < len(plan.boundaries); i++ {
+			bucket := models.AggregateBucket{Start: plan.boundaries[i], End: plan.boundaries[i+1], Empty: true}
+			if stats, ok := buckets[aggregateKey{series: key, bucket: i}]; ok {
+				bucket.Empty = false
+				bucket.Statistics = stats
+			}
+			seriesBuckets = append(seriesBuckets, bucket)
+		}
+		data.Series[key] = seriesBuckets
+	}
+	return nil
+}
+
+// queryStatistics runs the aggregate query for the plan, grouped by series
+// and, if bucketed, by bucket.
+func queryStatistics(db *gorm.DB, request models.AggregateRequest, plan aggregationPlan, bucketed bool) (map[aggregateKey]*models.VitalStatistics, error) {
+	statistics := plan.statistics
+	percentileNames, fractions := statistics.orderedPercentiles()
+
+	groupColumns := "vital_id, component"
+	if bucketed {
+		groupColumns += ", bucket"
+	}
+
+	columns := []string{groupColumns, "COUNT(value)"}
+	var args []interface{}
+	if statistics.has(StatMean) {
+		columns = append(columns, "AVG(value)")
+	}
+	if statistics.has(StatMin) {
+		columns = append(columns, "MIN(value)")
+	}
+	if statistics.has(StatMax) {
+		columns = append(columns, "MAX(value)")
+	}
+	if statistics.has(StatStdDev) {
+		columns = append(columns, "STDDEV_SAMP(value)")
+	}
+	if len(fractions) > 0 {
+		columns = append(columns, "percentile_cont(?::float8[]) WITHIN GROUP (ORDER BY value)")
+		args = append(args, pq.Float64Array(fractions))
+	}
+
+	source, sourceArgs := plan.convertedValues(request, bucketed)
+	args = append(args, sourceArgs...)
+	query := fmt.Sprintf("SELECT %s FROM (%s) AS converted WHERE value IS NOT NULL GROUP BY %s",
+		strings.Join(columns, ", "), source, groupColumns)
+
+	rows, err := db.Raw(query, args...).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate vitals: %v", err)
+	}
+	defer rows.Close()
+
+	results := make(map[aggregateKey]*models.VitalStatistics)
+	for rows.Next() {
+		var vitalID, component string
+		var bucket, count int
+		var mean, min, max, stddev sql.NullFloat64
+		var percentiles pq.Float64Array
+
+		dest := []interface{}{&vitalID, &component}
+		if bucketed {
+			dest = append(dest, &bucket)
+		}
+		dest = append(dest, &count)
+		if statistics.has(StatMean) {
+			dest = append(dest, &mean)
+		}
+		if statistics.has(StatMin) {
+			dest = append(dest, &min)
+		}
+		if statistics.has(StatMax) {
+			dest = append(dest, &max)
+		}
+		if statistics.has(StatStdDev) {
+			dest = append(dest, &stddev)
+		}
+		if len(fractions) > 0 {
+			dest = append(dest, &percentiles)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to read aggregates: %v", err)
+		}
+
+		key := aggregateKey{series: seriesKey(vitalID, component)}
+		if bucketed {
+			index, ok := plan.bucketIndex(bucket)
+			if !ok {
+				continue
+			}
+			key.bucket = index
+		}
+
+		stats := &models.VitalStatistics{Unit: plan.units[key.series], Count: count}
+		if mean.Valid {
+			stats.Mean = floatPtr(mean.Float64)
+		}
+		if min.Valid {
+			stats.Min = floatPtr(min.Float64)
+		}
+		if max.Valid {
+			stats.Max = floatPtr(max.Float64)
+		}
+		if statistics.has(StatStdDev) {
+			// STDDEV_SAMP is NULL for a single reading; report 0 as computeStatistics does.
+			stats.StdDev = floatPtr(stddev.Float64)
+		}
+		for i, name := range percentileNames {
+			if i >= len(percentiles) {
+				break
+			}
+			if name == StatMedian {
+				stats.Median = floatPtr(percentiles[i])
+				continue
+			}
+			if stats.Percentiles == nil {
+				stats.Percentiles = make(map[string]float64)
+			}
+			stats.Percentiles[name] = percentiles[i]
+		}
+		results[key] = stats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read aggregates: %v", err)
+	}
+
+	if statistics.has(StatFirst) {
+		if err := queryEndpoints(db, request, plan, bucketed, false, results); err != nil {
+			return nil, err
+		}
+	}
+	if statistics.has(StatLast) {
+		if err := queryEndpoints(db, request, plan, bucketed, true, results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// queryEndpoints fills in the first or last value of each group using
+// DISTINCT ON, which lets the database stop at one row per group.
+func queryEndpoints(db *gorm.DB, request models.AggregateRequest, plan aggregationPlan, bucketed, last bool, results map[aggregateKey]*models.VitalStatistics) error {
+	groupColumns := "vital_id, component"
+	if bucketed {
+		groupColumns += ", bucket"
+	}
+	direction := "ASC"
+	if last {
+		direction = "DESC"
+	}
+
+	source, args := plan.convertedValues(request, bucketed)
+	query := fmt.Sprintf("SELECT DISTINCT ON (%[1]s) %[1]s, value FROM (%[2]s) AS converted WHERE value IS NOT NULL ORDER BY %[1]s, \"timestamp\" %[3]s, id %[3]s",
+		groupColumns, source, direction)
+
+	rows, err := db.Raw(query, args...).Rows()
+	if err != nil {
+		return fmt.Errorf("failed to aggregate vitals: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var vitalID, component string
+		var bucket int
+		var value float64
+
+		dest := []interface{}{&vitalID, &component}
+		if bucketed {
+			dest = append(dest, &bucket)
+		}
+		dest = append(dest, &value)
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("failed to read aggregates: %v", err)
+		}
+
+		key := aggregateKey{series: seriesKey(vitalID, component)}
+		if bucketed {
+			index, ok := plan.bucketIndex(bucket)
+			if !ok {
+				continue
+			}
+			key.bucket = index
+		}
+
+		stats, ok := results[key]
+		if !ok {
+			continue
+		}
+		if last {
+			stats.Last = floatPtr(value)
+		} else {
+			stats.First = floatPtr(value)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read aggregates: %v", err)
+	}
+	return nil
+}
+
+// convertedValues builds the subquery selecting the requested readings with
+// their values converted to the output unit of their series. Readings whose
+// unit cannot be converted have a NULL value.
+func (p aggregationPlan) convertedValues(request models.AggregateRequest, bucketed bool) (string, []interface{}) {
+	var args []interface{}
+
+	bucketColumn := ""
+	if bucketed {
+		bucketColumn = "width_bucket(extract(epoch FROM \"timestamp\")::float8, ?::float8[]) AS bucket, "
+		args = append(args, pq.Float64Array(p.bucketEpochs()))
+	}
+
+	var cases []string
+	for _, series := range p.series {
+		conversions := conversionsTo(p.units[series.Key()])
+
+		units := make([]string, 0, len(conversions))
+		for unit := range conversions {
+			units = append(units, unit)
+		}
+		sort.Strings(units)
+
+		for _, unit := range units {
+			cases = append(cases, "WHEN vital_id = ? AND COALESCE(component, '') = ? AND unit = ? THEN value * ? + ?")
+			args = append(args, series.VitalID, series.Component, unit, conversions[unit].scale, conversions[unit].offset)
+		}
+	}
+
+	query := fmt.Sprintf("SELECT vital_id, COALESCE(component, '') AS component, \"timestamp\", id, %sCAST(CASE %s END AS double precision) AS value "+
+		"FROM vitals WHERE deleted_at IS NULL AND username = ? AND vital_id IN (?) AND \"timestamp\" BETWEEN ? AND ?",
+		bucketColumn, strings.Join(cases, " "))
+	args = append(args, request.Username, request.VitalIDs, request.StartTimestamp, request.EndTimestamp)
+	if condition, sourceArgs := sourceCondition(request.SourceFilter); condition != "" {
+		query += " AND " + condition
+		args = append(args, sourceArgs...)
+	}
+	return query, args
+}
@@ -0,0 +1,197 @@
+package app
+
+import (
+	"math"
+	"medical-vitals-management-system/models"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/lib/pq"
+)
+
+// The aggregation benchmarks need a scratch PostgreSQL database, given as a
+// connection string in VITALS_BENCH_DATABASE; they are skipped otherwise.
+// VITALS_BENCH_ROWS sets the number of synthetic 1 Hz readings per vital
+// (default 200000). For example:
+//
+//	VITALS_BENCH_DATABASE="host=localhost user=postgres password=postgres dbname=vitalbench sslmode=disable" \
+//		go test ./app -run '^$' -bench AggregateVitals -benchmem
+
+const benchUsername = "bench-wearable-user"
+
+var benchStart = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	benchOnce  sync.Once
+	benchDB    *gorm.DB
+	benchRows  int
+	benchError error
+)
+
+func openBenchDB(b *testing.B) *gorm.DB {
+	conn := os.Getenv("VITALS_BENCH_DATABASE")
+	if conn == "" {
+		b.Skip("VITALS_BENCH_DATABASE is not set")
+	}
+
+	benchOnce.Do(func() {
+		benchRows = 200000
+		if rows, err := strconv.Atoi(os.Getenv("VITALS_BENCH_ROWS")); err == nil && rows > 0 {
+			benchRows = rows
+		}
+
+		benchDB, benchError = gorm.Open("postgres", conn)
+		if benchError != nil {
+			return
+		}
+		benchDB.LogMode(false)
+		benchError = seedBenchData(benchDB, benchRows)
+	})
+	if benchError != nil {
+		b.Fatalf("Failed to prepare benchmark database: %v", benchError)
+	}
+	return benchDB
+}
+
+// seedBenchData loads synthetic wearable data for benchUsername: heart rate
+// and temperature, which the benchmarks aggregate, and blood pressure, which
+// they do not request and which the database should never return.
+func seedBenchData(db *gorm.DB, rows int) error {
+	if err := db.AutoMigrate(&models.Vital{}, &models.VitalType{}, &models.VitalComponent{}).Error; err != nil {
+		return err
+	}
+	for _, vitalType := range []models.VitalType{
+		{VitalID: "HeartRate", Unit: "bpm", MinValue: 20, MaxValue: 300, Active: true},
+		{VitalID: "Temperature", Unit: "°C", MinValue: 25, MaxValue: 45, Precision: 1, Active: true},
+		{VitalID: "BloodPressure", Active: true, Components: []models.VitalComponent{
+			{Name: "systolic", Unit: "mmHg", MinValue: 40, MaxValue: 300},
+			{Name: "diastolic", Unit: "mmHg", MinValue: 20, MaxValue: 200},
+		}},
+	} {
+		vitalType := vitalType
+		if err := db.Where(models.VitalType{VitalID: vitalType.VitalID}).FirstOrCreate(&vitalType).Error; err != nil {
+			return err
+		}
+	}
+
+	if err := db.Unscoped().Where("username = ?", benchUsername).Delete(&models.Vital{}).Error; err != nil {
+		return err
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("vitals", "created_at", "updated_at", "username", "vital_id", "component", "value", "unit", "timestamp"))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now()
+	for i := 0; i < rows; i++ {
+		timestamp := benchStart.Add(time.Duration(i) * time.Second)
+		wave := math.Sin(float64(i) / 3600)
+		readings := []struct {
+			vitalID, component, unit string
+			value                    float64
+		}{
+			{"HeartRate", "", "bpm", 70 + 15*wave + float64(i%7)},
+			{"Temperature", "", "°C", 36.8 + 0.4*wave},
+			{"BloodPressure", "systolic", "mmHg", 120 + 10*wave},
+			{"BloodPressure", "diastolic", "mmHg", 80 + 5*wave},
+		}
+		for _, reading := range readings {
+			if _, err := stmt.Exec(now, now, benchUsername, reading.vitalID, reading.component, reading.value, reading.unit, timestamp); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return db.Exec("ANALYZE vitals").Error
+}
+
+func benchAggregateRequest(rows int, interval string) models.AggregateRequest {
+	return models.AggregateRequest{
+		Username:       benchUsername,
+		VitalIDs:       []string{"HeartRate", "Temperature"},
+		Statistics:     []string{"count", "mean", "min", "max", "median", "stddev", "first", "last", "p5", "p95"},
+		Interval:       interval,
+		StartTimestamp: benchStart,
+		EndTimestamp:   benchStart.Add(time.Duration(rows) * time.Second),
+	}
+}
+
+// aggregationMethod computes the aggregates of a planned request into data
+type aggregationMethod func(db *gorm.DB, request models.AggregateRequest, plan aggregationPlan, data *models.AggregateData) error
+
+// aggregateByLoadingAll is the approach aggregation in SQL replaced, as the
+// baseline to compare against: every stored reading is loaded, and the
+// user's readings of the requested vitals in the time range are picked out
+// and summarized in Go.
+func aggregateByLoadingAll(db *gorm.DB, request models.AggregateRequest, plan aggregationPlan, data *models.AggregateData) error {
+	var all []models.Vital
+	if err := db.Order("timestamp, id").Find(&all).Error; err != nil {
+		return err
+	}
+
+	var vitals []models.Vital
+	for _, vital := range all {
+		if vital.Username != request.Username || vital.Timestamp.Before(request.StartTimestamp) || vital.Timestamp.After(request.EndTimestamp) {
+			continue
+		}
+		vitals = append(vitals, vital)
+	}
+	return summarizeVitals(vitals, plan, data)
+}
+
+func benchmarkAggregation(b *testing.B, interval string, aggregate aggregationMethod) {
+	db := openBenchDB(b)
+	request := benchAggregateRequest(benchRows, interval)
+
+	plan, err := planAggregation(db, request)
+	if err != nil {
+		b.Fatalf("Failed to plan aggregation: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data := models.AggregateData{Aggregates: make(map[string]models.VitalStatistics), Series: make(map[string][]models.AggregateBucket)}
+		if err := aggregate(db, request, plan, &data); err != nil {
+			b.Fatalf("Failed to aggregate: %v", err)
+		}
+		if data.Aggregates["HeartRate"].Count != benchRows {
+			b.Fatalf("Expected %d heart rate readings, got %d", benchRows, data.Aggregates["HeartRate"].Count)
+		}
+	}
+}
+
+func BenchmarkAggregateVitals(b *testing.B) {
+	b.Run("LoadAll", func(b *testing.B) { benchmarkAggregation(b, "", aggregateByLoadingAll) })
+	b.Run("InMemory", func(b *testing.B) { benchmarkAggregation(b, "", aggregateInMemory) })
+	b.Run("InDatabase", func(b *testing.B) { benchmarkAggregation(b, "", aggregateInDatabase) })
+}
+
+func BenchmarkAggregateVitalsHourly(b *testing.B) {
+	b.Run("LoadAll", func(b *testing.B) { benchmarkAggregation(b, IntervalHour, aggregateByLoadingAll) })
+	b.Run("InMemory", func(b *testing.B) { benchmarkAggregation(b, IntervalHour, aggregateInMemory) })
+	b.Run("InDatabase", func(b *testing.B) { benchmarkAggregation(b, IntervalHour, aggregateInDatabase) })
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+// openTestDB connects to the scratch PostgreSQL database given as a
+// connection string in VITALS_TEST_DATABASE, skipping the test if it is not
+// set, for tests of the queries only PostgreSQL runs.
+func openTestDB(t *testing.T) *gorm.DB {
+	conn := os.Getenv("VITALS_TEST_DATABASE")
+	if conn == "" {
+		t.Skip("VITALS_TEST_DATABASE is not set")
+	}
+
+	db, err := gorm.Open("postgres", conn)
+	if err != nil {
+		t.Fatalf("Failed to connect to the test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.LogMode(false)
+	if err := db.AutoMigrate(&models.Vital{}, &models.VitalType{}, &models.VitalComponent{}).Error; err != nil {
+		t.Fatalf("Failed to migrate the test database: %v", err)
+	}
+	return db
+}
+
+func TestConvertedValuesPlaceholders(t *testing.T) {
+	location, _ := loadLocation("Europe/Berlin")
+	plan := aggregationPlan{
+		series: []vitalSeries{
+			{VitalID: "Temperature", Unit: "°C"},
+			{VitalID: "BloodPressure", Component: "systolic", Unit: "mmHg"},
+		},
+		units:    map[string]string{"Temperature": "°F", "BloodPressure.systolic": "mmHg"},
+		interval: IntervalHour,
+		location: location,
+	}
+	request := models.AggregateRequest{
+		Username:       "JohnDoe",
+		VitalIDs:       []string{"Temperature", "BloodPressure"},
+		StartTimestamp: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndTimestamp:   time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	for _, bucketed := range []bool{false, true} {
+		query, args := plan.convertedValues(request, bucketed)
+		assert.Equal(t, strings.Count(query, "?"), len(args), "Every placeholder should have an argument")
+		assert.Contains(t, query, "vital_id IN (?)", "Only requested vitals should be read")
+		assert.Equal(t, bucketed, strings.Contains(query, "width_bucket("))
+	}
+}
+
+func TestBucketIndexAcrossDST(t *testing.T) {
+	location, err := loadLocation("America/New_York")
+	assert.NoError(t, err)
+
+	// Clocks in New York go back at 02:00 on 2023-11-05, so 01:00 comes twice.
+	start := time.Date(2023, 11, 5, 0, 0, 0, 0, location)
+	boundaries, err := bucketBoundaries(start, start.Add(4*time.Hour), IntervalHour, location)
+	assert.NoError(t, err)
+	plan := aggregationPlan{boundaries: boundaries}
+
+	epochs := plan.bucketEpochs()
+	assert.Len(t, epochs, len(boundaries))
+	for i := 1; i < len(epochs); i++ {
+		assert.Equal(t, 3600.0, epochs[i]-epochs[i-1], "Both 01:00 hours should get a bucket of their own")
+	}
+
+	index, ok := plan.bucketIndex(1)
+	assert.True(t, ok)
+	assert.Equal(t, 0, index, "width_bucket counts from 1")
+	_, ok = plan.bucketIndex(0)
+	assert.False(t, ok, "Readings before the first boundary belong to no bucket")
+	_, ok = plan.bucketIndex(len(boundaries))
+	assert.False(t, ok, "Readings at or after the last boundary belong to no bucket")
+}
+
+func TestConversionsTo(t *testing.T) {
+	conversions := conversionsTo("°F")
+	assert.Contains(t, conversions, "°C")
+	assert.Contains(t, conversions, "K")
+	assert.NotContains(t, conversions, "bpm", "Units of other dimensions should not convert")
+
+	celsius := conversions["°C"]
+	assert.InDelta(t, 98.6, 37*celsius.scale+celsius.offset, 1e-9)
+}
+
+func TestAggregateInDatabaseAcrossDST(t *testing.T) {
+	db := openTestDB(t)
+	const username = "dst-test-user"
+
+	heartRate := models.VitalType{VitalID: "HeartRate", Unit: "bpm", MinValue: 20, MaxValue: 300, Active: true}
+	assert.NoError(t, db.Where(models.VitalType{VitalID: heartRate.VitalID}).FirstOrCreate(&heartRate).Error)
+	assert.NoError(t, db.Unscoped().Where("username = ?", username).Delete(&models.Vital{}).Error)
+
+	// Clocks in New York go back at 02:00 on 2023-11-05, so 01:00 comes twice:
+	// 05:00 UTC in daylight time and 06:00 UTC in standard time.
+	start := time.Date(2023, 11, 5, 4, 0, 0, 0, time.UTC)
+	for _, reading := range []struct {
+		offset time.Duration
+		value  float64
+	}{
+		{30 * time.Minute, 60},
+		{75 * time.Minute, 70},
+		{105 * time.Minute, 80},
+		{135 * time.Minute, 100},
+		{210 * time.Minute, 90},
+	} {
+		vital := models.Vital{Username: username, VitalID: "HeartRate", Value: reading.value, Unit: "bpm", Timestamp: start.Add(reading.offset)}
+		assert.NoError(t, db.Create(&vital).Error)
+	}
+
+	request := models.AggregateRequest{
+		Username:       username,
+		VitalIDs:       []string{"HeartRate"},
+		Statistics:     []string{"count", "mean", "first", "last"},
+		Interval:       IntervalHour,
+		Timezone:       "America/New_York",
+		StartTimestamp: start,
+		EndTimestamp:   start.Add(4 * time.Hour),
+	}
+	plan, err := planAggregation(db, request)
+	assert.NoError(t, err)
+	request.VitalIDs = plan.vitalIDs
+
+	inDatabase := models.AggregateData{Aggregates: make(map[string]models.VitalStatistics), Series: make(map[string][]models.AggregateBucket)}
+	assert.NoError(t, aggregateInDatabase(db, request, plan, &inDatabase))
+	inMemory := models.AggregateData{Aggregates: make(map[string]models.VitalStatistics), Series: make(map[string][]models.AggregateBucket)}
+	assert.NoError(t, aggregateInMemory(db, request, plan, &inMemory))
+
+	buckets := inDatabase.Series["HeartRate"]
+	assert.Len(t, buckets, 4)
+	for i, count := range []int{1, 2, 1, 1} {
+		assert.False(t, buckets[i].Empty, "Bucket %d should have readings", i)
+		if buckets[i].Statistics != nil {
+			assert.Equal(t, count, buckets[i].Statistics.Count, "Bucket %d should only count its own hour", i)
+		}
+	}
+	assert.Equal(t, 100.0, *buckets[2].Statistics.Mean, "The second 01:00 hour should not be merged into the first")
+	for i, bucket := range inMemory.Series["HeartRate"] {
+		assert.Equal(t, bucket.Empty, buckets[i].Empty, "Both aggregation paths should bucket by instant")
+		if bucket.Statistics != nil && buckets[i].Statistics != nil {
+			assert.Equal(t, bucket.Statistics.Count, buckets[i].Statistics.Count)
+			assert.InDelta(t, *bucket.Statistics.Mean, *buckets[i].Statistics.Mean, 1e-9)
+			assert.Equal(t, *bucket.Statistics.First, *buckets[i].Statistics.First)
+			assert.Equal(t, *bucket.Statistics.Last, *buckets[i].Statistics.Last)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"medical-vitals-management-system/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+var alertSeverities = map[string]bool{
+	models.SeverityInfo:     true,
+	models.SeverityWarning:  true,
+	models.SeverityCritical: true,
+}
+
+var alertStatuses = map[string]bool{
+	models.AlertOpen:         true,
+	models.AlertAcknowledged: true,
+	models.AlertResolved:     true,
+}
+
+// CreateAlertRule adds a rule for the readings of patient, or of everyone if
+// patient is empty.
+func CreateAlertRule(db *gorm.DB, patient string, request models.AlertRuleRequest, createdBy string) (models.AlertRule, error) {
+	rule, err := alertRuleFromRequest(db, request)
+	if err != nil {
+		return rule, err
+	}
+	if patient != "" {
+		exists, err := UserExists(db, patient)
+		if err != nil {
+			return rule, err
+		}
+		if !exists {
+			return rule, notFoundErrorf("user %s not found", patient)
+		}
+	}
+
+	rule.Patient = patient
+	rule.CreatedBy = createdBy
+	if err := db.Create(&rule).Error; err != nil {
+		return rule, fmt.Errorf("failed to create alert rule: %v", err)
+	}
+	return rule, nil
+}
+
+// GetAlertRules lists the global alert rules or, for a patient, the rules of
+// the patient followed by the global ones.
+func GetAlertRules(db *gorm.DB, patient string) ([]models.AlertRule, error) {
+	query := db.Where("patient = ''")
+	if patient != "" {
+		query = db.Where("patient = ? OR patient = ''", patient)
+	}
+
+	rules := []models.AlertRule{}
+	if err := query.Order("patient DESC, id").Find(&rules).Error; err != nil {
+		return nil, fmt.Errorf("failed to get alert rules: %v", err)
+	}
+	return rules, nil
+}
+
+func GetAlertRule(db *gorm.DB, id uint) (models.AlertRule, error) {
+	var rule models.AlertRule
+	if err := db.First(&rule, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return rule, notFoundErrorf("alert rule %d not found", id)
+		}
+		return rule, fmt.Errorf("failed to get alert rule: %v", err)
+	}
+	return rule, nil
+}
+
+// UpdateAlertRule replaces the definition of a rule, keeping its patient
+func UpdateAlertRule(db *gorm.DB, id uint, request models.AlertRuleRequest) (models.AlertRule, error) {
+	existing, err := GetAlertRule(db, id)
+	if err != nil {
+		return existing, err
+	}
+	rule, err := alertRuleFromRequest(db, request)
+	if err != nil {
+		return existing, err
+	}
+
+	rule.Model = existing.Model
+	rule.Patient = existing.Patient
+	rule.CreatedBy = existing.CreatedBy
+	if err := db.Save(&rule).Error; err != nil {
+		return existing, fmt.Errorf("failed to update alert rule: %v", err)
+	}
+	return rule, nil
+}
+
+// DeleteAlertRule deletes a rule. The alerts it raised are kept.
+func DeleteAlertRule(db *gorm.DB, id uint) error {
+	result := db.Delete(&models.AlertRule{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete alert rule: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return notFoundErrorf("alert rule %d not found", id)
+	}
+	return nil
+}
+
+// GetAlerts returns the alerts matching query, newest first
+func GetAlerts(db *gorm.DB, query models.AlertQuery) ([]models.Alert, error) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit < 0 || limit > maxPageSize {
+		return nil, validationErrorf("limit must be between 1 and %d", maxPageSize)
+	}
+	if query.Status != "" && !alertStatuses[query.Status] {
+		return nil, validationErrorf("unknown alert status %q", query.Status)
+	}
+	if query.Severity != "" && !alertSeverities[query.Severity] {
+		return nil, validationErrorf("unknown severity %q", query.Severity)
+	}
+
+	alerts := []models.Alert{}
+	if query.Patients != nil && len(query.Patients) == 0 {
+		return alerts, nil
+	}
+
+	scope := db
+	if query.Patients != nil {
+		scope = scope.Where("patient IN (?)", query.Patients)
+	}
+	if query.Status != "" {
+		scope = scope.Where("status = ?", query.Status)
+	}
+	if query.Severity != "" {
+		scope = scope.Where("severity = ?", query.Severity)
+	}
+	if query.BeforeID != 0 {
+		scope = scope.Where("id < ?", query.BeforeID)
+	}
+
+	if err := scope.Order("id DESC").Limit(limit).Find(&alerts).Error; err != nil {
+		return nil, fmt.Errorf("failed to get alerts: %v", err)
+	}
+	return alerts, nil
+}
+
+func GetAlert(db *gorm.DB, id uint) (models.Alert, error) {
+	var alert models.Alert
+	if err := db.First(&alert, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return alert, notFoundErrorf("alert %d not found", id)
+		}
+		return alert, fmt.Errorf("failed to get alert: %v", err)
+	}
+	return alert, nil
+}
+
+// AcknowledgeAlert records that actor has seen an open alert
+func AcknowledgeAlert(db *gorm.DB, id uint, actor, note string) (models.Alert, error) {
+	alert, err := GetAlert(db, id)
+	if err != nil {
+		return alert, err
+	}
+	if alert.Status != models.AlertOpen {
+		return alert, validationErrorf("alert %d is %s", id, alert.Status)
+	}
+
+	now := time.Now()
+	alert.Status, alert.AcknowledgedBy, alert.AcknowledgedAt = models.AlertAcknowledged, actor, &now
+	changes := map[string]interface{}{"status": alert.Status, "acknowledged_by": actor, "acknowledged_at": now}
+	if note != "" {
+		alert.Note = note
+		changes["note"] = note
+	}
+	if err := db.Model(&alert).Updates(changes).Error; err != nil {
+		return alert, fmt.Errorf("failed to acknowledge alert: %v", err)
+	}
+	return alert, nil
+}
+
+// ResolveAlert closes an open or acknowledged alert. The rule that raised it
+// may raise another for the patient from then on.
+func ResolveAlert(db *gorm.DB, id uint, actor, note string) (models.Alert, error) {
+	alert, err := GetAlert(db, id)
+	if err != nil {
+		return alert, err
+	}
+	if alert.Status == models.AlertResolved {
+		return alert, validationErrorf("alert %d is already resolved", id)
+	}
+
+	now := time.Now()
+	alert.Status, alert.ResolvedBy, alert.ResolvedAt = models.AlertResolved, actor, &now
+	changes := map[string]interface{}{"status": alert.Status, "resolved_by": actor, "resolved_at": now}
+	if note != "" {
+		alert.Note = note
+		changes["note"] = note
+	}
+	if err := db.Model(&alert).Updates(changes).Error; err != nil {
+		return alert, fmt.Errorf("failed to resolve alert: %v", err)
+	}
+	return alert, nil
+}
+
+// alertRuleFromRequest validates request and builds the rule it describes,
+// for the series it names by its vital ID. Settings the kind of rule does
+// not use are dropped.
+func alertRuleFromRequest(db *gorm.DB, request models.AlertRuleRequest) (models.AlertRule, error) {
+	rule := models.AlertRule{
+		Name:          strings.TrimSpace(request.Name),
+		Kind:          request.Kind,
+		Low:           request.Low,
+		High:          request.High,
+		Delta:         request.Delta,
+		Count:         request.Count,
+		WindowMinutes: request.WindowMinutes,
+		Severity:      request.Severity,
+		Active:        request.Active == nil || *request.Active,
+	}
+	if rule.Name == "" {
+		return rule, validationErrorf("name is required")
+	}
+	if rule.Severity == "" {
+		rule.Severity = models.SeverityWarning
+	}
+	if !alertSeverities[rule.Severity] {
+		return rule, validationErrorf("unknown severity %q", rule.Severity)
+	}
+
+	vitalType, err := GetVitalType(db, request.VitalID)
+	if err != nil {
+		return rule, err
+	}
+	series, err := selectSeries(vitalType, request.Component)
+	if err != nil {
+		return rule, err
+	}
+	if len(series) != 1 {
+		return rule, validationErrorf("%s has components; name the component the rule is for", vitalType.VitalID)
+	}
+	rule.VitalID, rule.Component, rule.Unit = series[0].VitalID, series[0].Component, series[0].Unit
+
+	switch rule.Kind {
+	case models.AlertThreshold:
+		if rule.Low == nil && rule.High == nil {
+			return rule, validationErrorf("a threshold rule needs low, high or both")
+		}
+		rule.Delta, rule.Count, rule.WindowMinutes = nil, 0, 0
+	case models.AlertRateOfChange:
+		if rule.Delta == nil || *rule.Delta <= 0 {
+			return rule, validationErrorf("a rate of change rule needs a positive delta")
+		}
+		if rule.WindowMinutes <= 0 {
+			return rule, validationErrorf("window_minutes must be positive")
+		}
+		rule.Low, rule.High, rule.Count = nil, nil, 0
+	case models.AlertOutOfRangeCount:
+		if rule.Count < 1 {
+			return rule, validationErrorf("count must be at least 1")
+		}
+		if rule.WindowMinutes <= 0 {
+			return rule, validationErrorf("window_minutes must be positive")
+		}
+		if rule.Low == nil && rule.High == nil {
+			rule.Low, rule.High = series[0].NormalLow, series[0].NormalHigh
+			if rule.Low == nil && rule.High == nil {
+				return rule, validationErrorf("%s has no normal range; give low, high or both", series[0].Key())
+			}
+		}
+		rule.Delta = nil
+	default:
+		return rule, validationErrorf("unknown rule kind %q; expected %s, %s or %s",
+			rule.Kind, models.AlertThreshold, models.AlertRateOfChange, models.AlertOutOfRangeCount)
+	}
+
+	if rule.Low != nil && rule.High != nil && *rule.Low > *rule.High {
+		return rule, validationErrorf("low must not exceed high")
+	}
+	return rule, nil
+}
+
+// raiseAlerts evaluates the active alert rules against rows that were just
+// stored and records the alerts they trigger. The rows are stored either
+// way, so failures are logged rather than returned.
+func raiseAlerts(db *gorm.DB, rows []models.Vital) {
+	if err := evaluateAlertRules(db, rows); err != nil {
+		logrus.Errorf("Failed to evaluate alert rules: %v", err)
+	}
+}
+
+func evaluateAlertRules(db *gorm.DB, rows []models.Vital) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	var vitalIDs, usernames []string
+	for _, row := range rows {
+		vitalIDs = append(vitalIDs, row.VitalID)
+		usernames = append(usernames, row.Username)
+	}
+
+	var rules []models.AlertRule
+	err := db.Where("active = ? AND vital_id IN (?)", true, uniqueStrings(vitalIDs)).
+		Where("patient = '' OR patient IN (?)", uniqueStrings(usernames)).
+		Order("id").Find(&rules).Error
+	if err != nil {
+		return fmt.Errorf("failed to get alert rules: %v", err)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	for _, row := range rows {
+		for _, rule := range rulesFor(rules, row) {
+			if row.Unit != rule.Unit {
+				// Readings stored before units were tracked cannot be compared.
+				continue
+			}
+			message, triggered, err := evaluateRule(db, rule, row)
+			if err != nil {
+				return err
+			}
+			if !triggered {
+				continue
+			}
+			if err := raiseAlert(db, rule, row, message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rulesFor picks the rules of rules that apply to row: those of its patient
+// for its series, and the global ones for its series of a kind the patient
+// has no rule of.
+func rulesFor(rules []models.AlertRule, row models.Vital) []models.AlertRule {
+	forSeries := func(rule models.AlertRule) bool {
+		return rule.VitalID == row.VitalID && rule.Component == row.Component
+	}
+
+	own := make(map[string]bool)
+	for _, rule := range rules {
+		if forSeries(rule) && rule.Patient == row.Username {
+			own[rule.Kind] = true
+		}
+	}
+
+	var applicable []models.AlertRule
+	for _, rule := range rules {
+		if !forSeries(rule) {
+			continue
+		}
+		if rule.Patient == row.Username || (rule.Patient == "" && !own[rule.Kind]) {
+			applicable = append(applicable, rule)
+		}
+	}
+	return applicable
+}
+
+// evaluateRule reports whether row triggers rule, with the message of the
+// alert if it does.
+func evaluateRule(db *gorm.DB, rule models.AlertRule, row models.Vital) (string, bool, error) {
+	switch rule.Kind {
+	case models.AlertThreshold:
+		message, triggered := thresholdBreach(rule, row.Value)
+		return message, triggered, nil
+
+	case models.AlertRateOfChange:
+		var low, high sql.NullFloat64
+		err := alertWindow(db, rule, row).Where("id <> ?", row.ID).Select("MIN(value), MAX(value)").Row().Scan(&low, &high)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to evaluate alert rule %d: %v", rule.ID, err)
+		}
+		if !low.Valid {
+			return "", false, nil
+		}
+		message, triggered := rateOfChange(rule, row.Value, low.Float64, high.Float64)
+		return message, triggered, nil
+
+	case models.AlertOutOfRangeCount:
+		if !outOfRange(rule, row.Value) {
+			return "", false, nil
+		}
+		var conditions []string
+		var args []interface{}
+		if rule.Low != nil {
+			conditions = append(conditions, "value < ?")
+			args = append(args, *rule.Low)
+		}
+		if rule.High != nil {
+			conditions = append(conditions, "value > ?")
+			args = append(args, *rule.High)
+		}
+		var count int
+		err := alertWindow(db, rule, row).Where(strings.Join(conditions, " OR "), args...).Count(&count).Error
+		if err != nil {
+			return "", false, fmt.Errorf("failed to evaluate alert rule %d: %v", rule.ID, err)
+		}
+		if count < rule.Count {
+			return "", false, nil
+		}
+		return fmt.Sprintf("%d %s readings outside %s within %d minutes",
+			count, seriesKey(rule.VitalID, rule.Component), rangeText(rule), rule.WindowMinutes), true, nil
+	}
+	return "", false, nil
+}
+
+// alertWindow selects the readings of the series of row, in its unit, from
+// the window of rule up to and including the time of row.
+func alertWindow(db *gorm.DB, rule models.AlertRule, row models.Vital) *gorm.DB {
+	from := row.Timestamp.Add(-time.Duration(rule.WindowMinutes) * time.Minute)
+	return db.Model(&models.Vital{}).
+		Where("username = ? AND vital_id = ? AND COALESCE(component, '') = ? AND unit = ?", row.Username, row.VitalID, row.Component, row.Unit).
+		Where("timestamp BETWEEN ? AND ?", from, row.Timestamp)
+}
+
+// thresholdBreach reports whether value is beyond the bounds of rule
+func thresholdBreach(rule models.AlertRule, value float64) (string, bool) {
+	key := seriesKey(rule.VitalID, rule.Component)
+	if rule.Low != nil && value < *rule.Low {
+		return fmt.Sprintf("%s of %s is below %s", key, valueText(value, rule.Unit), valueText(*rule.Low, rule.Unit)), true
+	}
+	if rule.High != nil && value > *rule.High {
+		return fmt.Sprintf("%s of %s is above %s", key, valueText(value, rule.Unit), valueText(*rule.High, rule.Unit)), true
+	}
+	return "", false
+}
+
+// rateOfChange reports whether value differs by the delta of rule or more
+// from the lowest or highest earlier reading in the window, low and high.
+func rateOfChange(rule models.AlertRule, value, low, high float64) (string, bool) {
+	key := seriesKey(rule.VitalID, rule.Component)
+	rise, fall := value-low, high-value
+	if rise >= *rule.Delta && rise >= fall {
+		return fmt.Sprintf("%s rose by %s within %d minutes, to %s",
+			key, valueText(rise, rule.Unit), rule.WindowMinutes, valueText(value, rule.Unit)), true
+	}
+	if fall >= *rule.Delta {
+		return fmt.Sprintf("%s fell by %s within %d minutes, to %s",
+			key, valueText(fall, rule.Unit), rule.WindowMinutes, valueText(value, rule.Unit)), true
+	}
+	return "", false
+}
+
+// outOfRange reports whether value is outside the bounds of rule
+func outOfRange(rule models.AlertRule, value float64) bool {
+	return (rule.Low != nil && value < *rule.Low) || (rule.High != nil && value > *rule.High)
+}
+
+// raiseAlert records an alert of rule for row, unless one raised by the
+// rule for the patient is still unresolved. The unique index over the
+// unresolved alerts of each rule and patient decides between concurrent
+// inserts, the loser of which inserts nothing.
+func raiseAlert(db *gorm.DB, rule models.AlertRule, row models.Vital, message string) error {
+	alert := models.Alert{
+		RuleID:     rule.ID,
+		Patient:    row.Username,
+		VitalID:    row.VitalID,
+		Component:  row.Component,
+		VitalRowID: row.ID,
+		Value:      row.Value,
+		Unit:       row.Unit,
+		ObservedAt: row.Timestamp,
+		Severity:   rule.Severity,
+		Message:    message,
+		Status:     models.AlertOpen,
+	}
+	err := db.Set("gorm:insert_option", fmt.Sprintf("ON CONFLICT (rule_id, patient) WHERE status <> '%s' AND deleted_at IS NULL DO NOTHING", models.AlertResolved)).
+		Create(&alert).Error
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to record alert: %v", err)
+	}
+	logrus.WithFields(logrus.Fields{"patient": alert.Patient, "rule": rule.ID, "severity": alert.Severity}).Warnf("Alert raised: %s", message)
+	return nil
+}
+
+// valueText formats a value in unit for an alert message
+func valueText(value float64, unit string) string {
+	text := strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+	if unit == "" {
+		return text
+	}
+	return text + " " + unit
+}
+
+// rangeText describes the bounds of rule for an alert message
+func rangeText(rule models.AlertRule) string {
+	switch {
+	case rule.Low != nil && rule.High != nil:
+		return fmt.Sprintf("%s to %s", valueText(*rule.Low, ""), valueText(*rule.High, rule.Unit))
+	case rule.Low != nil:
+		return "at least " + valueText(*rule.Low, rule.Unit)
+	default:
+		return "at most " + valueText(*rule.High, rule.Unit)
+	}
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func float(value float64) *float64 {
+	return &value
+}
+
+func TestThresholdBreach(t *testing.T) {
+	rule := models.AlertRule{VitalID: "heart_rate", Unit: "bpm", Low: float(40), High: float(150)}
+
+	message, triggered := thresholdBreach(rule, 190)
+	assert.True(t, triggered)
+	assert.Equal(t, "heart_rate of 190 bpm is above 150 bpm", message)
+
+	message, triggered = thresholdBreach(rule, 35.5)
+	assert.True(t, triggered)
+	assert.Equal(t, "heart_rate of 35.5 bpm is below 40 bpm", message)
+
+	_, triggered = thresholdBreach(rule, 150)
+	assert.False(t, triggered, "Bounds should be inclusive")
+
+	_, triggered = thresholdBreach(models.AlertRule{VitalID: "heart_rate", High: float(150)}, 10)
+	assert.False(t, triggered, "A missing bound should not be checked")
+}
+
+func TestRateOfChange(t *testing.T) {
+	rule := models.AlertRule{VitalID: "heart_rate", Unit: "bpm", Delta: float(30), WindowMinutes: 10}
+
+	message, triggered := rateOfChange(rule, 120, 85, 90)
+	assert.True(t, triggered)
+	assert.Equal(t, "heart_rate rose by 35 bpm within 10 minutes, to 120 bpm", message)
+
+	message, triggered = rateOfChange(rule, 50, 80, 95)
+	assert.True(t, triggered)
+	assert.Equal(t, "heart_rate fell by 45 bpm within 10 minutes, to 50 bpm", message)
+
+	_, triggered = rateOfChange(rule, 100, 80, 95)
+	assert.False(t, triggered)
+}
+
+func TestOutOfRange(t *testing.T) {
+	rule := models.AlertRule{Low: float(90), High: float(140)}
+	assert.True(t, outOfRange(rule, 89))
+	assert.True(t, outOfRange(rule, 141))
+	assert.False(t, outOfRange(rule, 90))
+	assert.False(t, outOfRange(models.AlertRule{Low: float(90)}, 200))
+}
+
+func TestRulesFor(t *testing.T) {
+	globalThreshold := models.AlertRule{Kind: models.AlertThreshold, VitalID: "heart_rate"}
+	globalRate := models.AlertRule{Kind: models.AlertRateOfChange, VitalID: "heart_rate"}
+	ownThreshold := models.AlertRule{Kind: models.AlertThreshold, Patient: "JohnDoe", VitalID: "heart_rate"}
+	otherThreshold := models.AlertRule{Kind: models.AlertThreshold, Patient: "JaneDoe", VitalID: "heart_rate"}
+	systolic := models.AlertRule{Kind: models.AlertThreshold, VitalID: "blood_pressure", Component: "systolic"}
+	rules := []models.AlertRule{globalThreshold, globalRate, ownThreshold, otherThreshold, systolic}
+
+	applicable := rulesFor(rules, models.Vital{Username: "JohnDoe", VitalID: "heart_rate"})
+	assert.Equal(t, []models.AlertRule{globalRate, ownThreshold}, applicable, "A patient's rule should override the global rule of its kind")
+
+	applicable = rulesFor(rules, models.Vital{Username: "Someone", VitalID: "heart_rate"})
+	assert.Equal(t, []models.AlertRule{globalThreshold, globalRate}, applicable)
+
+	applicable = rulesFor(rules, models.Vital{Username: "JohnDoe", VitalID: "blood_pressure", Component: "diastolic"})
+	assert.Empty(t, applicable)
+}
+
+func TestRangeText(t *testing.T) {
+	assert.Equal(t, "90 to 140 mmHg", rangeText(models.AlertRule{Unit: "mmHg", Low: float(90), High: float(140)}))
+	assert.Equal(t, "at least 92 %", rangeText(models.AlertRule{Unit: "%", Low: float(92)}))
+	assert.Equal(t, "at most 37.33", rangeText(models.AlertRule{High: float(37.333)}))
+}
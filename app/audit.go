@@ -0,0 +1,169 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"medical-vitals-management-system/models"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// auditLockKey is the PostgreSQL advisory lock that serializes appends to the
+// audit chain across processes.
+const auditLockKey = 7261736901
+
+// auditVerifyBatch is how many entries VerifyAuditChain reads at a time
+const auditVerifyBatch = 1000
+
+// auditMu serializes appends to the audit chain within this process
+var auditMu sync.Mutex
+
+// AppendAuditEntry adds entry to the end of the audit chain, linking it to
+// the last entry. Times are kept to the microsecond, the precision the
+// database stores, so that hashes can be recomputed from stored entries.
+func AppendAuditEntry(db *gorm.DB, entry models.AuditEntry) (models.AuditEntry, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	entry.ID = 0
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC().Truncate(time.Microsecond)
+
+	tx := db.Begin()
+	if db.Dialect().GetName() == "postgres" {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditLockKey).Error; err != nil {
+			tx.Rollback()
+			return entry, fmt.Errorf("failed to lock the audit log: %v", err)
+		}
+	}
+
+	var last models.AuditEntry
+	err := tx.Order("id DESC").First(&last).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		tx.Rollback()
+		return entry, fmt.Errorf("failed to read the audit log: %v", err)
+	}
+
+	entry.PrevHash = last.Hash
+	entry.Hash = auditHash(entry)
+	if err := tx.Create(&entry).Error; err != nil {
+		tx.Rollback()
+		return entry, fmt.Errorf("failed to write audit entry: %v", err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return entry, fmt.Errorf("failed to write audit entry: %v", err)
+	}
+	return entry, nil
+}
+
+// auditHash hashes the contents of an entry together with the hash of the
+// entry before it. Fields are length-prefixed so that no two entries hash
+// the same input.
+func auditHash(entry models.AuditEntry) string {
+	sum := sha256.New()
+	for _, field := range []string{
+		entry.PrevHash,
+		entry.Time.UTC().Format(time.RFC3339Nano),
+		entry.Actor,
+		entry.Patient,
+		entry.Action,
+		entry.Resource,
+		entry.RequestID,
+		entry.ClientIP,
+		strconv.Itoa(entry.Status),
+		entry.Outcome,
+	} {
+		fmt.Fprintf(sum, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// GetAuditEntries returns the audit entries matching query, newest first
+func GetAuditEntries(db *gorm.DB, query models.AuditQuery) ([]models.AuditEntry, error) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit < 0 || limit > maxPageSize {
+		return nil, validationErrorf("limit must be between 1 and %d", maxPageSize)
+	}
+
+	scope := db
+	for column, value := range map[string]string{
+		"actor":      query.Actor,
+		"patient":    query.Patient,
+		"action":     query.Action,
+		"outcome":    query.Outcome,
+		"request_id": query.RequestID,
+	} {
+		if value != "" {
+			scope = scope.Where(column+" = ?", value)
+		}
+	}
+	if query.From != nil {
+		scope = scope.Where("time >= ?", *query.From)
+	}
+	if query.To != nil {
+		scope = scope.Where("time <= ?", *query.To)
+	}
+	if query.BeforeID != 0 {
+		scope = scope.Where("id < ?", query.BeforeID)
+	}
+
+	entries := []models.AuditEntry{}
+	if err := scope.Order("id DESC").Limit(limit).Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to get audit entries: %v", err)
+	}
+	return entries, nil
+}
+
+// VerifyAuditChain recomputes the hash of every audit entry, oldest first,
+// and checks that each links to the entry before it. Entries removed from
+// the end of the log cannot be detected this way; every other alteration,
+// insertion or removal can.
+func VerifyAuditChain(db *gorm.DB) (models.AuditVerification, error) {
+	var verification models.AuditVerification
+	prevHash := ""
+	var lastID uint
+	for {
+		var entries []models.AuditEntry
+		err := db.Where("id > ?", lastID).Order("id").Limit(auditVerifyBatch).Find(&entries).Error
+		if err != nil {
+			return verification, fmt.Errorf("failed to read the audit log: %v", err)
+		}
+
+		for _, entry := range entries {
+			if reason := verifyAuditEntry(entry, prevHash); reason != "" {
+				verification.BrokenAt = entry.ID
+				verification.Reason = reason
+				return verification, nil
+			}
+			verification.Entries++
+			prevHash = entry.Hash
+			lastID = entry.ID
+		}
+
+		if len(entries) < auditVerifyBatch {
+			verification.Valid = true
+			return verification, nil
+		}
+	}
+}
+
+// verifyAuditEntry checks one entry against the hash of the entry before it,
+// returning why it does not match or an empty string if it does.
+func verifyAuditEntry(entry models.AuditEntry, prevHash string) string {
+	if entry.PrevHash != prevHash {
+		return "the entry does not link to the entry before it"
+	}
+	if auditHash(entry) != entry.Hash {
+		return "the entry does not match its hash"
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func auditChain(entries ...models.AuditEntry) []models.AuditEntry {
+	prevHash := ""
+	for i := range entries {
+		entries[i].ID = uint(i + 1)
+		entries[i].PrevHash = prevHash
+		entries[i].Hash = auditHash(entries[i])
+		prevHash = entries[i].Hash
+	}
+	return entries
+}
+
+func TestAuditChain(t *testing.T) {
+	at := time.Date(2023, 1, 1, 8, 0, 0, 123456000, time.UTC)
+	chain := auditChain(
+		models.AuditEntry{Time: at, Actor: "dr.smith", Patient: "JohnDoe", Action: "read", Resource: "GET /api/v1/users/:username/vitals", RequestID: "a", Status: 200, Outcome: "success"},
+		models.AuditEntry{Time: at, Actor: "dr.smith", Patient: "JohnDoe", Action: "update", Resource: "PUT /api/v1/users/:username/vitals/:vital_id", RequestID: "b", Status: 200, Outcome: "success"},
+		models.AuditEntry{Time: at, Actor: "anonymous", Action: "read", Resource: "GET /api/v1/audit", RequestID: "c", Status: 200, Outcome: "success"},
+	)
+
+	prevHash := ""
+	for _, entry := range chain {
+		assert.Empty(t, verifyAuditEntry(entry, prevHash))
+		prevHash = entry.Hash
+	}
+
+	reloaded := chain[0]
+	reloaded.Time = reloaded.Time.In(time.FixedZone("CET", 3600))
+	assert.Empty(t, verifyAuditEntry(reloaded, ""), "Hashes should not depend on the time zone an entry is read in")
+
+	tampered := chain[1]
+	tampered.Actor = "someone.else"
+	assert.NotEmpty(t, verifyAuditEntry(tampered, chain[0].Hash), "An altered entry should not match its hash")
+
+	assert.NotEmpty(t, verifyAuditEntry(chain[2], chain[0].Hash), "Removing an entry should break the link of the next one")
+}
+
+func TestAuditHashFieldBoundaries(t *testing.T) {
+	a := models.AuditEntry{Actor: "ab", Patient: "c"}
+	b := models.AuditEntry{Actor: "a", Patient: "bc"}
+	assert.NotEqual(t, auditHash(a), auditHash(b), "Moving text between fields should change the hash")
+}
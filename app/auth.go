@@ -0,0 +1,305 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"medical-vitals-management-system/models"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	// minPasswordLength is the shortest password a user may set
+	minPasswordLength = 8
+	// minSecretLength is the shortest JWT_SECRET, in bytes, that is used
+	// without a warning.
+	minSecretLength = 32
+)
+
+// dummyPasswordHash is compared against when a login names an unknown user,
+// so that the response takes as long as for a wrong password.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+var (
+	ephemeralSecret     []byte
+	ephemeralSecretOnce sync.Once
+)
+
+// AuthSettings controls how tokens are signed and how long they last
+type AuthSettings struct {
+	// Secret signs access tokens.
+	Secret []byte
+	// AccessTTL is the lifetime of an access token.
+	AccessTTL time.Duration
+	// RefreshTTL is the lifetime of a refresh token.
+	RefreshTTL time.Duration
+}
+
+// AuthSettingsFromEnv reads the auth settings from JWT_SECRET,
+// AUTH_ACCESS_TOKEN_TTL and AUTH_REFRESH_TOKEN_TTL, the lifetimes being Go
+// durations such as 15m. Without a secret, tokens are signed with a random
+// one that lasts until the process exits.
+func AuthSettingsFromEnv() AuthSettings {
+	settings := AuthSettings{
+		Secret:     []byte(os.Getenv("JWT_SECRET")),
+		AccessTTL:  defaultAccessTokenTTL,
+		RefreshTTL: defaultRefreshTokenTTL,
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("AUTH_ACCESS_TOKEN_TTL")); err == nil && ttl > 0 {
+		settings.AccessTTL = ttl
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("AUTH_REFRESH_TOKEN_TTL")); err == nil && ttl > 0 {
+		settings.RefreshTTL = ttl
+	}
+
+	if len(settings.Secret) == 0 {
+		ephemeralSecretOnce.Do(func() {
+			logrus.Warn("JWT_SECRET is not set; tokens will not survive a restart")
+			ephemeralSecret = randomBytes(minSecretLength)
+		})
+		settings.Secret = ephemeralSecret
+	} else if len(settings.Secret) < minSecretLength {
+		logrus.Warnf("JWT_SECRET is shorter than %d bytes", minSecretLength)
+	}
+	return settings
+}
+
+// SetPassword sets the password username logs in with
+func SetPassword(db *gorm.DB, username, password string) error {
+	if len(password) < minPasswordLength {
+		return validationErrorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return validationErrorf("invalid password: %v", err)
+	}
+
+	credential := models.Credential{Username: username}
+	err = db.Where(models.Credential{Username: username}).
+		Assign(models.Credential{PasswordHash: string(hash)}).
+		FirstOrCreate(&credential).Error
+	if err != nil {
+		return fmt.Errorf("failed to set password: %v", err)
+	}
+	return nil
+}
+
+// ChangePassword replaces the password of username after checking the
+// current one, and signs the user out everywhere else by revoking every
+// refresh token.
+func ChangePassword(db *gorm.DB, username string, request models.ChangePasswordRequest) error {
+	if err := checkPassword(db, username, request.CurrentPassword); err != nil {
+		return err
+	}
+	if err := SetPassword(db, username, request.NewPassword); err != nil {
+		return err
+	}
+	return revokeRefreshTokens(db, "username = ?", username)
+}
+
+// ResetPassword sets the password of username without the current one, for
+// admins and for users created before logins were required, who have none.
+// The user is signed out everywhere.
+func ResetPassword(db *gorm.DB, username, password string) error {
+	exists, err := UserExists(db, username)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return notFoundErrorf("user %s not found", username)
+	}
+	if err := SetPassword(db, username, password); err != nil {
+		return err
+	}
+	return revokeRefreshTokens(db, "username = ?", username)
+}
+
+// Login checks a user's password and issues a new pair of tokens
+func Login(db *gorm.DB, settings AuthSettings, request models.LoginRequest) (models.TokenPair, error) {
+	if err := checkPassword(db, request.Username, request.Password); err != nil {
+		return models.TokenPair{}, err
+	}
+	return issueTokens(db, settings, request.Username, newTokenID())
+}
+
+func checkPassword(db *gorm.DB, username, password string) error {
+	var credential models.Credential
+	err := db.Where("username = ?", username).First(&credential).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("failed to check credentials: %v", err)
+	}
+
+	hash := []byte(credential.PasswordHash)
+	if err != nil {
+		hash = dummyPasswordHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || err != nil {
+		return authErrorf("invalid username or password")
+	}
+	return nil
+}
+
+// RefreshTokens exchanges a refresh token for a new pair of tokens. The
+// refresh token is revoked; presenting it again revokes every token of its
+// family, since it has most likely been stolen.
+func RefreshTokens(db *gorm.DB, settings AuthSettings, refreshToken string) (models.TokenPair, error) {
+	var stored models.RefreshToken
+	err := db.Where("token_hash = ?", hashToken(refreshToken)).First(&stored).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return models.TokenPair{}, authErrorf("invalid refresh token")
+		}
+		return models.TokenPair{}, fmt.Errorf("failed to check refresh token: %v", err)
+	}
+
+	if stored.RevokedAt != nil {
+		logrus.WithField("username", stored.Username).Warn("Revoked refresh token presented; revoking its family")
+		if err := revokeRefreshTokens(db, "family = ?", stored.Family); err != nil {
+			return models.TokenPair{}, err
+		}
+		return models.TokenPair{}, authErrorf("refresh token has been revoked")
+	}
+	if !time.Now().Before(stored.ExpiresAt) {
+		return models.TokenPair{}, authErrorf("refresh token has expired")
+	}
+
+	// Only one of two concurrent refreshes with the same token may win.
+	result := db.Model(&models.RefreshToken{}).Where("id = ? AND revoked_at IS NULL", stored.ID).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return models.TokenPair{}, fmt.Errorf("failed to revoke refresh token: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return models.TokenPair{}, authErrorf("refresh token has been revoked")
+	}
+	return issueTokens(db, settings, stored.Username, stored.Family)
+}
+
+// Logout revokes the access token of principal and either the given refresh
+// token or, if request.All is set, every refresh token of the principal.
+func Logout(db *gorm.DB, principal models.Principal, request models.LogoutRequest) error {
+	revoked := models.RevokedToken{TokenID: principal.TokenID, ExpiresAt: principal.ExpiresAt}
+	if err := db.Where(models.RevokedToken{TokenID: principal.TokenID}).FirstOrCreate(&revoked).Error; err != nil {
+		return fmt.Errorf("failed to revoke access token: %v", err)
+	}
+	if err := db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{}).Error; err != nil {
+		logrus.Warnf("Failed to purge expired revoked tokens: %v", err)
+	}
+
+	if request.All {
+		return revokeRefreshTokens(db, "username = ?", principal.Username)
+	}
+	if request.RefreshToken != "" {
+		return revokeRefreshTokens(db, "username = ? AND token_hash = ?", principal.Username, hashToken(request.RefreshToken))
+	}
+	return nil
+}
+
+// ParseAccessToken authenticates the caller presenting an access token
+func ParseAccessToken(db *gorm.DB, settings AuthSettings, token string) (models.Principal, error) {
+	claims, err := verifyJWT(token, settings.Secret, time.Now())
+	if err != nil {
+		return models.Principal{}, err
+	}
+
+	var count int64
+	if err := db.Model(&models.RevokedToken{}).Where("token_id = ?", claims.ID).Count(&count).Error; err != nil {
+		return models.Principal{}, fmt.Errorf("failed to check token revocation: %v", err)
+	}
+	if count > 0 {
+		return models.Principal{}, authErrorf("access token has been revoked")
+	}
+
+	// The role is looked up on every request, so that role changes take
+	// effect without waiting for tokens to expire.
+	var user models.User
+	if err := db.Where("username = ?", claims.Subject).First(&user).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return models.Principal{}, authErrorf("the user of this access token no longer exists")
+		}
+		return models.Principal{}, fmt.Errorf("failed to check user existence: %v", err)
+	}
+	permissions, err := rolePermissions(db, user.Role)
+	if err != nil {
+		return models.Principal{}, err
+	}
+
+	return models.Principal{
+		Username:    claims.Subject,
+		Role:        user.Role,
+		Permissions: permissions,
+		TokenID:     claims.ID,
+		ExpiresAt:   time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
+
+// issueTokens signs a new access token for username and stores a new
+// refresh token in family.
+func issueTokens(db *gorm.DB, settings AuthSettings, username, family string) (models.TokenPair, error) {
+	now := time.Now()
+	accessToken, err := signJWT(accessClaims{
+		Issuer:    jwtIssuer,
+		Subject:   username,
+		ID:        newTokenID(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(settings.AccessTTL).Unix(),
+	}, settings.Secret)
+	if err != nil {
+		return models.TokenPair{}, fmt.Errorf("failed to sign access token: %v", err)
+	}
+
+	refreshToken := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	err = db.Create(&models.RefreshToken{
+		Username:  username,
+		TokenHash: hashToken(refreshToken),
+		Family:    family,
+		ExpiresAt: now.Add(settings.RefreshTTL),
+	}).Error
+	if err != nil {
+		return models.TokenPair{}, fmt.Errorf("failed to store refresh token: %v", err)
+	}
+
+	return models.TokenPair{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(settings.AccessTTL / time.Second),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func revokeRefreshTokens(db *gorm.DB, where string, args ...interface{}) error {
+	err := db.Model(&models.RefreshToken{}).Where(where, args...).Where("revoked_at IS NULL").
+		Update("revoked_at", time.Now()).Error
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %v", err)
+	}
+	return nil
+}
+
+// hashToken is how refresh tokens are stored, so that a copy of the database
+// cannot be used to sign in.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTokenID() string {
+	return hex.EncodeToString(randomBytes(16))
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return b
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testClaims(now time.Time) accessClaims {
+	return accessClaims{
+		Issuer:    jwtIssuer,
+		Subject:   "JohnDoe",
+		ID:        "token-1",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(15 * time.Minute).Unix(),
+	}
+}
+
+func TestJWTRoundTrip(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	token, err := signJWT(testClaims(now), secret)
+	assert.NoError(t, err)
+
+	claims, err := verifyJWT(token, secret, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, testClaims(now), claims)
+
+	_, err = verifyJWT(token, []byte("another secret of thirty-two bytes"), now)
+	assert.True(t, IsAuthError(err), "A token signed with another secret should be rejected")
+
+	_, err = verifyJWT(token, secret, now.Add(15*time.Minute))
+	assert.True(t, IsAuthError(err), "An expired token should be rejected")
+
+	_, err = verifyJWT(token, secret, now.Add(-2*jwtLeeway))
+	assert.True(t, IsAuthError(err), "A token issued in the future should be rejected")
+}
+
+func TestJWTTampering(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	token, _ := signJWT(testClaims(now), secret)
+	parts := strings.Split(token, ".")
+
+	forged := testClaims(now)
+	forged.Subject = "JaneDoe"
+	forgedToken, _ := signJWT(forged, []byte("attacker secret"))
+	forgedParts := strings.Split(forgedToken, ".")
+	_, err := verifyJWT(parts[0]+"."+forgedParts[1]+"."+parts[2], secret, now)
+	assert.True(t, IsAuthError(err), "Changing the claims should invalidate the signature")
+
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	_, err = verifyJWT(none+"."+parts[1]+".", secret, now)
+	assert.True(t, IsAuthError(err), "Unsigned tokens should be rejected")
+
+	_, err = verifyJWT("not-a-token", secret, now)
+	assert.True(t, IsAuthError(err))
+
+	foreign := testClaims(now)
+	foreign.Issuer = "someone-else"
+	foreignToken, _ := signJWT(foreign, secret)
+	_, err = verifyJWT(foreignToken, secret, now)
+	assert.True(t, IsAuthError(err), "Tokens of another issuer should be rejected")
+}
+
+func TestHashToken(t *testing.T) {
+	assert.Equal(t, hashToken("refresh"), hashToken("refresh"))
+	assert.NotEqual(t, hashToken("refresh"), hashToken("refresh2"))
+	assert.NotContains(t, hashToken("refresh"), "refresh")
+	assert.NotEqual(t, newTokenID(), newTokenID())
+}
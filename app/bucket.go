@@ -0,0 +1,115 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"time"
+)
+
+// Bucket intervals that can be requested in models.AggregateRequest
+const (
+	IntervalHour = "hour"
+	IntervalDay  = "day"
+	IntervalWeek = "week"
+)
+
+// maxBuckets bounds the length of a series so that a long window with a
+// short interval cannot produce an unbounded response.
+const maxBuckets = 10000
+
+// loadLocation resolves the IANA timezone buckets are aligned to, UTC if
+// none is given.
+func loadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, validationErrorf("unknown timezone: %s", timezone)
+	}
+	return location, nil
+}
+
+// bucketStart returns the start of the bucket containing t. Boundaries fall
+// on local midnight, or local Monday midnight for weeks, so days across a
+// daylight saving change are 23 or 25 hours long.
+func bucketStart(t time.Time, interval string, location *time.Location) time.Time {
+	local := t.In(location)
+	switch interval {
+	case IntervalHour:
+		return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, location)
+	case IntervalWeek:
+		daysSinceMonday := (int(local.Weekday()) + 6) % 7
+		return time.Date(local.Year(), local.Month(), local.Day()-daysSinceMonday, 0, 0, 0, 0, location)
+	default:
+		return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	}
+}
+
+// nextBucketStart returns the start of the bucket following the one that
+// starts at start.
+func nextBucketStart(start time.Time, interval string) time.Time {
+	switch interval {
+	case IntervalHour:
+		return start.Add(time.Hour)
+	case IntervalWeek:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// bucketBoundaries returns the boundaries of the buckets covering the window
+// from start to end inclusive: bucket i spans [boundaries[i], boundaries[i+1]).
+func bucketBoundaries(start, end time.Time, interval string, location *time.Location) ([]time.Time, error) {
+	switch interval {
+	case IntervalHour, IntervalDay, IntervalWeek:
+	default:
+		return nil, validationErrorf("invalid interval: %s", interval)
+	}
+	if end.Before(start) {
+		return nil, validationErrorf("end_timestamp must not be before start_timestamp")
+	}
+
+	boundaries := []time.Time{bucketStart(start, interval, location)}
+	for !boundaries[len(boundaries)-1].After(end) {
+		if len(boundaries) > maxBuckets {
+			return nil, validationErrorf("interval %s produces more than %d buckets for the requested window", interval, maxBuckets)
+		}
+		boundaries = append(boundaries, nextBucketStart(boundaries[len(boundaries)-1], interval))
+	}
+	return boundaries, nil
+}
+
+// timedValue is a reading value with the time it was taken
+type timedValue struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// bucketSeries splits values, which must be in time order, into the buckets
+// described by boundaries and computes statistics for each. Buckets without
+// readings are kept and flagged as empty.
+func bucketSeries(values []timedValue, boundaries []time.Time, set statisticSet, unit string) []models.AggregateBucket {
+	buckets := make([]models.AggregateBucket, 0, len(boundaries)-1)
+
+	next := 0
+	for i := 0; i+1 < len(boundaries); i++ {
+		start, end := boundaries[i], boundaries[i+1]
+
+		var bucketValues []float64
+		for next < len(values) && values[next].Timestamp.Before(end) {
+			if !values[next].Timestamp.Before(start) {
+				bucketValues = append(bucketValues, values[next].Value)
+			}
+			next++
+		}
+
+		bucket := models.AggregateBucket{Start: start, End: end, Empty: true}
+		if stats, ok := computeStatistics(bucketValues, set, unit); ok {
+			bucket.Empty = false
+			bucket.Statistics = &stats
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketBoundariesAcrossDST(t *testing.T) {
+	location, err := loadLocation("America/New_York")
+	assert.NoError(t, err, "Error loading timezone")
+
+	// Clocks in New York go forward on 2023-03-12, making that day 23 hours long.
+	start := time.Date(2023, 3, 11, 12, 0, 0, 0, location)
+	end := time.Date(2023, 3, 13, 12, 0, 0, 0, location)
+
+	boundaries, err := bucketBoundaries(start, end, IntervalDay, location)
+	assert.NoError(t, err, "Error computing bucket boundaries")
+	assert.Len(t, boundaries, 4, "Three daily buckets should cover the window")
+	assert.Equal(t, time.Date(2023, 3, 11, 0, 0, 0, 0, location), boundaries[0], "Buckets should start at local midnight")
+	assert.Equal(t, 23*time.Hour, boundaries[2].Sub(boundaries[1]), "DST day should be 23 hours long")
+}
+
+func TestBucketBoundariesWeek(t *testing.T) {
+	start := time.Date(2023, 1, 4, 10, 0, 0, 0, time.UTC) // Wednesday
+	end := time.Date(2023, 1, 10, 10, 0, 0, 0, time.UTC)
+
+	boundaries, err := bucketBoundaries(start, end, IntervalWeek, time.UTC)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), boundaries[0], "Weeks should start on Monday")
+	assert.Len(t, boundaries, 3)
+
+	_, err = bucketBoundaries(start, end, "fortnight", time.UTC)
+	assert.True(t, IsValidationError(err), "Unknown interval should be rejected")
+}
+
+func TestBucketSeriesFlagsEmptyBuckets(t *testing.T) {
+	set, _ := parseStatistics([]string{"mean", "count"})
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	boundaries, err := bucketBoundaries(base, base.Add(150*time.Minute), IntervalHour, time.UTC)
+	assert.NoError(t, err)
+
+	values := []timedValue{
+		{Timestamp: base.Add(10 * time.Minute), Value: 70},
+		{Timestamp: base.Add(50 * time.Minute), Value: 80},
+		{Timestamp: base.Add(130 * time.Minute), Value: 90},
+	}
+
+	buckets := bucketSeries(values, boundaries, set, "bpm")
+	assert.Len(t, buckets, 3)
+	assert.False(t, buckets[0].Empty)
+	assert.Equal(t, 75.0, *buckets[0].Statistics.Mean)
+	assert.True(t, buckets[1].Empty, "Hour without readings should be flagged as empty")
+	assert.Nil(t, buckets[1].Statistics)
+	assert.Equal(t, 1, buckets[2].Statistics.Count)
+}
@@ -0,0 +1,259 @@
+package app
+
+import (
+	"fmt"
+	"medical-vitals-management-system/models"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// activeAt narrows a query of clinician assignments to those in effect at
+func activeAt(query *gorm.DB, at time.Time) *gorm.DB {
+	return query.Where("start_date <= ? AND (end_date IS NULL OR end_date > ?)", at, at)
+}
+
+// CreateCareTeam adds a care team that patients can be assigned to
+func CreateCareTeam(db *gorm.DB, team models.CareTeam) error {
+	team.Name = strings.TrimSpace(team.Name)
+	if team.Name == "" {
+		return validationErrorf("name is required")
+	}
+
+	var count int64
+	if err := db.Model(&models.CareTeam{}).Where("name = ?", team.Name).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check care team: %v", err)
+	}
+	if count > 0 {
+		return validationErrorf("care team %s already exists", team.Name)
+	}
+
+	if err := db.Create(&team).Error; err != nil {
+		return fmt.Errorf("failed to create care team: %v", err)
+	}
+	return nil
+}
+
+// GetCareTeams lists the care teams by name
+func GetCareTeams(db *gorm.DB) ([]models.CareTeam, error) {
+	var teams []models.CareTeam
+	if err := db.Order("name").Find(&teams).Error; err != nil {
+		return nil, fmt.Errorf("failed to get care teams: %v", err)
+	}
+	return teams, nil
+}
+
+// GetAssignments lists the clinician assignments of patient, most recent
+// first, or only those in effect now if activeOnly is set.
+func GetAssignments(db *gorm.DB, patient string, activeOnly bool) ([]models.ClinicianAssignment, error) {
+	query := db.Where("patient = ?", patient)
+	if activeOnly {
+		query = activeAt(query, time.Now())
+	}
+
+	var assignments []models.ClinicianAssignment
+	if err := query.Order("start_date DESC, id DESC").Find(&assignments).Error; err != nil {
+		return nil, fmt.Errorf("failed to get clinician assignments: %v", err)
+	}
+	return assignments, nil
+}
+
+// AssignedPatients lists the patients in the care of clinician now
+func AssignedPatients(db *gorm.DB, clinician string) ([]string, error) {
+	var patients []string
+	query := db.Model(&models.ClinicianAssignment{}).Where("clinician = ?", clinician)
+	if err := activeAt(query, time.Now()).Pluck("patient", &patients).Error; err != nil {
+		return nil, fmt.Errorf("failed to get clinician assignments: %v", err)
+	}
+	return uniqueStrings(patients), nil
+}
+
+// AssignClinician puts patient in the care of the clinician in request. The
+// clinician's role must grant access to assigned patients, and the period
+// must not overlap another assignment of the same clinician to patient.
+func AssignClinician(db *gorm.DB, patient string, request models.AssignmentRequest, assignedBy string) (models.ClinicianAssignment, error) {
+	assignment := models.ClinicianAssignment{
+		Clinician:  request.Clinician,
+		Patient:    patient,
+		CareTeam:   request.CareTeam,
+		StartDate:  time.Now(),
+		EndDate:    request.EndDate,
+		AssignedBy: assignedBy,
+	}
+	if request.StartDate != nil {
+		assignment.StartDate = *request.StartDate
+	}
+	if assignment.EndDate != nil && !assignment.EndDate.After(assignment.StartDate) {
+		return assignment, validationErrorf("end_date must be after start_date")
+	}
+	if assignment.Clinician == patient {
+		return assignment, validationErrorf("%s cannot be assigned to themselves", patient)
+	}
+
+	var clinician models.User
+	if err := db.Where("username = ?", assignment.Clinician).First(&clinician).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return assignment, notFoundErrorf("clinician %s not found", assignment.Clinician)
+		}
+		return assignment, fmt.Errorf("failed to get clinician: %v", err)
+	}
+	permissions, err := rolePermissions(db, clinician.Role)
+	if err != nil {
+		return assignment, err
+	}
+	if !HasPermission(models.Principal{Permissions: permissions}, models.PermAccessAssigned) {
+		return assignment, validationErrorf("%s is not a clinician", assignment.Clinician)
+	}
+
+	if assignment.CareTeam != "" {
+		var count int64
+		if err := db.Model(&models.CareTeam{}).Where("name = ?", assignment.CareTeam).Count(&count).Error; err != nil {
+			return assignment, fmt.Errorf("failed to check care team: %v", err)
+		}
+		if count == 0 {
+			return assignment, validationErrorf("unknown care team %s", assignment.CareTeam)
+		}
+	}
+
+	overlapping := db.Model(&models.ClinicianAssignment{}).
+		Where("clinician = ? AND patient = ?", assignment.Clinician, patient).
+		Where("end_date IS NULL OR (end_date > ? AND end_date > start_date)", assignment.StartDate)
+	if assignment.EndDate != nil {
+		overlapping = overlapping.Where("start_date < ?", *assignment.EndDate)
+	}
+	var count int64
+	if err := overlapping.Count(&count).Error; err != nil {
+		return assignment, fmt.Errorf("failed to check clinician assignments: %v", err)
+	}
+	if count > 0 {
+		return assignment, validationErrorf("%s is already assigned to %s for part of that period", assignment.Clinician, patient)
+	}
+
+	if err := db.Create(&assignment).Error; err != nil {
+		return assignment, fmt.Errorf("failed to assign clinician: %v", err)
+	}
+	return assignment, nil
+}
+
+// UnassignClinician ends the assignment of clinician to patient in effect
+// at, along with any that would have started later.
+func UnassignClinician(db *gorm.DB, patient, clinician string, at time.Time) error {
+	pair := func() *gorm.DB {
+		return db.Model(&models.ClinicianAssignment{}).Where("clinician = ? AND patient = ?", clinician, patient)
+	}
+
+	result := activeAt(pair(), at).Update("end_date", at)
+	if result.Error != nil {
+		return fmt.Errorf("failed to unassign clinician: %v", result.Error)
+	}
+	// Upcoming assignments end before they start, which keeps them on record.
+	upcoming := pair().Where("start_date > ?", at).Update("end_date", gorm.Expr("start_date"))
+	if upcoming.Error != nil {
+		return fmt.Errorf("failed to unassign clinician: %v", upcoming.Error)
+	}
+	if result.RowsAffected+upcoming.RowsAffected == 0 {
+		return notFoundErrorf("%s is not assigned to %s", clinician, patient)
+	}
+	return nil
+}
+
+// GetClinicianPanel lists the patients in the care of clinician now, by
+// username, each with the latest reading of every vital and whether it is
+// outside the normal range.
+func GetClinicianPanel(db *gorm.DB, clinician string) (models.ClinicianPanel, error) {
+	panel := models.ClinicianPanel{Clinician: clinician, AsOf: time.Now(), Patients: []models.PanelPatient{}}
+
+	var assignments []models.ClinicianAssignment
+	err := activeAt(db.Where("clinician = ?", clinician), panel.AsOf).Order("patient, start_date").Find(&assignments).Error
+	if err != nil {
+		return panel, fmt.Errorf("failed to get clinician assignments: %v", err)
+	}
+	if len(assignments) == 0 {
+		return panel, nil
+	}
+
+	patients := make(map[string]*models.PanelPatient)
+	var usernames []string
+	for _, assignment := range assignments {
+		patient, ok := patients[assignment.Patient]
+		if !ok {
+			patient = &models.PanelPatient{Username: assignment.Patient, AssignedSince: assignment.StartDate, LatestVitals: []models.PanelVital{}}
+			patients[assignment.Patient] = patient
+			usernames = append(usernames, assignment.Patient)
+		}
+		if assignment.CareTeam != "" {
+			patient.CareTeams = append(patient.CareTeams, assignment.CareTeam)
+		}
+	}
+
+	var users []models.User
+	if err := db.Where("username IN (?)", usernames).Find(&users).Error; err != nil {
+		return panel, fmt.Errorf("failed to get patients: %v", err)
+	}
+	for _, user := range users {
+		patients[user.Username].Age = user.Age
+		patients[user.Username].Gender = user.Gender
+	}
+
+	var latest []models.Vital
+	err = db.Raw(`SELECT DISTINCT ON (username, vital_id, component) * FROM vitals
+		WHERE username IN (?) AND deleted_at IS NULL
+		ORDER BY username, vital_id, component, timestamp DESC, id DESC`, usernames).Scan(&latest).Error
+	if err != nil {
+		return panel, fmt.Errorf("failed to get latest vitals: %v", err)
+	}
+	vitalTypes, err := GetVitalTypes(db, false)
+	if err != nil {
+		return panel, err
+	}
+	series := make(map[string]vitalSeries)
+	for _, vitalType := range vitalTypes {
+		for _, s := range seriesOf(vitalType) {
+			series[s.Key()] = s
+		}
+	}
+
+	for _, row := range latest {
+		patient := patients[row.Username]
+		vital := panelVital(series[seriesKey(row.VitalID, row.Component)], row)
+		patient.LatestVitals = append(patient.LatestVitals, vital)
+		patient.OutOfRange = patient.OutOfRange || vital.Flag != ""
+	}
+
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		panel.Patients = append(panel.Patients, *patients[username])
+	}
+	return panel, nil
+}
+
+// panelVital describes the latest row of a series, flagged against the
+// normal range of the series. Rows stored in another unit than the series'
+// are converted first.
+func panelVital(series vitalSeries, row models.Vital) models.PanelVital {
+	vital := models.PanelVital{
+		VitalID:   row.VitalID,
+		Component: row.Component,
+		LoincCode: series.LOINC,
+		Value:     row.Value,
+		Unit:      row.Unit,
+		Timestamp: row.Timestamp,
+	}
+	if series.VitalID == "" {
+		return vital
+	}
+
+	if row.Unit != series.Unit {
+		value, err := ConvertValue(row.Value, row.Unit, series.Unit)
+		if err != nil {
+			return vital
+		}
+		vital.Value, vital.Unit = value, series.Unit
+	}
+	vital.NormalLow = series.NormalLow
+	vital.NormalHigh = series.NormalHigh
+	vital.Flag = normalFlag(series, vital.Value)
+	return vital
+}
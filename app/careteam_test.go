@@ -0,0 +1,42 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPanelVital(t *testing.T) {
+	low, high := 36.1, 37.8
+	temperature := models.VitalType{VitalID: "Temperature", Unit: "°C", MinValue: 25, MaxValue: 45, NormalLow: &low, NormalHigh: &high, LoincCode: "8310-5"}
+	series := seriesOf(temperature)[0]
+	at := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	normal := panelVital(series, models.Vital{VitalID: "Temperature", Value: 37, Unit: "°C", Timestamp: at})
+	assert.Empty(t, normal.Flag)
+	assert.Equal(t, "8310-5", normal.LoincCode)
+	assert.Equal(t, &low, normal.NormalLow)
+
+	fever := panelVital(series, models.Vital{VitalID: "Temperature", Value: 39.2, Unit: "°C", Timestamp: at})
+	assert.Equal(t, "high", fever.Flag)
+
+	converted := panelVital(series, models.Vital{VitalID: "Temperature", Value: 95, Unit: "°F", Timestamp: at})
+	assert.Equal(t, "°C", converted.Unit, "Rows in another unit should be converted to the series' unit")
+	assert.InDelta(t, 35.0, converted.Value, 1e-9)
+	assert.Equal(t, "low", converted.Flag)
+
+	unknown := panelVital(vitalSeries{}, models.Vital{VitalID: "Retired", Value: 1, Unit: "x", Timestamp: at})
+	assert.Empty(t, unknown.Flag, "Rows of unknown types should not be flagged")
+}
+
+func TestNormalFlag(t *testing.T) {
+	floor := 95.0
+	spo2 := vitalSeries{VitalID: "PulseOximetry", Component: "spo2", Unit: "%", MinValue: 50, MaxValue: 100, NormalLow: &floor}
+	assert.Equal(t, "low", normalFlag(spo2, 91))
+	assert.Empty(t, normalFlag(spo2, 95), "Values on the bound should be normal")
+	assert.Empty(t, normalFlag(spo2, 100), "A missing bound should not flag anything")
+
+	assert.Empty(t, normalFlag(vitalSeries{VitalID: "HeartRate"}, 190), "Series without a normal range should not be flagged")
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"fmt"
+	"medical-vitals-management-system/models"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// defaultAgeBand is how many years either side of a user's age a "users like
+// me" cohort spans when the request does not say.
+const defaultAgeBand = 5
+
+// ResolveCohort turns the cohort filter of a population insight request into
+// a concrete definition. A "like me" filter takes the age and gender of
+// username; explicit bounds or gender in the filter override those.
+func ResolveCohort(db *gorm.DB, username string, filter *models.CohortFilter) (models.CohortDefinition, error) {
+	var cohort models.CohortDefinition
+	if filter != nil {
+		if filter.LikeMe {
+			user, err := GetUser(db, username)
+			if err != nil {
+				return models.CohortDefinition{}, err
+			}
+			if user.Age <= 0 || user.Gender == "" {
+				return models.CohortDefinition{}, validationErrorf("a users like me cohort needs the age and gender of %s", username)
+			}
+
+			band := filter.AgeBand
+			if band <= 0 {
+				band = defaultAgeBand
+			}
+			minAge, maxAge := user.Age-band, user.Age+band
+			if minAge < 0 {
+				minAge = 0
+			}
+			cohort.MinAge, cohort.MaxAge, cohort.Gender = &minAge, &maxAge, user.Gender
+		}
+
+		if filter.MinAge != nil {
+			cohort.MinAge = filter.MinAge
+		}
+		if filter.MaxAge != nil {
+			cohort.MaxAge = filter.MaxAge
+		}
+		if filter.Gender != "" {
+			cohort.Gender = filter.Gender
+		}
+	}
+
+	if cohort.MinAge != nil && *cohort.MinAge < 0 || cohort.MaxAge != nil && *cohort.MaxAge < 0 {
+		return models.CohortDefinition{}, validationErrorf("cohort ages must not be negative")
+	}
+	if cohort.MinAge != nil && cohort.MaxAge != nil && *cohort.MinAge > *cohort.MaxAge {
+		return models.CohortDefinition{}, validationErrorf("cohort min_age must not be greater than max_age")
+	}
+
+	var size int
+	if err := inCohort(db.Model(&models.User{}), cohort).Count(&size).Error; err != nil {
+		return models.CohortDefinition{}, fmt.Errorf("failed to count cohort: %v", err)
+	}
+	cohort.Size = size
+	cohort.Description = describeCohort(cohort)
+	return cohort, nil
+}
+
+// inCohort restricts a query that selects from or joins the users table to
+// the members of cohort.
+func inCohort(query *gorm.DB, cohort models.CohortDefinition) *gorm.DB {
+	if cohort.MinAge != nil {
+		query = query.Where("users.age >= ?", *cohort.MinAge)
+	}
+	if cohort.MaxAge != nil {
+		query = query.Where("users.age <= ?", *cohort.MaxAge)
+	}
+	if cohort.Gender != "" {
+		query = query.Where("LOWER(users.gender) = LOWER(?)", cohort.Gender)
+	}
+	return query
+}
+
+func isEveryone(cohort models.CohortDefinition) bool {
+	return cohort.MinAge == nil && cohort.MaxAge == nil && cohort.Gender == ""
+}
+
+func describeCohort(cohort models.CohortDefinition) string {
+	if isEveryone(cohort) {
+		return "all users"
+	}
+
+	var parts []string
+	switch {
+	case cohort.MinAge != nil && cohort.MaxAge != nil:
+		parts = append(parts, fmt.Sprintf("aged %d-%d", *cohort.MinAge, *cohort.MaxAge))
+	case cohort.MinAge != nil:
+		parts = append(parts, fmt.Sprintf("aged %d or over", *cohort.MinAge))
+	case cohort.MaxAge != nil:
+		parts = append(parts, fmt.Sprintf("aged %d or under", *cohort.MaxAge))
+	}
+	if cohort.Gender != "" {
+		parts = append(parts, fmt.Sprintf("gender %s", cohort.Gender))
+	}
+	return "users " + strings.Join(parts, ", ")
+}
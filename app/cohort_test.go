@@ -0,0 +1,18 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeCohort(t *testing.T) {
+	minAge, maxAge := 20, 30
+
+	assert.Equal(t, "all users", describeCohort(models.CohortDefinition{}))
+	assert.Equal(t, "users aged 20-30, gender female", describeCohort(models.CohortDefinition{MinAge: &minAge, MaxAge: &maxAge, Gender: "female"}))
+	assert.Equal(t, "users aged 20 or over", describeCohort(models.CohortDefinition{MinAge: &minAge}))
+	assert.True(t, isEveryone(models.CohortDefinition{}))
+	assert.False(t, isEveryone(models.CohortDefinition{Gender: "male"}))
+}
@@ -0,0 +1,337 @@
+package app
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"medical-vitals-management-system/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// maxCSVRows is the largest number of rows one CSV import may carry
+const maxCSVRows = 50000
+
+// csvFields are the fields an imported file may map columns to. The source
+// of every imported reading is an import, with the firmware, method and body
+// site of its first row.
+var csvFields = []string{"username", "vital_id", "component", "value", "unit", "timestamp", "firmware", "method", "body_site"}
+
+// csvExportFields are the columns of an exported file: the first six
+// importable fields, the standard codes of each value and its provenance.
+// Imports ignore the codes, source type and device.
+var csvExportFields = []string{"username", "vital_id", "component", "value", "unit", "timestamp", "loinc_code", "ucum_unit",
+	"source_type", "device_id", "firmware", "method", "body_site"}
+
+// csvRow is a data row of an imported file and the reading it belongs to
+type csvRow struct {
+	line    int
+	reading int
+	err     error
+}
+
+// ImportVitalsCSV reads vitals from a CSV file laid out as options describe
+// and stores them, or only validates them in a dry run. Rows sharing a
+// username, vital ID and timestamp but naming different components form one
+// composite reading. The report has one result per data row, with its line
+// number; a rejected composite reading rejects all of its rows.
+func ImportVitalsCSV(db *gorm.DB, r io.Reader, options models.CSVImportOptions) (models.IngestReport, error) {
+	parseTimestamp, err := csvTimestampParser(options.TimestampFormat, options.Timezone)
+	if err != nil {
+		return models.IngestReport{}, err
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return models.IngestReport{}, validationErrorf("failed to read CSV header: %v", err)
+	}
+	columns, err := csvColumns(header, options)
+	if err != nil {
+		return models.IngestReport{}, err
+	}
+
+	var rows []csvRow
+	var readings []models.VitalReading
+	index := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if len(rows) == maxCSVRows {
+			return models.IngestReport{}, validationErrorf("at most %d rows may be imported at once", maxCSVRows)
+		}
+		if err != nil {
+			parseErr, ok := err.(*csv.ParseError)
+			if !ok {
+				return models.IngestReport{}, fmt.Errorf("failed to read CSV: %v", err)
+			}
+			rows = append(rows, csvRow{line: parseErr.StartLine, err: parseErr.Err})
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := csvRow{line: line}
+		row.reading, row.err = addCSVRecord(&readings, index, record, columns, options, parseTimestamp)
+		rows = append(rows, row)
+	}
+
+	var results []models.IngestResult
+	if options.DryRun {
+		results, err = ValidateVitals(db, readings)
+	} else {
+		results, err = CreateVitals(db, readings)
+	}
+	if err != nil {
+		return models.IngestReport{}, err
+	}
+
+	rowResults := make([]models.IngestResult, len(rows))
+	for i, row := range rows {
+		if row.err != nil {
+			rowResults[i] = rejected(i, row.err.Error())
+		} else {
+			rowResults[i] = results[row.reading]
+			rowResults[i].Index = i
+		}
+		rowResults[i].Line = row.line
+	}
+	return SummarizeIngest(rowResults), nil
+}
+
+// csvColumns finds the column of each field in header. Headers are matched
+// case-insensitively.
+func csvColumns(header []string, options models.CSVImportOptions) (map[string]int, error) {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		positions[name] = i
+	}
+
+	columns := make(map[string]int)
+	for _, field := range csvFields {
+		name, mapped := options.Columns[field]
+		if !mapped {
+			name = field
+		}
+		if i, ok := positions[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[field] = i
+		} else if mapped {
+			return nil, validationErrorf("column %q mapped to %s is not in the CSV header", name, field)
+		}
+	}
+
+	for field := range options.Columns {
+		if !isCSVField(field) {
+			return nil, validationErrorf("unknown CSV field %q; expected one of %s", field, strings.Join(csvFields, ", "))
+		}
+	}
+	for _, field := range []string{"value", "timestamp"} {
+		if _, ok := columns[field]; !ok {
+			return nil, validationErrorf("the CSV file has no %s column", field)
+		}
+	}
+	if _, ok := columns["username"]; !ok && options.Username == "" {
+		return nil, validationErrorf("the CSV file has no username column")
+	}
+	if _, ok := columns["vital_id"]; !ok && options.VitalID == "" {
+		return nil, validationErrorf("the CSV file has no vital_id column and no vital_id was given")
+	}
+	return columns, nil
+}
+
+func isCSVField(field string) bool {
+	for _, known := range csvFields {
+		if field == known {
+			return true
+		}
+	}
+	return false
+}
+
+// addCSVRecord merges a record into the reading it belongs to, creating the
+// reading if needed, and returns the reading's index.
+func addCSVRecord(readings *[]models.VitalReading, index map[string]int, record []string, columns map[string]int, options models.CSVImportOptions, parseTimestamp func(string) (time.Time, error)) (int, error) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	username := field("username")
+	if username == "" {
+		username = options.Username
+	} else if options.Username != "" && username != options.Username {
+		return 0, fmt.Errorf("username %q does not match %q", username, options.Username)
+	}
+	vitalID := field("vital_id")
+	if vitalID == "" {
+		vitalID = options.VitalID
+	}
+	if username == "" || vitalID == "" {
+		return 0, fmt.Errorf("username and vital_id are required")
+	}
+
+	value, err := strconv.ParseFloat(field("value"), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid value %q", field("value"))
+	}
+	timestamp, err := parseTimestamp(field("timestamp"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", field("timestamp"))
+	}
+	component, unit := field("component"), field("unit")
+
+	key := fmt.Sprintf("%s\x00%s\x00%d", username, vitalID, timestamp.UnixNano())
+	i, ok := index[key]
+	if !ok {
+		i = len(*readings)
+		index[key] = i
+		*readings = append(*readings, models.VitalReading{Username: username, VitalID: vitalID, Timestamp: timestamp, Source: models.VitalSource{
+			Type:     models.SourceImport,
+			Firmware: field("firmware"),
+			Method:   field("method"),
+			BodySite: field("body_site"),
+		}})
+	}
+
+	reading := &(*readings)[i]
+	if component == "" {
+		if reading.Value != nil || reading.Components != nil {
+			return 0, fmt.Errorf("duplicate reading for %s at %s", vitalID, timestamp.Format(time.RFC3339))
+		}
+		reading.Value = &value
+		reading.Unit = unit
+		return i, nil
+	}
+
+	if _, exists := reading.Components[component]; exists || reading.Value != nil {
+		return 0, fmt.Errorf("duplicate reading for %s.%s at %s", vitalID, component, timestamp.Format(time.RFC3339))
+	}
+	if reading.Components == nil {
+		reading.Components = make(map[string]float64)
+		reading.ComponentUnits = make(map[string]string)
+	}
+	reading.Components[component] = value
+	if unit != "" {
+		reading.ComponentUnits[component] = unit
+	}
+	return i, nil
+}
+
+// csvTimestampParser returns a parser for timestamps in format
+func csvTimestampParser(format, timezone string) (func(string) (time.Time, error), error) {
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return nil, validationErrorf("unknown timezone %q", timezone)
+		}
+	}
+
+	switch strings.ToLower(format) {
+	case "", "rfc3339":
+		return func(value string) (time.Time, error) {
+			return time.Parse(time.RFC3339, value)
+		}, nil
+	case "unix", "unix_ms":
+		scale := 1e9
+		if strings.ToLower(format) == "unix_ms" {
+			scale = 1e6
+		}
+		return func(value string) (time.Time, error) {
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(0, int64(math.Round(seconds*scale))).UTC(), nil
+		}, nil
+	default:
+		sample := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(format)
+		if _, err := time.Parse(format, sample); err != nil || sample == format {
+			return nil, validationErrorf("invalid timestamp format %q", format)
+		}
+		return func(value string) (time.Time, error) {
+			return time.ParseInLocation(format, value, location)
+		}, nil
+	}
+}
+
+// ExportVitalsCSV writes the vitals matching query to w as CSV, converted to
+// units, one row per stored value. The vitals are read a page at a time and
+// each page is flushed before the next is read, so an export of any size is
+// never held in memory. Nothing is written if the first page cannot be read.
+func ExportVitalsCSV(db *gorm.DB, query models.VitalQuery, units map[string]string, w io.Writer) error {
+	query.Limit = maxPageSize
+	query.Cursor = ""
+
+	codes, err := LOINCCodes(db)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	for page := 0; ; page++ {
+		vitals, err := GetVitals(db, query)
+		if err != nil {
+			return err
+		}
+		converted, err := ConvertVitals(db, vitals.Vitals, units)
+		if err != nil {
+			return err
+		}
+
+		if page == 0 {
+			if err := writer.Write(csvExportFields); err != nil {
+				return fmt.Errorf("failed to write CSV: %v", err)
+			}
+		}
+		for _, vital := range converted {
+			deviceID := ""
+			if vital.DeviceID != nil {
+				deviceID = strconv.FormatUint(uint64(*vital.DeviceID), 10)
+			}
+			err := writer.Write([]string{
+				vital.Username,
+				vital.VitalID,
+				vital.Component,
+				strconv.FormatFloat(vital.Value, 'f', -1, 64),
+				vital.Unit,
+				vital.Timestamp.Format(time.RFC3339Nano),
+				codes[seriesKey(vital.VitalID, vital.Component)],
+				UCUMCode(vital.Unit),
+				vital.SourceType,
+				deviceID,
+				vital.Firmware,
+				vital.Method,
+				vital.BodySite,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to write CSV: %v", err)
+			}
+		}
+
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("failed to write CSV: %v", err)
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		if !vitals.HasMore {
+			return nil
+		}
+		query.Cursor = vitals.NextCursor
+	}
+}
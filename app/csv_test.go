@@ -0,0 +1,85 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSVColumns(t *testing.T) {
+	header := []string{"\ufeffPatient", "Measured At", "SBP", "Unit"}
+	options := models.CSVImportOptions{
+		VitalID: "HeartRate",
+		Columns: map[string]string{"username": "patient", "timestamp": "measured at", "value": "SBP"},
+	}
+
+	columns, err := csvColumns(header, options)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"username": 0, "timestamp": 1, "value": 2, "unit": 3}, columns)
+
+	_, err = csvColumns(header, models.CSVImportOptions{VitalID: "HeartRate", Columns: map[string]string{"value": "DBP"}})
+	assert.True(t, IsValidationError(err), "A mapped column missing from the header should be rejected")
+
+	_, err = csvColumns(header, models.CSVImportOptions{Columns: map[string]string{"reading": "SBP"}})
+	assert.True(t, IsValidationError(err), "Unknown fields should be rejected")
+
+	_, err = csvColumns([]string{"username", "value", "timestamp"}, models.CSVImportOptions{})
+	assert.True(t, IsValidationError(err), "A vital ID is needed from a column or the options")
+}
+
+func TestAddCSVRecord(t *testing.T) {
+	columns := map[string]int{"vital_id": 0, "component": 1, "value": 2, "unit": 3, "timestamp": 4}
+	options := models.CSVImportOptions{Username: "JohnDoe"}
+	parse, err := csvTimestampParser("", "")
+	assert.NoError(t, err)
+
+	var readings []models.VitalReading
+	index := make(map[string]int)
+	add := func(record ...string) (int, error) {
+		return addCSVRecord(&readings, index, record, columns, options, parse)
+	}
+
+	i, err := add("BloodPressure", "systolic", "120", "mmHg", "2023-01-01T08:00:00Z")
+	assert.NoError(t, err)
+	j, err := add("BloodPressure", "diastolic", "80", "", "2023-01-01T08:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, i, j, "Components at the same timestamp should form one reading")
+	assert.Equal(t, map[string]float64{"systolic": 120, "diastolic": 80}, readings[i].Components)
+	assert.Equal(t, map[string]string{"systolic": "mmHg"}, readings[i].ComponentUnits)
+
+	_, err = add("BloodPressure", "systolic", "118", "mmHg", "2023-01-01T08:00:00Z")
+	assert.Error(t, err, "A repeated component should be rejected")
+
+	k, err := add("HeartRate", "", "72", "bpm", "2023-01-01T08:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, 72.0, *readings[k].Value)
+	assert.Equal(t, "JohnDoe", readings[k].Username)
+
+	_, err = add("HeartRate", "", "n/a", "bpm", "2023-01-01T09:00:00Z")
+	assert.EqualError(t, err, `invalid value "n/a"`)
+	_, err = add("HeartRate", "", "72", "bpm", "yesterday")
+	assert.EqualError(t, err, `invalid timestamp "yesterday"`)
+}
+
+func TestCSVTimestampParser(t *testing.T) {
+	expected := time.Date(2023, 1, 1, 8, 30, 0, 0, time.UTC)
+
+	parse, err := csvTimestampParser("unix_ms", "")
+	assert.NoError(t, err)
+	parsed, err := parse("1672561800000")
+	assert.NoError(t, err)
+	assert.True(t, expected.Equal(parsed))
+
+	parse, err = csvTimestampParser("02/01/2006 15:04", "Europe/Berlin")
+	assert.NoError(t, err)
+	parsed, err = parse("01/01/2023 09:30")
+	assert.NoError(t, err)
+	assert.True(t, expected.Equal(parsed), "Layouts without an offset should be read in the timezone")
+
+	_, err = csvTimestampParser("day month year", "")
+	assert.True(t, IsValidationError(err))
+	_, err = csvTimestampParser("", "Mars/Olympus")
+	assert.True(t, IsValidationError(err))
+}
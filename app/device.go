@@ -0,0 +1,243 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"medical-vitals-management-system/models"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// apiKeyPrefix starts every device API key, so that leaked keys are easy to
+// recognize.
+const apiKeyPrefix = "vmk"
+
+// lastSeenResolution is how stale the last-seen time of a device may get
+// before a request updates it, sparing a write on every request.
+const lastSeenResolution = time.Minute
+
+// RegisterDevice registers a device for the patients and vital types of
+// request and returns it with its API key.
+func RegisterDevice(db *gorm.DB, request models.DeviceRequest, registeredBy string) (models.DeviceKey, error) {
+	device := models.Device{Name: strings.TrimSpace(request.Name), RegisteredBy: registeredBy}
+	if err := setDeviceScope(db, &device, request); err != nil {
+		return models.DeviceKey{}, err
+	}
+
+	key := newAPIKey(&device)
+	if err := db.Create(&device).Error; err != nil {
+		return models.DeviceKey{}, fmt.Errorf("failed to register device: %v", err)
+	}
+	return models.DeviceKey{Device: device, APIKey: key}, nil
+}
+
+// GetDevices lists the registered devices, revoked ones included
+func GetDevices(db *gorm.DB) ([]models.Device, error) {
+	var devices []models.Device
+	if err := db.Order("id").Find(&devices).Error; err != nil {
+		return nil, fmt.Errorf("failed to get devices: %v", err)
+	}
+	return devices, nil
+}
+
+func GetDevice(db *gorm.DB, id uint) (models.Device, error) {
+	var device models.Device
+	if err := db.First(&device, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return device, notFoundErrorf("device %d not found", id)
+		}
+		return device, fmt.Errorf("failed to get device: %v", err)
+	}
+	return device, nil
+}
+
+// UpdateDevice changes the name and scope of a device
+func UpdateDevice(db *gorm.DB, id uint, request models.DeviceRequest) (models.Device, error) {
+	device, err := GetDevice(db, id)
+	if err != nil {
+		return device, err
+	}
+
+	device.Name = strings.TrimSpace(request.Name)
+	if err := setDeviceScope(db, &device, request); err != nil {
+		return device, err
+	}
+	err = db.Model(&device).Updates(map[string]interface{}{
+		"name":        device.Name,
+		"source_type": device.SourceType,
+		"patients":    device.Patients,
+		"vital_types": device.VitalTypes,
+	}).Error
+	if err != nil {
+		return device, fmt.Errorf("failed to update device: %v", err)
+	}
+	return device, nil
+}
+
+// RotateDeviceKey replaces the API key of a device. The old key stops
+// working at once.
+func RotateDeviceKey(db *gorm.DB, id uint) (models.DeviceKey, error) {
+	device, err := GetDevice(db, id)
+	if err != nil {
+		return models.DeviceKey{}, err
+	}
+	if device.RevokedAt != nil {
+		return models.DeviceKey{}, validationErrorf("device %d has been revoked", id)
+	}
+
+	key := newAPIKey(&device)
+	now := time.Now()
+	device.RotatedAt = &now
+	err = db.Model(&device).Updates(map[string]interface{}{
+		"key_id":     device.KeyID,
+		"key_hash":   device.KeyHash,
+		"rotated_at": now,
+	}).Error
+	if err != nil {
+		return models.DeviceKey{}, fmt.Errorf("failed to rotate device key: %v", err)
+	}
+	return models.DeviceKey{Device: device, APIKey: key}, nil
+}
+
+// RevokeDevice disables the API key of a device for good. The device and
+// the vitals it pushed are kept.
+func RevokeDevice(db *gorm.DB, id uint) error {
+	device, err := GetDevice(db, id)
+	if err != nil {
+		return err
+	}
+	if device.RevokedAt != nil {
+		return nil
+	}
+	if err := db.Model(&device).Update("revoked_at", time.Now()).Error; err != nil {
+		return fmt.Errorf("failed to revoke device: %v", err)
+	}
+	return nil
+}
+
+// AuthenticateDevice identifies the device presenting an API key
+func AuthenticateDevice(db *gorm.DB, key string) (models.Principal, error) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return models.Principal{}, authErrorf("malformed API key")
+	}
+
+	var device models.Device
+	if err := db.Where("key_id = ?", parts[1]).First(&device).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return models.Principal{}, authErrorf("invalid API key")
+		}
+		return models.Principal{}, fmt.Errorf("failed to check API key: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(device.KeyHash)) != 1 {
+		return models.Principal{}, authErrorf("invalid API key")
+	}
+	if device.RevokedAt != nil {
+		return models.Principal{}, authErrorf("API key has been revoked")
+	}
+
+	now := time.Now()
+	if device.LastSeenAt == nil || now.Sub(*device.LastSeenAt) >= lastSeenResolution {
+		if err := db.Model(&device).UpdateColumn("last_seen_at", now).Error; err != nil {
+			return models.Principal{}, fmt.Errorf("failed to record device activity: %v", err)
+		}
+	}
+
+	return models.Principal{
+		Username:         fmt.Sprintf("device:%d", device.ID),
+		Role:             models.RoleDevice,
+		Permissions:      []string{models.PermIngestVitals},
+		DeviceID:         device.ID,
+		DeviceSource:     device.SourceType,
+		DevicePatients:   device.Patients,
+		DeviceVitalTypes: device.VitalTypes,
+	}, nil
+}
+
+// AuthorizeVitalType checks that a device principal may record vitals of
+// the type vitalID, given by vital ID or LOINC code. Other principals may
+// record any type. Unknown types are left for validation to reject.
+func AuthorizeVitalType(db *gorm.DB, principal models.Principal, vitalID string) error {
+	if principal.DeviceID == 0 {
+		return nil
+	}
+
+	vitalType, err := GetVitalType(db, vitalID)
+	if IsValidationError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !containsString(principal.DeviceVitalTypes, vitalType.VitalID) {
+		return forbiddenErrorf("device %d may not record %s", principal.DeviceID, vitalType.VitalID)
+	}
+	return nil
+}
+
+// setDeviceScope validates the name, source type and scope of request and
+// sets the source type and scope of device, with vital types by their vital
+// IDs.
+func setDeviceScope(db *gorm.DB, device *models.Device, request models.DeviceRequest) error {
+	if device.Name == "" {
+		return validationErrorf("name is required")
+	}
+	sourceType := strings.ToLower(strings.TrimSpace(request.SourceType))
+	if sourceType == "" {
+		sourceType = models.SourceSmartwatch
+	}
+	if !deviceSourceTypes[sourceType] {
+		return validationErrorf("a device's source type must be %s or %s", models.SourceSmartwatch, models.SourceHospitalMonitor)
+	}
+	if len(request.Patients) == 0 {
+		return validationErrorf("at least one patient is required")
+	}
+	if len(request.VitalTypes) == 0 {
+		return validationErrorf("at least one vital type is required")
+	}
+
+	patients := uniqueStrings(request.Patients)
+	for _, patient := range patients {
+		exists, err := UserExists(db, patient)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return notFoundErrorf("user %s not found", patient)
+		}
+	}
+
+	var vitalTypes []string
+	for _, vitalID := range request.VitalTypes {
+		vitalType, err := GetVitalType(db, vitalID)
+		if err != nil {
+			return err
+		}
+		vitalTypes = append(vitalTypes, vitalType.VitalID)
+	}
+
+	device.SourceType = sourceType
+	device.Patients = patients
+	device.VitalTypes = uniqueStrings(vitalTypes)
+	return nil
+}
+
+// newAPIKey gives device a new key ID and key hash and returns the key
+func newAPIKey(device *models.Device) string {
+	device.KeyID = hex.EncodeToString(randomBytes(6))
+	key := apiKeyPrefix + "_" + device.KeyID + "_" + base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	device.KeyHash = hashToken(key)
+	return key
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
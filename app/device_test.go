@@ -0,0 +1,58 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	var device models.Device
+	key := newAPIKey(&device)
+
+	parts := strings.SplitN(key, "_", 3)
+	assert.Len(t, parts, 3)
+	assert.Equal(t, apiKeyPrefix, parts[0])
+	assert.Equal(t, device.KeyID, parts[1])
+	assert.Equal(t, hashToken(key), device.KeyHash)
+	assert.NotContains(t, device.KeyHash, parts[2], "Only a hash of the key should be stored")
+
+	rotated := device
+	assert.NotEqual(t, key, newAPIKey(&rotated))
+	assert.NotEqual(t, device.KeyID, rotated.KeyID)
+}
+
+func TestAuthenticateDeviceMalformedKey(t *testing.T) {
+	for _, key := range []string{"", "vmk", "vmk_abc", "sk_abc_def"} {
+		_, err := AuthenticateDevice(nil, key)
+		assert.True(t, IsAuthError(err), "Key %q should be rejected before looking it up", key)
+	}
+}
+
+func TestAuthorizeDevice(t *testing.T) {
+	device := models.Principal{
+		Username:         "device:1",
+		Role:             models.RoleDevice,
+		Permissions:      []string{models.PermIngestVitals},
+		DeviceID:         1,
+		DevicePatients:   []string{"JohnDoe"},
+		DeviceVitalTypes: []string{"HeartRate"},
+	}
+
+	_, err := AuthorizePatient(nil, device, models.PermIngestVitals, "JohnDoe")
+	assert.NoError(t, err)
+
+	_, err = AuthorizePatient(nil, device, models.PermIngestVitals, "JaneDoe")
+	assert.True(t, IsForbiddenError(err), "Devices should only reach the patients they were registered for")
+
+	_, err = AuthorizePatient(nil, device, models.PermIngestVitals, "")
+	assert.True(t, IsForbiddenError(err), "Devices should name the patient")
+
+	_, err = AuthorizePatient(nil, device, models.PermReadVitals, "JohnDoe")
+	assert.True(t, IsForbiddenError(err), "Devices should only push vitals")
+
+	patient := models.Principal{Username: "JohnDoe", Role: models.RolePatient, Permissions: []string{models.PermIngestVitals}}
+	assert.NoError(t, AuthorizeVitalType(nil, patient, "Temperature"), "Only devices are limited to vital types")
+}
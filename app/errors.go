@@ -0,0 +1,104 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ValidationError reports input that was rejected by a business rule rather
+// than by a failure talking to the database.
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func validationErrorf(format string, args ...interface{}) error {
+	return &ValidationError{Message: fmt.Sprintf(format, args...)}
+}
+
+// IsValidationError reports whether err was caused by invalid input
+func IsValidationError(err error) bool {
+	var validationErr *ValidationError
+	return errors.As(err, &validationErr)
+}
+
+// PrivacyError reports a request refused because answering it could expose
+// other patients' data.
+type PrivacyError struct {
+	Message string
+}
+
+func (e *PrivacyError) Error() string {
+	return e.Message
+}
+
+func privacyErrorf(format string, args ...interface{}) error {
+	return &PrivacyError{Message: fmt.Sprintf(format, args...)}
+}
+
+// IsPrivacyError reports whether err was a refusal to disclose data
+func IsPrivacyError(err error) bool {
+	var privacyErr *PrivacyError
+	return errors.As(err, &privacyErr)
+}
+
+// NotFoundError reports a request for a record that does not exist
+type NotFoundError struct {
+	Message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Message
+}
+
+func notFoundErrorf(format string, args ...interface{}) error {
+	return &NotFoundError{Message: fmt.Sprintf(format, args...)}
+}
+
+// IsNotFoundError reports whether err was caused by a missing record
+func IsNotFoundError(err error) bool {
+	var notFoundErr *NotFoundError
+	return errors.As(err, &notFoundErr)
+}
+
+// AuthError reports a caller who could not be authenticated
+type AuthError struct {
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+func authErrorf(format string, args ...interface{}) error {
+	return &AuthError{Message: fmt.Sprintf(format, args...)}
+}
+
+// IsAuthError reports whether err was caused by missing or bad credentials
+func IsAuthError(err error) bool {
+	var authErr *AuthError
+	return errors.As(err, &authErr)
+}
+
+// ForbiddenError reports an authenticated caller whose role does not allow
+// the request
+type ForbiddenError struct {
+	Message string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.Message
+}
+
+func forbiddenErrorf(format string, args ...interface{}) error {
+	return &ForbiddenError{Message: fmt.Sprintf(format, args...)}
+}
+
+// IsForbiddenError reports whether err was a refusal by the access policy
+func IsForbiddenError(err error) bool {
+	var forbiddenErr *ForbiddenError
+	return errors.As(err, &forbiddenErr)
+}
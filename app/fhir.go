@@ -0,0 +1,538 @@
+package app
+
+import (
+	"fmt"
+	"medical-vitals-management-system/models"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	categorySystem    = "http://terminology.hl7.org/CodeSystem/observation-category"
+	vitalIDSystem     = "urn:medical-vitals-management-system:vital-id"
+	usernameSystem    = "urn:medical-vitals-management-system:username"
+	patientReference  = "Patient/"
+	deviceReference   = "Device/"
+	observationStatus = "final"
+)
+
+// SearchObservations returns a page of the Observations matching search. A
+// code matches the vital type it, or one of its components, identifies; codes
+// that identify nothing match no observations.
+func SearchObservations(db *gorm.DB, search models.FHIRObservationSearch) (models.FHIRObservationPage, error) {
+	username := strings.TrimPrefix(search.Patient, patientReference)
+	if username == "" {
+		return models.FHIRObservationPage{}, validationErrorf("the patient search parameter is required")
+	}
+
+	query := models.VitalQuery{Username: username, Limit: search.Count, Cursor: search.Cursor}
+	switch search.Sort {
+	case "", "date":
+		query.Sort = "asc"
+	case "-date":
+		query.Sort = "desc"
+	default:
+		return models.FHIRObservationPage{}, validationErrorf("unsupported _sort %q; use date or -date", search.Sort)
+	}
+
+	var err error
+	if query.From, query.To, err = fhirDateRange(search.Dates); err != nil {
+		return models.FHIRObservationPage{}, err
+	}
+
+	if len(search.Codes) > 0 {
+		vitalTypes, err := GetVitalTypes(db, false)
+		if err != nil {
+			return models.FHIRObservationPage{}, err
+		}
+		for _, codes := range search.Codes {
+			for _, token := range strings.Split(codes, ",") {
+				query.VitalIDs = append(query.VitalIDs, vitalIDsForCode(vitalTypes, token)...)
+			}
+		}
+		if len(query.VitalIDs) == 0 {
+			return models.FHIRObservationPage{}, nil
+		}
+	}
+
+	page, err := GetVitals(db, query)
+	if err != nil {
+		return models.FHIRObservationPage{}, err
+	}
+
+	observations, err := observationsFromVitals(db, page.Vitals)
+	if err != nil {
+		return models.FHIRObservationPage{}, err
+	}
+	return models.FHIRObservationPage{Observations: observations, HasMore: page.HasMore, NextCursor: page.NextCursor}, nil
+}
+
+// GetObservation returns the Observation with the given ID, which is the ID of
+// the first row stored for the reading.
+func GetObservation(db *gorm.DB, id string) (models.FHIRObservation, error) {
+	rowID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return models.FHIRObservation{}, notFoundErrorf("Observation/%s not found", id)
+	}
+
+	var first models.Vital
+	if err := db.First(&first, rowID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return models.FHIRObservation{}, notFoundErrorf("Observation/%s not found", id)
+		}
+		return models.FHIRObservation{}, fmt.Errorf("failed to get vital: %v", err)
+	}
+
+	var rows []models.Vital
+	err = db.Where("username = ? AND vital_id = ? AND timestamp = ?", first.Username, first.VitalID, first.Timestamp).
+		Order("id").Find(&rows).Error
+	if err != nil {
+		return models.FHIRObservation{}, fmt.Errorf("failed to get vital: %v", err)
+	}
+
+	observations, err := observationsFromVitals(db, rows)
+	if err != nil {
+		return models.FHIRObservation{}, err
+	}
+	// Only the first row of a reading identifies it.
+	if len(observations) == 0 || observations[0].ID != id {
+		return models.FHIRObservation{}, notFoundErrorf("Observation/%s not found", id)
+	}
+	return observations[0], nil
+}
+
+// CreateObservation stores an Observation as a vital reading through
+// CreateVital and returns it as stored, in canonical units.
+func CreateObservation(db *gorm.DB, observation models.FHIRObservation) (models.FHIRObservation, error) {
+	if observation.ResourceType != "Observation" {
+		return models.FHIRObservation{}, validationErrorf("expected an Observation resource, got %q", observation.ResourceType)
+	}
+	switch observation.Status {
+	case "", "final", "amended", "corrected", "preliminary":
+	default:
+		return models.FHIRObservation{}, validationErrorf("observations with status %q cannot be recorded", observation.Status)
+	}
+
+	reading, err := readingFromObservation(db, observation)
+	if err != nil {
+		return models.FHIRObservation{}, err
+	}
+
+	exists, err := UserExists(db, reading.Username)
+	if err != nil {
+		return models.FHIRObservation{}, err
+	} else if !exists {
+		return models.FHIRObservation{}, notFoundErrorf("Patient/%s not found", reading.Username)
+	}
+
+	if err := CreateVital(db, reading); err != nil {
+		return models.FHIRObservation{}, err
+	}
+
+	stored := len(reading.Components)
+	if reading.Value != nil {
+		stored = 1
+	}
+	var rows []models.Vital
+	err = db.Where("username = ? AND vital_id = ? AND timestamp = ?", reading.Username, reading.VitalID, reading.Timestamp).
+		Order("id DESC").Limit(stored).Find(&rows).Error
+	if err != nil {
+		return models.FHIRObservation{}, fmt.Errorf("failed to get vital: %v", err)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+
+	observations, err := observationsFromVitals(db, rows)
+	if err != nil {
+		return models.FHIRObservation{}, err
+	}
+	return observations[0], nil
+}
+
+// PatientFromUser represents a user as a Patient resource
+func PatientFromUser(user models.User) models.FHIRPatient {
+	gender := strings.ToLower(user.Gender)
+	switch gender {
+	case "male", "female", "other":
+	case "m":
+		gender = "male"
+	case "f":
+		gender = "female"
+	case "":
+		gender = "unknown"
+	default:
+		gender = "other"
+	}
+
+	return models.FHIRPatient{
+		ResourceType: "Patient",
+		ID:           user.Username,
+		Meta:         &models.FHIRMeta{LastUpdated: user.UpdatedAt.UTC().Format(time.RFC3339)},
+		Identifier:   []models.FHIRIdentifier{{System: usernameSystem, Value: user.Username}},
+		Name:         []models.FHIRHumanName{{Text: user.Username}},
+		Gender:       gender,
+	}
+}
+
+// observationsFromVitals groups rows, ordered by timestamp and ID, into one
+// Observation per reading.
+func observationsFromVitals(db *gorm.DB, rows []models.Vital) ([]models.FHIRObservation, error) {
+	vitalTypes := make(map[string]models.VitalType)
+	var observations []models.FHIRObservation
+	for start := 0; start < len(rows); {
+		end := start + 1
+		for end < len(rows) && sameReading(rows[start], rows[end]) {
+			end++
+		}
+
+		vitalID := rows[start].VitalID
+		vitalType, ok := vitalTypes[vitalID]
+		if !ok {
+			var err error
+			if vitalType, err = GetVitalType(db, vitalID); err != nil {
+				if !IsValidationError(err) {
+					return nil, err
+				}
+				// The type has been deleted; its readings are still coded by ID.
+				vitalType = models.VitalType{VitalID: vitalID}
+			}
+			vitalTypes[vitalID] = vitalType
+		}
+
+		observations = append(observations, observationFromVitals(vitalType, rows[start:end]))
+		start = end
+	}
+	return observations, nil
+}
+
+// observationFromVitals represents the rows of one reading as an Observation
+func observationFromVitals(vitalType models.VitalType, rows []models.Vital) models.FHIRObservation {
+	first := rows[0]
+	lastUpdated := first.UpdatedAt
+	for _, row := range rows {
+		if row.ID < first.ID {
+			first = row
+		}
+		if row.UpdatedAt.After(lastUpdated) {
+			lastUpdated = row.UpdatedAt
+		}
+	}
+
+	text := vitalType.Name
+	if text == "" {
+		text = vitalType.VitalID
+	}
+	observation := models.FHIRObservation{
+		ResourceType: "Observation",
+		ID:           strconv.FormatUint(uint64(first.ID), 10),
+		Meta:         &models.FHIRMeta{LastUpdated: lastUpdated.UTC().Format(time.RFC3339)},
+		Status:       observationStatus,
+		Category: []models.FHIRCodeableConcept{{
+			Coding: []models.FHIRCoding{{System: categorySystem, Code: "vital-signs", Display: "Vital Signs"}},
+		}},
+		Code:              seriesConcept(vitalType, "", text),
+		Subject:           &models.FHIRReference{Reference: patientReference + first.Username},
+		EffectiveDateTime: first.Timestamp.Format(time.RFC3339Nano),
+	}
+	if first.BodySite != "" {
+		observation.BodySite = &models.FHIRCodeableConcept{Text: first.BodySite}
+	}
+	if first.Method != "" {
+		observation.Method = &models.FHIRCodeableConcept{Text: first.Method}
+	}
+	if first.DeviceID != nil {
+		observation.Device = &models.FHIRReference{Reference: deviceReference + strconv.FormatUint(uint64(*first.DeviceID), 10)}
+	}
+
+	if len(rows) == 1 && rows[0].Component == "" {
+		observation.ValueQuantity = fhirQuantity(rows[0].Value, rows[0].Unit)
+		return observation
+	}
+
+	order := make(map[string]int)
+	for i, component := range vitalType.Components {
+		order[component.Name] = i
+	}
+	components := append([]models.Vital(nil), rows...)
+	sort.SliceStable(components, func(i, j int) bool {
+		return order[components[i].Component] < order[components[j].Component]
+	})
+	for _, row := range components {
+		observation.Component = append(observation.Component, models.FHIRObservationComponent{
+			Code:          seriesConcept(vitalType, row.Component, row.Component),
+			ValueQuantity: fhirQuantity(row.Value, row.Unit),
+		})
+	}
+	return observation
+}
+
+// seriesConcept codes a series of vitalType with LOINC, where known, and its
+// series key
+func seriesConcept(vitalType models.VitalType, component, text string) models.FHIRCodeableConcept {
+	key := seriesKey(vitalType.VitalID, component)
+	concept := models.FHIRCodeableConcept{Text: text}
+	if code := loincCode(vitalType, key); code != "" {
+		concept.Coding = append(concept.Coding, models.FHIRCoding{System: loincSystem, Code: code, Display: text})
+	}
+	concept.Coding = append(concept.Coding, models.FHIRCoding{System: vitalIDSystem, Code: key})
+	return concept
+}
+
+// conceptText describes a concept by its text or, failing that, by the
+// display or code of its first coding.
+func conceptText(concept *models.FHIRCodeableConcept) string {
+	if concept == nil {
+		return ""
+	}
+	if concept.Text != "" {
+		return concept.Text
+	}
+	for _, coding := range concept.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+		if coding.Code != "" {
+			return coding.Code
+		}
+	}
+	return ""
+}
+
+func fhirQuantity(value float64, unit string) *models.FHIRQuantity {
+	quantity := &models.FHIRQuantity{Value: floatPtr(value), Unit: unit}
+	if code, ok := ucumCodes[unit]; ok {
+		quantity.System = ucumSystem
+		quantity.Code = code
+	}
+	return quantity
+}
+
+// readingFromObservation maps a submitted Observation to a vital reading
+func readingFromObservation(db *gorm.DB, observation models.FHIRObservation) (models.VitalReading, error) {
+	var reading models.VitalReading
+
+	if observation.Subject == nil || !strings.HasPrefix(observation.Subject.Reference, patientReference) {
+		return reading, validationErrorf("subject must reference a Patient")
+	}
+	reading.Username = strings.TrimPrefix(observation.Subject.Reference, patientReference)
+
+	effective := observation.EffectiveDateTime
+	if effective == "" {
+		effective = observation.EffectiveInstant
+	}
+	timestamp, err := time.Parse(time.RFC3339, effective)
+	if err != nil {
+		return reading, validationErrorf("effectiveDateTime must be a full date and time with a timezone")
+	}
+	reading.Timestamp = timestamp
+	reading.Source.BodySite = conceptText(observation.BodySite)
+	reading.Source.Method = conceptText(observation.Method)
+
+	vitalTypes, err := GetVitalTypes(db, false)
+	if err != nil {
+		return reading, err
+	}
+	vitalType, component, err := seriesForConcept(vitalTypes, observation.Code)
+	if err != nil {
+		return reading, err
+	}
+	if component != "" {
+		return reading, validationErrorf("the code identifies the %s component of %s; send a %s observation with components",
+			component, vitalType.VitalID, vitalType.VitalID)
+	}
+	reading.VitalID = vitalType.VitalID
+	series := seriesOf(vitalType)
+
+	if len(vitalType.Components) == 0 {
+		if observation.ValueQuantity == nil || observation.ValueQuantity.Value == nil {
+			return reading, validationErrorf("valueQuantity is required for %s", vitalType.VitalID)
+		}
+		reading.Value = observation.ValueQuantity.Value
+		reading.Unit = quantityUnit(*observation.ValueQuantity, series[0])
+		return reading, nil
+	}
+
+	reading.Components = make(map[string]float64)
+	reading.ComponentUnits = make(map[string]string)
+	for _, observed := range observation.Component {
+		name, ok := componentForConcept(vitalType, observed.Code)
+		if !ok {
+			return reading, validationErrorf("unknown component of %s", vitalType.VitalID)
+		}
+		if observed.ValueQuantity == nil || observed.ValueQuantity.Value == nil {
+			return reading, validationErrorf("component %s needs a valueQuantity", name)
+		}
+		for _, s := range series {
+			if s.Component == name {
+				reading.Components[name] = *observed.ValueQuantity.Value
+				reading.ComponentUnits[name] = quantityUnit(*observed.ValueQuantity, s)
+			}
+		}
+	}
+	return reading, nil
+}
+
+// quantityUnit returns the unit of a quantity in the spelling used by the
+// unit registry, preferring its UCUM code.
+func quantityUnit(quantity models.FHIRQuantity, series vitalSeries) string {
+	if quantity.Code == "" || (quantity.System != "" && quantity.System != ucumSystem) {
+		return quantity.Unit
+	}
+	if ucumCodes[series.Unit] == quantity.Code {
+		return series.Unit
+	}
+	for unit, code := range ucumCodes {
+		if code == quantity.Code {
+			return unit
+		}
+	}
+	return quantity.Code
+}
+
+// seriesForConcept finds the vital type, and the component if the concept
+// identifies one, that a coded concept refers to.
+func seriesForConcept(vitalTypes []models.VitalType, concept models.FHIRCodeableConcept) (models.VitalType, string, error) {
+	for _, coding := range concept.Coding {
+		for _, vitalType := range vitalTypes {
+			for _, key := range conceptKeys(vitalType) {
+				if codingMatches(coding.System, coding.Code, vitalType, key) {
+					_, component := splitSeriesKey(key)
+					return vitalType, component, nil
+				}
+			}
+		}
+	}
+	return models.VitalType{}, "", validationErrorf("the observation code is not a known vital type")
+}
+
+// componentForConcept finds the component of vitalType a coded concept
+// refers to.
+func componentForConcept(vitalType models.VitalType, concept models.FHIRCodeableConcept) (string, bool) {
+	for _, coding := range concept.Coding {
+		for _, component := range vitalType.Components {
+			if codingMatches(coding.System, coding.Code, vitalType, seriesKey(vitalType.VitalID, component.Name)) {
+				return component.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// vitalIDsForCode returns the vital types a code search token, "code" or
+// "system|code", identifies either as a whole or through a component.
+func vitalIDsForCode(vitalTypes []models.VitalType, token string) []string {
+	system, code := "", strings.TrimSpace(token)
+	if i := strings.Index(code, "|"); i >= 0 {
+		system, code = code[:i], code[i+1:]
+	}
+
+	var vitalIDs []string
+	for _, vitalType := range vitalTypes {
+		for _, key := range conceptKeys(vitalType) {
+			if codingMatches(system, code, vitalType, key) {
+				vitalIDs = append(vitalIDs, vitalType.VitalID)
+				break
+			}
+		}
+	}
+	return vitalIDs
+}
+
+// conceptKeys lists the series keys of a vital type and of its components,
+// the type's own key first.
+func conceptKeys(vitalType models.VitalType) []string {
+	keys := []string{vitalType.VitalID}
+	for _, component := range vitalType.Components {
+		keys = append(keys, seriesKey(vitalType.VitalID, component.Name))
+	}
+	return keys
+}
+
+// codingMatches reports whether a system and code identify the series key of
+// vitalType, by LOINC or by the key itself. An empty system matches either.
+func codingMatches(system, code string, vitalType models.VitalType, key string) bool {
+	if (system == "" || system == vitalIDSystem) && code == key {
+		return true
+	}
+	loinc := loincCode(vitalType, key)
+	return loinc != "" && (system == "" || system == loincSystem) && code == loinc
+}
+
+func splitSeriesKey(key string) (string, string) {
+	if i := strings.Index(key, "."); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+// fhirDateRange intersects FHIR date search parameters, such as
+// "ge2023-01-01" and "lt2023-02", into an inclusive time range. Each value is
+// a date or date-time of any FHIR precision, with an optional eq, ge, gt, le
+// or lt prefix.
+func fhirDateRange(values []string) (*time.Time, *time.Time, error) {
+	var from, to *time.Time
+	narrowFrom := func(t time.Time) {
+		if from == nil || t.After(*from) {
+			from = &t
+		}
+	}
+	narrowTo := func(t time.Time) {
+		if to == nil || t.Before(*to) {
+			to = &t
+		}
+	}
+
+	for _, value := range values {
+		prefix := "eq"
+		if len(value) > 2 && strings.ContainsAny(value[:1], "abcdefghijklmnopqrstuvwxyz") {
+			prefix, value = value[:2], value[2:]
+		}
+		start, end, err := fhirDateBounds(value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		last := end.Add(-time.Nanosecond)
+		switch prefix {
+		case "eq":
+			narrowFrom(start)
+			narrowTo(last)
+		case "ge":
+			narrowFrom(start)
+		case "gt":
+			narrowFrom(end)
+		case "le":
+			narrowTo(last)
+		case "lt":
+			narrowTo(start.Add(-time.Nanosecond))
+		default:
+			return nil, nil, validationErrorf("unsupported date prefix %q", prefix)
+		}
+	}
+	return from, to, nil
+}
+
+// fhirDateBounds returns the start of a FHIR date or date-time and the start
+// of the period after it, at the precision it was given in. Dates without a
+// time are read in UTC.
+func fhirDateBounds(value string) (time.Time, time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, t.Add(time.Second), nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04Z07:00", value); err == nil {
+		return t, t.Add(time.Minute), nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, t.AddDate(0, 0, 1), nil
+	}
+	if t, err := time.Parse("2006-01", value); err == nil {
+		return t, t.AddDate(0, 1, 0), nil
+	}
+	if t, err := time.Parse("2006", value); err == nil {
+		return t, t.AddDate(1, 0, 0), nil
+	}
+	return time.Time{}, time.Time{}, validationErrorf("invalid date %q", value)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObservationFromVitals(t *testing.T) {
+	at := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	device := uint(3)
+	rows := []models.Vital{
+		{Model: gorm.Model{ID: 8}, Username: "JohnDoe", VitalID: "BloodPressure", Component: "diastolic", Value: 80, Unit: "mmHg", Timestamp: at},
+		{Model: gorm.Model{ID: 7}, Username: "JohnDoe", VitalID: "BloodPressure", Component: "systolic", Value: 120, Unit: "mmHg", Timestamp: at,
+			SourceType: models.SourceSmartwatch, DeviceID: &device, Method: "oscillometric", BodySite: "Left wrist"},
+	}
+
+	observation := observationFromVitals(bloodPressureType(), rows)
+	assert.Equal(t, "7", observation.ID, "A reading should be identified by its first row")
+	assert.Equal(t, "Patient/JohnDoe", observation.Subject.Reference)
+	assert.Equal(t, "2023-01-01T08:00:00Z", observation.EffectiveDateTime)
+	assert.Equal(t, "85354-9", observation.Code.Coding[0].Code)
+	assert.Nil(t, observation.ValueQuantity)
+	assert.Len(t, observation.Component, 2)
+	assert.Equal(t, "8480-6", observation.Component[0].Code.Coding[0].Code, "Components should follow the vital type's order")
+	assert.Equal(t, "mm[Hg]", observation.Component[0].ValueQuantity.Code)
+	assert.Equal(t, 120.0, *observation.Component[0].ValueQuantity.Value)
+	assert.Equal(t, "oscillometric", observation.Method.Text)
+	assert.Equal(t, "Left wrist", observation.BodySite.Text)
+	assert.Equal(t, "Device/3", observation.Device.Reference)
+
+	custom := observationFromVitals(models.VitalType{VitalID: "Glucose"}, []models.Vital{
+		{Model: gorm.Model{ID: 9}, Username: "JohnDoe", VitalID: "Glucose", Value: 5.5, Unit: "mmol/L", Timestamp: at},
+	})
+	assert.Equal(t, []models.FHIRCoding{{System: vitalIDSystem, Code: "Glucose"}}, custom.Code.Coding)
+	assert.Equal(t, 5.5, *custom.ValueQuantity.Value)
+	assert.Nil(t, custom.Method, "Readings of unknown provenance should have no method")
+}
+
+func TestConceptLookup(t *testing.T) {
+	heartRate := models.VitalType{VitalID: "HeartRate", Unit: "bpm", LoincCode: "8867-4"}
+	bloodPressure := bloodPressureType()
+	vitalTypes := []models.VitalType{heartRate, bloodPressure}
+
+	assert.Equal(t, []string{"HeartRate"}, vitalIDsForCode(vitalTypes, "http://loinc.org|8867-4"))
+	assert.Equal(t, []string{"BloodPressure"}, vitalIDsForCode(vitalTypes, "8480-6"), "Component codes should find their vital")
+	assert.Equal(t, []string{"HeartRate"}, vitalIDsForCode(vitalTypes, "HeartRate"))
+	assert.Empty(t, vitalIDsForCode(vitalTypes, "http://snomed.info/sct|8867-4"))
+
+	vitalType, component, err := seriesForConcept(vitalTypes, models.FHIRCodeableConcept{Coding: []models.FHIRCoding{{System: loincSystem, Code: "8462-4"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, "BloodPressure", vitalType.VitalID)
+	assert.Equal(t, "diastolic", component)
+
+	name, ok := componentForConcept(bloodPressure, models.FHIRCodeableConcept{Coding: []models.FHIRCoding{{Code: "BloodPressure.systolic", System: vitalIDSystem}}})
+	assert.True(t, ok)
+	assert.Equal(t, "systolic", name)
+}
+
+func TestQuantityUnit(t *testing.T) {
+	heartRate := seriesOf(models.VitalType{VitalID: "HeartRate", Unit: "bpm"})[0]
+	temperature := seriesOf(models.VitalType{VitalID: "Temperature", Unit: "°C"})[0]
+
+	assert.Equal(t, "bpm", quantityUnit(models.FHIRQuantity{System: ucumSystem, Code: "/min", Unit: "beats/minute"}, heartRate))
+	assert.Equal(t, "°F", quantityUnit(models.FHIRQuantity{System: ucumSystem, Code: "[degF]"}, temperature))
+	assert.Equal(t, "F", quantityUnit(models.FHIRQuantity{Unit: "F"}, temperature), "Uncoded units should be passed on as given")
+}
+
+func TestFHIRDateRange(t *testing.T) {
+	from, to, err := fhirDateRange([]string{"ge2023-01", "lt2023-01-15"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), *from)
+	assert.Equal(t, time.Date(2023, 1, 14, 23, 59, 59, 999999999, time.UTC), *to)
+
+	from, to, err = fhirDateRange([]string{"2023-03-02"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 3, 2, 0, 0, 0, 0, time.UTC), *from)
+	assert.Equal(t, time.Date(2023, 3, 2, 23, 59, 59, 999999999, time.UTC), *to)
+
+	from, to, err = fhirDateRange([]string{"gt2023-01-01T08:00:00+01:00", "le2023"})
+	assert.NoError(t, err)
+	assert.True(t, time.Date(2023, 1, 1, 7, 0, 1, 0, time.UTC).Equal(*from))
+	assert.Equal(t, time.Date(2023, 12, 31, 23, 59, 59, 999999999, time.UTC), *to)
+
+	_, _, err = fhirDateRange([]string{"ap2023"})
+	assert.True(t, IsValidationError(err))
+	_, _, err = fhirDateRange([]string{"ge01/02/2023"})
+	assert.True(t, IsValidationError(err))
+}
+
+func TestPatientFromUser(t *testing.T) {
+	patient := PatientFromUser(models.User{Username: "JohnDoe", Gender: "M"})
+	assert.Equal(t, "Patient", patient.ResourceType)
+	assert.Equal(t, "JohnDoe", patient.ID)
+	assert.Equal(t, "male", patient.Gender)
+	assert.Equal(t, "unknown", PatientFromUser(models.User{}).Gender)
+}
@@ -0,0 +1,492 @@
+package app
+
+import (
+	"fmt"
+	"medical-vitals-management-system/models"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// hl7Message is a parsed HL7 v2 message: its segments in order, each split
+// into fields, with the encoding characters declared in MSH.
+type hl7Message struct {
+	segments     [][]string
+	component    string
+	repetition   string
+	escape       string
+	subcomponent string
+}
+
+// hl7ErrorCode is an HL7 table 0357 message error condition, reported in
+// ERR-3 of a NAK.
+type hl7ErrorCode struct {
+	id   string
+	text string
+}
+
+var (
+	hl7SegmentSequenceError   = hl7ErrorCode{"100", "Segment sequence error"}
+	hl7RequiredFieldMissing   = hl7ErrorCode{"101", "Required field missing"}
+	hl7DataTypeError          = hl7ErrorCode{"102", "Data type error"}
+	hl7TableValueNotFound     = hl7ErrorCode{"103", "Table value not found"}
+	hl7UnsupportedMessageType = hl7ErrorCode{"200", "Unsupported message type"}
+	hl7UnknownKeyIdentifier   = hl7ErrorCode{"204", "Unknown key identifier"}
+	hl7InternalError          = hl7ErrorCode{"207", "Application internal error"}
+)
+
+// hl7Error is a message that could not be processed. Rejected messages were
+// malformed, unsupported or invalid, so sending them again cannot succeed,
+// and are answered with AR and the code of the problem; the rest failed here
+// and are answered with AE and an application internal error.
+type hl7Error struct {
+	rejected bool
+	code     hl7ErrorCode
+	message  string
+}
+
+func (e *hl7Error) Error() string {
+	return e.message
+}
+
+func hl7Rejectf(code hl7ErrorCode, format string, args ...interface{}) error {
+	return &hl7Error{rejected: true, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func hl7Errorf(format string, args ...interface{}) error {
+	return &hl7Error{code: hl7InternalError, message: fmt.Sprintf(format, args...)}
+}
+
+// ProcessHL7Message stores the vitals reported by an ORU^R01 message and
+// returns the ACK to send back. Numeric OBX segments whose observation
+// identifier is a known LOINC code or vital ID become vitals of the user named
+// by PID-3, and components of a composite vital observed at the same time are
+// combined into one reading. The message is stored all or nothing; if it
+// cannot be, the reply is a NAK and the message is kept as a dead letter.
+func ProcessHL7Message(db *gorm.DB, raw string, remoteAddr string) string {
+	message, err := parseHL7(raw)
+	if err != nil {
+		recordDeadLetter(db, raw, remoteAddr, "", err)
+		return hl7Ack(nil, err)
+	}
+
+	err = storeHL7Vitals(db, message)
+	if err != nil {
+		recordDeadLetter(db, raw, remoteAddr, message.field("MSH", 10), err)
+	}
+	return hl7Ack(message, err)
+}
+
+func storeHL7Vitals(db *gorm.DB, message *hl7Message) error {
+	messageType := message.field("MSH", 9)
+	if parts := strings.Split(messageType, message.component); len(parts) < 2 || parts[0] != "ORU" || parts[1] != "R01" {
+		return hl7Rejectf(hl7UnsupportedMessageType, "unsupported message type %q; only ORU^R01 is accepted", messageType)
+	}
+
+	username, err := hl7Patient(db, message)
+	if err != nil {
+		return err
+	}
+
+	vitalTypes, err := GetVitalTypes(db, false)
+	if err != nil {
+		return err
+	}
+	readings, err := hl7Readings(message, vitalTypes, username)
+	if err != nil {
+		return err
+	}
+
+	results, err := ValidateVitals(db, readings)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for i, result := range results {
+		if result.Status != ingestAccepted {
+			problems = append(problems, fmt.Sprintf("%s at %s: %s", readings[i].VitalID, readings[i].Timestamp.Format(time.RFC3339), result.Reason))
+		}
+	}
+	if len(problems) > 0 {
+		return hl7Rejectf(hl7DataTypeError, "%s", strings.Join(problems, "; "))
+	}
+
+	if results, err = CreateVitals(db, readings); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Status != ingestAccepted {
+			return hl7Errorf("%s", result.Reason)
+		}
+	}
+	return nil
+}
+
+// hl7Patient maps the identifiers in PID-3 to a user. Each identifier is
+// tried as a username; if HL7_PATIENT_ID_AUTHORITY is set, only identifiers
+// assigned by that authority are considered.
+func hl7Patient(db *gorm.DB, message *hl7Message) (string, error) {
+	if message.segment("PID") == nil {
+		return "", hl7Rejectf(hl7SegmentSequenceError, "the message has no PID segment")
+	}
+
+	authority := os.Getenv("HL7_PATIENT_ID_AUTHORITY")
+	for _, identifier := range strings.Split(message.field("PID", 3), message.repetition) {
+		components := strings.Split(identifier, message.component)
+		id := message.unescape(components[0])
+		if id == "" {
+			continue
+		}
+		if authority != "" && (len(components) < 4 || message.unescape(strings.Split(components[3], message.subcomponent)[0]) != authority) {
+			continue
+		}
+
+		exists, err := UserExists(db, id)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return id, nil
+		}
+	}
+	return "", hl7Rejectf(hl7UnknownKeyIdentifier, "no user matches the patient identifiers in PID-3")
+}
+
+// hl7Readings converts the OBX segments of a message into readings of
+// vitalTypes for username. Observations are timed by OBX-14, falling back to OBR-7 and then
+// MSH-7. Readings come from a hospital monitor, measured by the method in OBX-17 at the
+// site in OBX-20.
+func hl7Readings(message *hl7Message, vitalTypes []models.VitalType, username string) ([]models.VitalReading, error) {
+	defaultTime := message.field("OBR", 7)
+	if defaultTime == "" {
+		defaultTime = message.field("MSH", 7)
+	}
+
+	var readings []models.VitalReading
+	index := make(map[string]int)
+	for _, obx := range message.all("OBX") {
+		setID := message.get(obx, 1)
+
+		switch message.get(obx, 11) {
+		case "D", "W", "X":
+			// Deleted, wrong or cancelled results carry no measurement.
+			continue
+		}
+		if valueType := message.get(obx, 2); valueType != "NM" {
+			logrus.Infof("Skipping OBX %s with non-numeric value type %q", setID, valueType)
+			continue
+		}
+
+		identifier := strings.Split(message.get(obx, 3), message.component)
+		concept := models.FHIRCodeableConcept{}
+		for i := 0; i < len(identifier); i += 3 {
+			coding := models.FHIRCoding{Code: message.unescape(identifier[i])}
+			if i+2 < len(identifier) {
+				coding.System = hl7CodingSystem(message.unescape(identifier[i+2]))
+			}
+			concept.Coding = append(concept.Coding, coding)
+		}
+		vitalType, component, err := seriesForConcept(vitalTypes, concept)
+		if err != nil {
+			logrus.Infof("Skipping OBX %s with unknown observation identifier %q", setID, message.get(obx, 3))
+			continue
+		}
+		if component == "" && len(vitalType.Components) > 0 {
+			// Some codes, such as SpO2's, name both a panel and one of its
+			// components; a single OBX can only be the component.
+			component, _ = componentForConcept(vitalType, concept)
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimSpace(message.get(obx, 5)), 64)
+		if err != nil {
+			return nil, hl7Rejectf(hl7DataTypeError, "OBX %s has a non-numeric value %q", setID, message.get(obx, 5))
+		}
+
+		observed := message.get(obx, 14)
+		if observed == "" {
+			observed = defaultTime
+		}
+		timestamp, err := parseHL7Time(observed)
+		if err != nil {
+			return nil, hl7Rejectf(hl7DataTypeError, "OBX %s has an invalid observation time %q", setID, observed)
+		}
+
+		units := strings.Split(message.get(obx, 6), message.component)
+		quantity := models.FHIRQuantity{Code: message.unescape(units[0])}
+		if len(units) > 2 && !strings.EqualFold(units[2], "UCUM") {
+			quantity.System = message.unescape(units[2])
+			quantity.Unit = quantity.Code
+		}
+		series, err := selectSeries(vitalType, component)
+		if err != nil {
+			return nil, err
+		}
+		unit := ""
+		if quantity.Code != "" {
+			unit = quantityUnit(quantity, series[0])
+		}
+
+		key := fmt.Sprintf("%s\x00%d", vitalType.VitalID, timestamp.UnixNano())
+		i, ok := index[key]
+		if !ok || component == "" {
+			i = len(readings)
+			index[key] = i
+			readings = append(readings, models.VitalReading{Username: username, VitalID: vitalType.VitalID, Timestamp: timestamp, Source: models.VitalSource{
+				Type:     models.SourceHospitalMonitor,
+				Method:   message.text(message.get(obx, 17)),
+				BodySite: message.text(message.get(obx, 20)),
+			}})
+		}
+
+		reading := &readings[i]
+		if len(vitalType.Components) == 0 {
+			reading.Value = &value
+			reading.Unit = unit
+			continue
+		}
+		if component == "" {
+			return nil, hl7Rejectf(hl7DataTypeError, "OBX %s reports %s as a whole; send one OBX per component", setID, vitalType.VitalID)
+		}
+		if reading.Components == nil {
+			reading.Components = make(map[string]float64)
+			reading.ComponentUnits = make(map[string]string)
+		}
+		reading.Components[component] = value
+		if unit != "" {
+			reading.ComponentUnits[component] = unit
+		}
+	}
+
+	if len(readings) == 0 {
+		return nil, hl7Rejectf(hl7TableValueNotFound, "the message has no numeric observations of a known vital type")
+	}
+	return readings, nil
+}
+
+// hl7CodingSystem maps HL7 v2 coding system names to the system URIs used
+// for FHIR codings.
+func hl7CodingSystem(system string) string {
+	switch strings.ToUpper(system) {
+	case "LN", "LOINC":
+		return loincSystem
+	case "":
+		return ""
+	default:
+		return vitalIDSystem
+	}
+}
+
+// parseHL7 splits a message into segments and fields. Segments may be ended
+// by CR, LF or CRLF.
+func parseHL7(raw string) (*hl7Message, error) {
+	raw = strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\r"), "\n", "\r")
+	if !strings.HasPrefix(raw, "MSH") || len(raw) < 8 {
+		return nil, hl7Rejectf(hl7SegmentSequenceError, "the message does not start with an MSH segment")
+	}
+
+	separator := raw[3:4]
+	encoding := strings.SplitN(raw[4:], separator, 2)[0]
+	if len(encoding) < 4 {
+		return nil, hl7Rejectf(hl7DataTypeError, "MSH-2 must declare the component, repetition, escape and subcomponent characters")
+	}
+
+	message := &hl7Message{
+		component:    encoding[0:1],
+		repetition:   encoding[1:2],
+		escape:       encoding[2:3],
+		subcomponent: encoding[3:4],
+	}
+	for _, line := range strings.Split(raw, "\r") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, separator)
+		if fields[0] == "MSH" {
+			// MSH-1 is the field separator itself, so shift the fields to
+			// number them as in every other segment.
+			fields = append([]string{"MSH", separator}, fields[1:]...)
+		}
+		message.segments = append(message.segments, fields)
+	}
+
+	if message.field("MSH", 10) == "" {
+		return nil, hl7Rejectf(hl7RequiredFieldMissing, "MSH-10 message control ID is required")
+	}
+	return message, nil
+}
+
+// segment returns the first segment with the given name
+func (m *hl7Message) segment(name string) []string {
+	for _, segment := range m.segments {
+		if segment[0] == name {
+			return segment
+		}
+	}
+	return nil
+}
+
+// all returns every segment with the given name
+func (m *hl7Message) all(name string) [][]string {
+	var segments [][]string
+	for _, segment := range m.segments {
+		if segment[0] == name {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// field returns field n of the first segment with the given name
+func (m *hl7Message) field(name string, n int) string {
+	return m.get(m.segment(name), n)
+}
+
+func (m *hl7Message) get(segment []string, n int) string {
+	if n < len(segment) {
+		return segment[n]
+	}
+	return ""
+}
+
+// text returns the text of a coded element (CWE or CE), or its code if it
+// has no text
+func (m *hl7Message) text(value string) string {
+	components := strings.Split(value, m.component)
+	if len(components) > 1 && components[1] != "" {
+		return m.unescape(components[1])
+	}
+	return m.unescape(components[0])
+}
+
+// unescape replaces the HL7 escape sequences for the delimiters
+func (m *hl7Message) unescape(value string) string {
+	if !strings.Contains(value, m.escape) {
+		return value
+	}
+	e := m.escape
+	return strings.NewReplacer(
+		e+"F"+e, "|",
+		e+"S"+e, m.component,
+		e+"R"+e, m.repetition,
+		e+"T"+e, m.subcomponent,
+		e+"E"+e, m.escape,
+	).Replace(value)
+}
+
+// parseHL7Time parses an HL7 DTM timestamp, YYYY[MM[DD[HH[MM[SS[.S+]]]]]]
+// with an optional +/-ZZZZ offset. Timestamps without an offset are read in
+// UTC.
+func parseHL7Time(value string) (time.Time, error) {
+	layouts := []string{"20060102150405", "200601021504", "2006010215", "20060102", "200601", "2006"}
+
+	offset := ""
+	if i := strings.IndexAny(value, "+-"); i >= 0 {
+		value, offset = value[:i], value[i:]
+	}
+	fraction := ""
+	if i := strings.Index(value, "."); i >= 0 {
+		value, fraction = value[:i], value[i:]
+	}
+
+	for _, layout := range layouts {
+		if len(value) != len(layout) {
+			continue
+		}
+		if fraction != "" && layout != layouts[0] {
+			break
+		}
+		if fraction != "" {
+			layout += "." + strings.Repeat("0", len(fraction)-1)
+		}
+		if offset != "" {
+			return time.Parse(layout+"-0700", value+fraction+offset)
+		}
+		return time.Parse(layout, value+fraction)
+	}
+	return time.Time{}, fmt.Errorf("invalid HL7 timestamp %q", value)
+}
+
+// hl7Ack builds the ACK for a message, or a NAK if err is set. message is nil
+// if it could not be parsed.
+func hl7Ack(message *hl7Message, err error) string {
+	separator, encoding := "|", `^~\&`
+	msh := func(n int) string { return "" }
+	version := "2.5.1"
+	if message != nil {
+		separator = message.field("MSH", 1)
+		encoding = message.field("MSH", 2)
+		msh = func(n int) string { return message.field("MSH", n) }
+		if v := msh(12); v != "" {
+			version = v
+		}
+	}
+
+	code, errorCode := "AA", hl7InternalError
+	if err != nil {
+		code = "AE"
+		if hl7Err, ok := err.(*hl7Error); ok {
+			errorCode = hl7Err.code
+			if hl7Err.rejected {
+				code = "AR"
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	segments := [][]string{
+		{"MSH", encoding, msh(5), msh(6), msh(3), msh(4), now.Format("20060102150405"), "", "ACK" + string(encoding[0]) + "R01" + string(encoding[0]) + "ACK", fmt.Sprintf("ACK%d", now.UnixNano()), firstNonEmpty(msh(11), "P"), version},
+		{"MSA", code, msh(10)},
+	}
+	if err != nil {
+		diagnostic := strings.NewReplacer("\r", " ", "\n", " ", separator, " ").Replace(err.Error())
+		segments = append(segments, []string{"ERR", "", "", errorCode.id + string(encoding[0]) + errorCode.text + string(encoding[0]) + "HL70357", "E", "", "", "", diagnostic})
+	}
+
+	lines := make([]string, len(segments))
+	for i, segment := range segments {
+		lines[i] = strings.Join(segment, separator)
+	}
+	return strings.Join(lines, "\r") + "\r"
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// recordDeadLetter keeps a message that could not be processed for later
+// inspection.
+func recordDeadLetter(db *gorm.DB, raw, remoteAddr, controlID string, reason error) {
+	deadLetter := models.HL7DeadLetter{
+		RemoteAddr: remoteAddr,
+		ControlID:  controlID,
+		Message:    raw,
+		Error:      reason.Error(),
+	}
+	if err := db.Create(&deadLetter).Error; err != nil {
+		logrus.Errorf("Failed to record HL7 dead letter from %s: %v", remoteAddr, err)
+		return
+	}
+	logrus.Warnf("HL7 message %q from %s dead-lettered: %v", controlID, remoteAddr, reason)
+}
+
+// GetDeadLetters returns the most recent HL7 messages that could not be
+// processed, newest first.
+func GetDeadLetters(db *gorm.DB, limit int) ([]models.HL7DeadLetter, error) {
+	if limit <= 0 || limit > maxPageSize {
+		limit = defaultPageSize
+	}
+	var deadLetters []models.HL7DeadLetter
+	if err := db.Order("id DESC").Limit(limit).Find(&deadLetters).Error; err != nil {
+		return nil, fmt.Errorf("failed to get dead letters: %v", err)
+	}
+	return deadLetters, nil
+}
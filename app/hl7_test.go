@@ -0,0 +1,95 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const oruMessage = "MSH|^~\\&|MONITOR|WARD3|VITALS|HOSP|20230101080500||ORU^R01^ORU_R01|MSG0001|P|2.5.1\r" +
+	"PID|1||12345^^^HOSP^MR~JohnDoe^^^VITALS^PI||Doe^John\r" +
+	"OBR|1|||85354-9^Blood pressure panel^LN|||20230101080000\r" +
+	"OBX|1|NM|8867-4^Heart rate^LN||72|/min^^UCUM|||||F|||20230101080000+0100|||AMEAS^auto-measurement^MDC|||Left wrist\r" +
+	"OBX|2|NM|8480-6^Systolic blood pressure^LN||120|mm[Hg]^^UCUM|||||F\r" +
+	"OBX|3|NM|8462-4^Diastolic blood pressure^LN||80|mm[Hg]^^UCUM|||||F\r" +
+	"OBX|4|ST|8867-4^Heart rate^LN||irregular||||||F\r" +
+	"OBX|5|NM|8310-5^Body temperature^LN||98.6|[degF]^^UCUM|||||X\r"
+
+func TestParseHL7(t *testing.T) {
+	message, err := parseHL7(strings.ReplaceAll(oruMessage, "\r", "\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "|", message.field("MSH", 1))
+	assert.Equal(t, "ORU^R01^ORU_R01", message.field("MSH", 9))
+	assert.Equal(t, "MSG0001", message.field("MSH", 10))
+	assert.Len(t, message.all("OBX"), 5)
+	assert.Equal(t, "a|b^c", message.unescape(`a\F\b\S\c`))
+
+	_, err = parseHL7("PID|1")
+	assert.Error(t, err)
+	_, err = parseHL7("MSH|^~\\&|A|B|C|D|20230101||ORU^R01|")
+	assert.Error(t, err, "A message without a control ID cannot be acknowledged")
+}
+
+func TestHL7Readings(t *testing.T) {
+	message, err := parseHL7(oruMessage)
+	assert.NoError(t, err)
+	vitalTypes := []models.VitalType{
+		{VitalID: "HeartRate", Unit: "bpm", MinValue: 20, MaxValue: 300, LoincCode: "8867-4"},
+		{VitalID: "Temperature", Unit: "°C", MinValue: 25, MaxValue: 45, LoincCode: "8310-5"},
+		bloodPressureType(),
+	}
+
+	readings, err := hl7Readings(message, vitalTypes, "JohnDoe")
+	assert.NoError(t, err)
+	assert.Len(t, readings, 2, "Non-numeric and cancelled results should be skipped")
+
+	heartRate := readings[0]
+	assert.Equal(t, "HeartRate", heartRate.VitalID)
+	assert.Equal(t, 72.0, *heartRate.Value)
+	assert.Equal(t, "bpm", heartRate.Unit)
+	assert.True(t, time.Date(2023, 1, 1, 7, 0, 0, 0, time.UTC).Equal(heartRate.Timestamp), "OBX-14 should take precedence")
+	assert.Equal(t, models.VitalSource{Type: models.SourceHospitalMonitor, Method: "auto-measurement", BodySite: "Left wrist"}, heartRate.Source)
+
+	bloodPressure := readings[1]
+	assert.Equal(t, "BloodPressure", bloodPressure.VitalID)
+	assert.Equal(t, map[string]float64{"systolic": 120, "diastolic": 80}, bloodPressure.Components)
+	assert.Equal(t, "mmHg", bloodPressure.ComponentUnits["systolic"])
+	assert.True(t, time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC).Equal(bloodPressure.Timestamp), "OBR-7 should time OBX segments without OBX-14")
+}
+
+func TestParseHL7Time(t *testing.T) {
+	parsed, err := parseHL7Time("20230101083015.25-0500")
+	assert.NoError(t, err)
+	assert.True(t, time.Date(2023, 1, 1, 13, 30, 15, 250000000, time.UTC).Equal(parsed))
+
+	parsed, err = parseHL7Time("202301011230")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 1, 1, 12, 30, 0, 0, time.UTC), parsed)
+
+	_, err = parseHL7Time("2023-01-01")
+	assert.Error(t, err)
+}
+
+func TestHL7Ack(t *testing.T) {
+	message, err := parseHL7(oruMessage)
+	assert.NoError(t, err)
+
+	ack := strings.Split(hl7Ack(message, nil), "\r")
+	msh := strings.Split(ack[0], "|")
+	assert.Equal(t, "VITALS", msh[2], "The ACK should be sent from the receiving application")
+	assert.Equal(t, "MONITOR", msh[4])
+	assert.Equal(t, "ACK^R01^ACK", msh[8])
+	assert.Equal(t, "MSA|AA|MSG0001", ack[1])
+
+	nak := strings.Split(hl7Ack(message, hl7Errorf("value out of range")), "\r")
+	assert.Equal(t, "MSA|AE|MSG0001", nak[1])
+	assert.Contains(t, nak[2], "value out of range")
+	assert.Equal(t, "207^Application internal error^HL70357", strings.Split(nak[2], "|")[3])
+
+	rejected := strings.Split(hl7Ack(nil, hl7Rejectf(hl7SegmentSequenceError, "not HL7")), "\r")
+	assert.Equal(t, "MSA|AR|", rejected[1], "Unparseable messages should still be answered")
+	assert.Equal(t, "100^Segment sequence error^HL70357", strings.Split(rejected[2], "|")[3], "Rejections should name the problem with the input")
+}
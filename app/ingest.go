@@ -0,0 +1,196 @@
+package app
+
+import (
+	"fmt"
+	"medical-vitals-management-system/models"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ingestChunkSize is the number of readings written per transaction by
+// CreateVitals.
+const ingestChunkSize = 500
+
+const (
+	ingestAccepted = "accepted"
+	ingestRejected = "rejected"
+)
+
+// CreateVitals validates and stores a batch of readings, returning one result
+// per reading in the same order. Each reading is checked as by CreateVital,
+// but vital types and users are looked up once per batch. Valid readings are
+// written in transactions of ingestChunkSize; if a chunk fails, its readings
+// are retried one by one so a single bad row only rejects itself.
+func CreateVitals(db *gorm.DB, readings []models.VitalReading) ([]models.IngestResult, error) {
+	batch, err := validateVitals(db, readings)
+	if err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(batch.pending); start += ingestChunkSize {
+		end := start + ingestChunkSize
+		if end > len(batch.pending) {
+			end = len(batch.pending)
+		}
+		chunk := batch.pending[start:end]
+
+		if err := insertVitalRows(db, batch.rows, chunk); err == nil {
+			continue
+		}
+		for _, i := range chunk {
+			if err := insertVitalRows(db, batch.rows, []int{i}); err != nil {
+				batch.results[i] = rejected(i, err.Error())
+			}
+		}
+	}
+
+	return batch.results, nil
+}
+
+// ValidateVitals checks a batch of readings as CreateVitals would, without
+// storing them.
+func ValidateVitals(db *gorm.DB, readings []models.VitalReading) ([]models.IngestResult, error) {
+	batch, err := validateVitals(db, readings)
+	if err != nil {
+		return nil, err
+	}
+	return batch.results, nil
+}
+
+// ingestBatch is a validated batch of readings: the result of each, the rows
+// to store for each valid reading, and the indexes of the valid readings.
+type ingestBatch struct {
+	results []models.IngestResult
+	rows    [][]models.Vital
+	pending []int
+}
+
+func validateVitals(db *gorm.DB, readings []models.VitalReading) (ingestBatch, error) {
+	batch := ingestBatch{
+		results: make([]models.IngestResult, len(readings)),
+		rows:    make([][]models.Vital, len(readings)),
+	}
+	for i := range batch.results {
+		batch.results[i] = models.IngestResult{Index: i, Status: ingestAccepted}
+	}
+
+	users, err := existingUsers(db, readings)
+	if err != nil {
+		return batch, err
+	}
+
+	vitalTypes := make(map[string]models.VitalType)
+	vitalTypeErrors := make(map[string]error)
+	type readingKey struct {
+		username  string
+		vitalID   string
+		timestamp int64
+	}
+	seen := make(map[readingKey]int)
+
+	for i, reading := range readings {
+		if !users[reading.Username] {
+			batch.results[i] = rejected(i, fmt.Sprintf("user not found: %s", reading.Username))
+			continue
+		}
+
+		vitalType, ok := vitalTypes[reading.VitalID]
+		if !ok && vitalTypeErrors[reading.VitalID] == nil {
+			vitalType, err = GetActiveVitalType(db, reading.VitalID)
+			if err != nil {
+				if !IsValidationError(err) {
+					return batch, err
+				}
+				vitalTypeErrors[reading.VitalID] = err
+			} else {
+				vitalTypes[reading.VitalID] = vitalType
+			}
+		}
+		if err := vitalTypeErrors[reading.VitalID]; err != nil {
+			batch.results[i] = rejected(i, err.Error())
+			continue
+		}
+
+		key := readingKey{reading.Username, vitalType.VitalID, reading.Timestamp.UnixNano()}
+		if first, ok := seen[key]; ok {
+			batch.results[i] = rejected(i, fmt.Sprintf("duplicate of reading %d", first))
+			continue
+		}
+
+		if batch.rows[i], err = readingToVitals(vitalType, reading); err != nil {
+			batch.results[i] = rejected(i, err.Error())
+			continue
+		}
+		seen[key] = i
+		batch.pending = append(batch.pending, i)
+	}
+	return batch, nil
+}
+
+// SummarizeIngest counts the accepted and rejected readings of a bulk insert
+func SummarizeIngest(results []models.IngestResult) models.IngestReport {
+	report := models.IngestReport{Results: results}
+	for _, result := range results {
+		if result.Status == ingestAccepted {
+			report.Accepted++
+		} else {
+			report.Rejected++
+		}
+	}
+	return report
+}
+
+// RejectedIngest is the result of a reading rejected before it reached
+// CreateVitals, such as one that could not be parsed.
+func RejectedIngest(index int, reason string) models.IngestResult {
+	return rejected(index, reason)
+}
+
+func rejected(index int, reason string) models.IngestResult {
+	return models.IngestResult{Index: index, Status: ingestRejected, Reason: reason}
+}
+
+// insertVitalRows writes the rows of the given readings in one transaction
+// and checks the stored rows against the alert rules. The rows of rows are
+// left as they were, so that a failed chunk can be retried.
+func insertVitalRows(db *gorm.DB, rows [][]models.Vital, readings []int) error {
+	var stored []models.Vital
+	tx := db.Begin()
+	for _, i := range readings {
+		for _, vital := range rows[i] {
+			if err := tx.Create(&vital).Error; err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to insert vital: %v", err)
+			}
+			stored = append(stored, vital)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to insert vital: %v", err)
+	}
+	raiseAlerts(db, stored)
+	return nil
+}
+
+// existingUsers returns the set of usernames in readings that exist
+func existingUsers(db *gorm.DB, readings []models.VitalReading) (map[string]bool, error) {
+	var usernames []string
+	for _, reading := range readings {
+		usernames = append(usernames, reading.Username)
+	}
+	usernames = uniqueStrings(usernames)
+
+	users := make(map[string]bool, len(usernames))
+	if len(usernames) == 0 {
+		return users, nil
+	}
+
+	var found []string
+	if err := db.Model(&models.User{}).Where("username IN (?)", usernames).Pluck("username", &found).Error; err != nil {
+		return nil, fmt.Errorf("failed to check user existence: %v", err)
+	}
+	for _, username := range found {
+		users[username] = true
+	}
+	return users, nil
+}
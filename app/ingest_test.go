@@ -0,0 +1,22 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarizeIngest(t *testing.T) {
+	results := []models.IngestResult{
+		{Index: 0, Status: ingestAccepted},
+		RejectedIngest(1, "invalid timestamp format"),
+		{Index: 2, Status: ingestAccepted},
+	}
+
+	report := SummarizeIngest(results)
+	assert.Equal(t, 2, report.Accepted)
+	assert.Equal(t, 1, report.Rejected)
+	assert.Equal(t, "rejected", report.Results[1].Status)
+	assert.Equal(t, "invalid timestamp format", report.Results[1].Reason)
+}
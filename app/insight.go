@@ -4,99 +4,347 @@ import (
 	"fmt"
 	"medical-vitals-management-system/models"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
-// AggregateVitals fetches vitals from the database and calculates the mean value for each requested vital
-func AggregateVitals(db *gorm.DB, request models.AggregateRequest) (map[string]float64, error) {
-	aggregatedValues := make(map[string]float64)
+// populationInsightWorkers bounds how many vitals of a batch are compared
+// against the population at the same time.
+const populationInsightWorkers = 4
 
-	var vitals []models.Vital
-	err := db.Where("username = ? AND timestamp BETWEEN ? AND ?", request.Username, request.StartTimestamp, request.EndTimestamp).
-		Find(&vitals).Error
+// maxBatchVitals is the largest number of vitals one batch may ask for.
+const maxBatchVitals = 50
+
+// CalculatePopulationInsights computes the population insight of each vital
+// in the request concurrently. A vital that fails gets an error entry in the
+// result instead of failing the batch.
+func CalculatePopulationInsights(db *gorm.DB, request models.BatchPopulationInsightRequest) (map[string]models.PopulationInsightResult, error) {
+	vitalIDs := uniqueStrings(request.VitalIDs)
+	if len(vitalIDs) == 0 {
+		return nil, validationErrorf("vital_ids is required")
+	}
+	if len(vitalIDs) > maxBatchVitals {
+		return nil, validationErrorf("at most %d vital_ids may be requested at once", maxBatchVitals)
+	}
+
+	// Each vital reserves its own spend as it is computed, so the budget of
+	// the whole batch, one disclosure per series, is checked first to refuse
+	// a batch that cannot be answered in full.
+	series, err := countSeries(db, vitalIDs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get vitals: %v", err)
+		return nil, err
+	}
+	if err := checkBudget(db, PrivacySettingsFromEnv(), request.Username, series); err != nil {
+		return nil, err
 	}
 
-	if len(vitals) == 0 {
-		return nil, fmt.Errorf("no vitals found for the specified user and time range")
+	results := make([]models.PopulationInsightResult, len(vitalIDs))
+	runBounded(len(vitalIDs), populationInsightWorkers, func(i int) {
+		data, err := GetPopulationInsight(db, models.PopulationInsightRequest{
+			Username:       request.Username,
+			VitalID:        vitalIDs[i],
+			Unit:           request.Units[vitalIDs[i]],
+			Cohort:         request.Cohort,
+			StartTimestamp: request.StartTimestamp,
+			EndTimestamp:   request.EndTimestamp,
+		})
+		if err != nil {
+			results[i] = models.PopulationInsightResult{Status: "error", Message: err.Error()}
+			return
+		}
+		results[i] = models.PopulationInsightResult{Status: "success", Data: &data}
+	})
+
+	populationInsights := make(map[string]models.PopulationInsightResult, len(vitalIDs))
+	for i, vitalID := range vitalIDs {
+		populationInsights[vitalID] = results[i]
 	}
+	return populationInsights, nil
+}
 
-	for _, vitalID := range request.VitalIDs {
-		var sum float64
-		count := 0
+// runBounded calls fn for every index below n, running at most workers calls
+// at once, and returns when all of them have finished.
+func runBounded(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
 
-		for _, vital := range vitals {
-			if vital.VitalID == vitalID {
-				sum += vital.Value
-				count++
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
 			}
-		}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
 
-		if count > 0 {
-			meanValue := sum / float64(count)
-			aggregatedValues[vitalID] = meanValue
+// countSeries returns the number of series of the vital types of vitalIDs,
+// each of which a population insight discloses a standing of. Unknown types
+// are left for the insight of each to reject.
+func countSeries(db *gorm.DB, vitalIDs []string) (int, error) {
+	count := 0
+	for _, vitalID := range vitalIDs {
+		vitalType, err := GetVitalType(db, vitalID)
+		if IsValidationError(err) {
+			continue
+		} else if err != nil {
+			return 0, err
 		}
+		count += len(seriesOf(vitalType))
 	}
+	return count, nil
+}
 
-	return aggregatedValues, nil
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		unique = append(unique, value)
+	}
+	return unique
 }
 
-func CalculatePopulationInsights(db *gorm.DB, request models.AggregateRequest) (map[string]string, error) {
-	populationInsights := make(map[string]string)
+// GetPopulationInsight compares a user's vitals against the population, or the cohort given in the request,
+// and provides percentile standings. Composite vitals get one standing per component, or only for the
+// requested component. Values are reported in the requested unit, or the canonical unit if none is given.
+// Each user's mean is computed per stored unit and converted to the canonical unit before the means are
+// combined, so readings in different units are never averaged together.
+func GetPopulationInsight(db *gorm.DB, request models.PopulationInsightRequest) (models.PopulationInsightData, error) {
+	data := models.PopulationInsightData{
+		Username:       request.Username,
+		VitalID:        request.VitalID,
+		StartTimestamp: request.StartTimestamp,
+		EndTimestamp:   request.EndTimestamp,
+	}
 
-	for _, vitalID := range request.VitalIDs {
-		populationInsight, err := GetPopulationInsight(db, request.Username, vitalID, request.StartTimestamp, request.EndTimestamp)
+	vitalType, err := GetVitalType(db, request.VitalID)
+	if err != nil {
+		return data, err
+	}
+	data.VitalID = vitalType.VitalID
+	data.LoincCode = vitalType.LoincCode
+
+	series, err := selectSeries(vitalType, request.Component)
+	if err != nil {
+		return data, err
+	}
+
+	cohort, err := ResolveCohort(db, request.Username, request.Cohort)
+	if err != nil {
+		return data, err
+	}
+
+	privacy := PrivacySettingsFromEnv()
+	disclosures, err := reserveDisclosures(db, privacy, request.Username, series, cohort)
+	if err != nil {
+		return data, err
+	}
+	disclosed := false
+	defer func() {
+		if !disclosed {
+			releaseDisclosures(db, disclosures)
+		}
+	}()
+
+	standings := make(map[string]models.PopulationStanding)
+	populationSizes := make(map[string]int)
+	for _, s := range series {
+		outputUnit, err := resolveUnit(s, request.Unit)
+		if err != nil {
+			return data, err
+		}
+
+		userMeans, err := populationMeans(db, s, request.StartTimestamp, request.EndTimestamp, func(query *gorm.DB) *gorm.DB {
+			return query.Where("vitals.username = ?", request.Username)
+		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to calculate population insight: %v", err)
+			return data, err
+		}
+		cohortMeans, err := populationMeans(db, s, request.StartTimestamp, request.EndTimestamp, func(query *gorm.DB) *gorm.DB {
+			if isEveryone(cohort) {
+				return query
+			}
+			return inCohort(query.Joins("JOIN users ON users.username = vitals.username AND users.deleted_at IS NULL"), cohort)
+		})
+		if err != nil {
+			return data, err
+		}
+
+		userValue, ok := userMeans[request.Username]
+		if !ok {
+			return data, validationErrorf("no %s readings found for %s in the specified time range", s.label(), request.Username)
 		}
-		populationInsights[vitalID] = populationInsight
+
+		if err := checkCohortSize(privacy, s, cohort, len(cohortMeans)); err != nil {
+			return data, err
+		}
+
+		standing := privatizeStanding(privacy, s, populationStanding(s, userValue, cohortMeans))
+		if standing, err = convertStanding(standing, s.Unit, outputUnit); err != nil {
+			return data, err
+		}
+		standings[s.Key()] = standing
+		populationSizes[s.Key()] = len(cohortMeans)
 	}
 
-	return populationInsights, nil
+	for i, s := range series {
+		if err := confirmDisclosure(db, disclosures[i], populationSizes[s.Key()]); err != nil {
+			return data, err
+		}
+	}
+	disclosed = true
+
+	data.Cohort = privatizeCohortSize(privacy, cohort)
+	if data.Privacy, err = privacyReport(db, privacy, request.Username, len(series)); err != nil {
+		return data, err
+	}
+	setStandings(&data, standings)
+	if data.Standing != nil {
+		data.Unit = data.Standing.Unit
+	} else if request.Unit != "" {
+		data.Unit = NormalizeUnit(request.Unit)
+	}
+	data.UCUMUnit = UCUMCode(data.Unit)
+	return data, nil
 }
 
-// GetPopulationInsight compares a user's vitals against the population and provides percentile standings
-func GetPopulationInsight(db *gorm.DB, username, vitalID string, startTimestamp, endTimestamp time.Time) (string, error) {
-	var userAggregatedValue float64
-	err := db.Table("vitals").
-		Select("AVG(value)").
-		Where("username = ? AND vital_id = ? AND timestamp BETWEEN ? AND ?", username, vitalID, startTimestamp, endTimestamp).
-		Row().Scan(&userAggregatedValue)
-	if err != nil {
-		return "", fmt.Errorf("failed to get user's aggregated vital value: %v", err)
-	}
-
-	// Fetch aggregated values of all users for the specified vital
-	var populationValues []float64
-	err = db.Table("vitals").
-		Select("AVG(value)").
-		Where("vital_id = ? AND timestamp BETWEEN ? AND ?", vitalID, startTimestamp, endTimestamp).
-		Group("username").
-		Order("AVG(value)").
-		Pluck("AVG(value)", &populationValues).
-		Error
-	if err != nil {
-		return "", fmt.Errorf("failed to get population values: %v", err)
+// setStandings fills in the summary sentence of data and either the single
+// standing of a simple vital or the per-component standings of a composite
+// one, keyed by component name.
+func setStandings(data *models.PopulationInsightData, standings map[string]models.PopulationStanding) {
+	if standing, ok := standings[data.VitalID]; ok && len(standings) == 1 {
+		data.Insight = standing.Insight
+		data.Standing = &standing
+		return
+	}
+
+	keys := make([]string, 0, len(standings))
+	for key := range standings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	data.Components = make(map[string]models.PopulationStanding, len(standings))
+	sentences := make([]string, 0, len(standings))
+	for _, key := range keys {
+		data.Components[standings[key].Component] = standings[key]
+		sentences = append(sentences, standings[key].Insight)
+	}
+	data.Insight = strings.Join(sentences, " ")
+}
+
+// populationStanding ranks a user's mean among the means of the users in
+// cohortMeans. The user need not be part of that population.
+func populationStanding(series vitalSeries, userAggregatedValue float64, cohortMeans map[string]float64) models.PopulationStanding {
+	populationValues := make([]float64, 0, len(cohortMeans))
+	for _, value := range cohortMeans {
+		populationValues = append(populationValues, value)
 	}
 
 	sort.Float64s(populationValues)
 
-	var position int
-	for i, value := range populationValues {
-		if userAggregatedValue == value {
-			position = i + 1
-			break
+	standing := models.PopulationStanding{
+		Component:      series.Component,
+		LoincCode:      series.LOINC,
+		Unit:           series.Unit,
+		UCUMUnit:       UCUMCode(series.Unit),
+		UserValue:      userAggregatedValue,
+		PopulationSize: len(populationValues),
+	}
+	if len(populationValues) > 0 {
+		var sum float64
+		for _, value := range populationValues {
+			sum += value
 		}
+
+		standing.Percentile = midRankPercentile(populationValues, userAggregatedValue)
+		standing.PopulationMean = sum / float64(len(populationValues))
+		standing.PopulationMedian = floatPtr(percentile(populationValues, 50))
+	}
+	standing.Insight = standingInsight(series, standing)
+	return standing
+}
+
+func standingInsight(series vitalSeries, standing models.PopulationStanding) string {
+	if standing.PopulationSize == 0 {
+		return fmt.Sprintf("No one in the population has %s readings to compare against.", series.label())
+	}
+	return fmt.Sprintf("Your %s is in the %.2fth percentile.", series.label(), standing.Percentile)
+}
+
+// convertStanding reports the values of a standing in another unit. The
+// percentile does not depend on the unit.
+func convertStanding(standing models.PopulationStanding, from, to string) (models.PopulationStanding, error) {
+	scale, offset, err := unitConversion(from, to)
+	if err != nil {
+		return models.PopulationStanding{}, err
+	}
+
+	standing.Unit = to
+	standing.UCUMUnit = UCUMCode(to)
+	standing.UserValue = standing.UserValue*scale + offset
+	standing.PopulationMean = standing.PopulationMean*scale + offset
+	if standing.PopulationMedian != nil {
+		standing.PopulationMedian = floatPtr(*standing.PopulationMedian*scale + offset)
 	}
+	return standing, nil
+}
 
-	totalCount := len(populationValues)
+// populationMeans returns the mean value of a series for every user with readings in the time range,
+// in the series' canonical unit. scope narrows down the users considered.
+func populationMeans(db *gorm.DB, series vitalSeries, startTimestamp, endTimestamp time.Time, scope func(*gorm.DB) *gorm.DB) (map[string]float64, error) {
+	query := db.Table("vitals").
+		Select("vitals.username, vitals.unit, AVG(vitals.value), COUNT(*)").
+		Where("vitals.vital_id = ? AND COALESCE(vitals.component, '') = ? AND vitals.unit <> '' AND vitals.timestamp BETWEEN ? AND ? AND vitals.deleted_at IS NULL",
+			series.VitalID, series.Component, startTimestamp, endTimestamp)
+	rows, err := scope(query).
+		Group("vitals.username, vitals.unit").
+		Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get population values: %v", err)
+	}
+	defer rows.Close()
 
-	percentileRank := (float64(position) / float64(totalCount)) * 100
+	sums := make(map[string]float64)
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var username, unit string
+		var mean float64
+		var count int64
+		if err := rows.Scan(&username, &unit, &mean, &count); err != nil {
+			return nil, fmt.Errorf("failed to read population values: %v", err)
+		}
 
-	insight := fmt.Sprintf("Your %s is in the %.2fth percentile.", vitalID, percentileRank)
+		mean, err = ConvertValue(mean, unit, series.Unit)
+		if err != nil {
+			return nil, err
+		}
+		sums[username] += mean * float64(count)
+		counts[username] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read population values: %v", err)
+	}
 
-	return insight, nil
+	means := make(map[string]float64, len(sums))
+	for username, sum := range sums {
+		means[username] = sum / float64(counts[username])
+	}
+	return means, nil
 }
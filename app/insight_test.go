@@ -0,0 +1,77 @@
+package app
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMidRankPercentile(t *testing.T) {
+	population := []float64{60, 70, 70, 70, 90}
+
+	assert.InDelta(t, 50.0, midRankPercentile(population, 70), 1e-9, "Ties should share the middle rank")
+	assert.InDelta(t, 10.0, midRankPercentile(population, 60), 1e-9)
+	assert.InDelta(t, 90.0, midRankPercentile(population, 90), 1e-9)
+	assert.InDelta(t, 50.0, midRankPercentile(population, 70+1e-12), 1e-9, "Floating point noise should still count as a tie")
+	assert.InDelta(t, 80.0, midRankPercentile(population, 80), 1e-9, "Values not in the population should still be ranked")
+}
+
+func TestPopulationStanding(t *testing.T) {
+	series := vitalSeries{VitalID: "HeartRate", Unit: "bpm"}
+	userMeans := map[string]float64{"JohnDoe": 72, "JaneDoe": 64, "Alex": 80, "Sam": 72}
+
+	standing := populationStanding(series, userMeans["JohnDoe"], userMeans)
+	assert.Equal(t, 72.0, standing.UserValue)
+	assert.Equal(t, 4, standing.PopulationSize)
+	assert.InDelta(t, 50.0, standing.Percentile, 1e-9)
+	assert.InDelta(t, 72.0, standing.PopulationMean, 1e-9)
+	assert.InDelta(t, 72.0, *standing.PopulationMedian, 1e-9)
+	assert.Equal(t, "Your HeartRate is in the 50.00th percentile.", standing.Insight)
+
+	outsider := populationStanding(series, 90, map[string]float64{"JaneDoe": 64, "Alex": 80})
+	assert.Equal(t, 2, outsider.PopulationSize, "User outside the cohort should not be counted in it")
+	assert.InDelta(t, 100.0, outsider.Percentile, 1e-9)
+
+	empty := populationStanding(series, 72, map[string]float64{})
+	assert.Equal(t, 0, empty.PopulationSize)
+}
+
+func TestConvertStanding(t *testing.T) {
+	series := vitalSeries{VitalID: "Temperature", Unit: "°C"}
+	standing := populationStanding(series, 37, map[string]float64{"JohnDoe": 37, "JaneDoe": 36})
+
+	converted, err := convertStanding(standing, "°C", "°F")
+	assert.NoError(t, err)
+	assert.Equal(t, "°F", converted.Unit)
+	assert.InDelta(t, 98.6, converted.UserValue, 1e-9)
+	assert.Equal(t, standing.Percentile, converted.Percentile, "Percentile should not depend on the unit")
+}
+
+func TestRunBounded(t *testing.T) {
+	var running, peak int32
+	var calls [20]int32
+
+	runBounded(len(calls), 3, func(i int) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			observed := atomic.LoadInt32(&peak)
+			if current <= observed || atomic.CompareAndSwapInt32(&peak, observed, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&calls[i], 1)
+		atomic.AddInt32(&running, -1)
+	})
+
+	assert.LessOrEqual(t, peak, int32(3), "No more than the worker limit should run at once")
+	for i, count := range calls {
+		assert.Equal(t, int32(1), count, "Index %d should be processed exactly once", i)
+	}
+}
+
+func TestUniqueStrings(t *testing.T) {
+	assert.Equal(t, []string{"HeartRate", "Temperature"}, uniqueStrings([]string{"HeartRate", "", "Temperature", "HeartRate"}))
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// jwtIssuer identifies the tokens this service issues
+const jwtIssuer = "medical-vitals-management-system"
+
+// jwtLeeway tolerates clock skew when checking when a token was issued
+const jwtLeeway = time.Minute
+
+// jwtHeader is the encoded header of every token: HMAC-SHA256 is the only
+// algorithm issued or accepted.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// accessClaims are the claims of an access token
+type accessClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// signJWT encodes claims as a JWT signed with secret
+func signJWT(claims accessClaims, secret []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + jwtSignature(unsigned, secret), nil
+}
+
+// verifyJWT checks the signature, issuer and lifetime of a token signed by
+// signJWT and returns its claims.
+func verifyJWT(token string, secret []byte, now time.Time) (accessClaims, error) {
+	var claims accessClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, authErrorf("malformed access token")
+	}
+
+	signature := jwtSignature(parts[0]+"."+parts[1], secret)
+	if !hmac.Equal([]byte(signature), []byte(parts[2])) {
+		return claims, authErrorf("invalid access token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, authErrorf("malformed access token")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, authErrorf("malformed access token")
+	}
+
+	if claims.Issuer != jwtIssuer || claims.Subject == "" || claims.ID == "" {
+		return claims, authErrorf("access token was not issued by this service")
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, authErrorf("access token has expired")
+	}
+	if time.Unix(claims.IssuedAt, 0).After(now.Add(jwtLeeway)) {
+		return claims, authErrorf("access token is not valid yet")
+	}
+	return claims, nil
+}
+
+func jwtSignature(unsigned string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
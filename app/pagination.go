@@ -0,0 +1,105 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"medical-vitals-management-system/models"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// vitalCursor marks the last row of a page. The sort order is kept so a
+// cursor cannot be replayed against the opposite order.
+type vitalCursor struct {
+	Timestamp time.Time `json:"t"`
+	ID        uint      `json:"id"`
+	Sort      string    `json:"s"`
+}
+
+// vitalPagePlan is a validated VitalQuery
+type vitalPagePlan struct {
+	sort       string
+	descending bool
+	limit      int
+	after      *vitalCursor
+}
+
+func planVitalPage(query models.VitalQuery) (vitalPagePlan, error) {
+	plan := vitalPagePlan{sort: strings.ToLower(query.Sort), limit: query.Limit}
+
+	switch plan.sort {
+	case "", "asc":
+		plan.sort = "asc"
+	case "desc":
+		plan.descending = true
+	default:
+		return plan, validationErrorf("unsupported sort %q; use asc or desc", query.Sort)
+	}
+
+	if plan.limit == 0 {
+		plan.limit = defaultPageSize
+	}
+	if plan.limit < 0 || plan.limit > maxPageSize {
+		return plan, validationErrorf("limit must be between 1 and %d", maxPageSize)
+	}
+
+	if query.From != nil && query.To != nil && query.To.Before(*query.From) {
+		return plan, validationErrorf("from must not be after to")
+	}
+	if query.MinValue != nil && query.MaxValue != nil && *query.MaxValue < *query.MinValue {
+		return plan, validationErrorf("min_value must not be greater than max_value")
+	}
+
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return plan, err
+		}
+		if cursor.Sort != plan.sort {
+			return plan, validationErrorf("cursor was issued for %s order, not %s", cursor.Sort, plan.sort)
+		}
+		plan.after = &cursor
+	}
+	return plan, nil
+}
+
+func encodeCursor(cursor vitalCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (vitalCursor, error) {
+	var cursor vitalCursor
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(data, &cursor) != nil || cursor.ID == 0 {
+		return cursor, validationErrorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// trimPartialReading cuts rows, fetched one past limit, down to a page of at
+// most limit rows that does not end part-way through a composite reading.
+// Rows of one reading are adjacent, as they share a timestamp and are
+// inserted together. The page is empty if the first reading alone exceeds
+// the limit.
+func trimPartialReading(rows []models.Vital, limit int) ([]models.Vital, bool) {
+	if len(rows) <= limit {
+		return rows, false
+	}
+
+	next := rows[limit]
+	end := limit
+	for end > 0 && sameReading(rows[end-1], next) {
+		end--
+	}
+	return rows[:end], true
+}
+
+func sameReading(a, b models.Vital) bool {
+	return a.Username == b.Username && a.VitalID == b.VitalID && a.Timestamp.Equal(b.Timestamp)
+}
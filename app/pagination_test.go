@@ -0,0 +1,76 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanVitalPage(t *testing.T) {
+	plan, err := planVitalPage(models.VitalQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, "asc", plan.sort)
+	assert.Equal(t, defaultPageSize, plan.limit)
+
+	plan, err = planVitalPage(models.VitalQuery{Sort: "DESC", Limit: 10})
+	assert.NoError(t, err)
+	assert.True(t, plan.descending)
+	assert.Equal(t, 10, plan.limit)
+
+	_, err = planVitalPage(models.VitalQuery{Sort: "newest"})
+	assert.True(t, IsValidationError(err))
+
+	_, err = planVitalPage(models.VitalQuery{Limit: maxPageSize + 1})
+	assert.True(t, IsValidationError(err))
+
+	low, high := 100.0, 50.0
+	_, err = planVitalPage(models.VitalQuery{MinValue: &low, MaxValue: &high})
+	assert.True(t, IsValidationError(err))
+
+	_, err = planVitalPage(models.VitalQuery{Cursor: "not a cursor"})
+	assert.True(t, IsValidationError(err))
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursor := vitalCursor{Timestamp: time.Date(2023, 1, 1, 8, 0, 0, 500, time.UTC), ID: 42, Sort: "desc"}
+
+	plan, err := planVitalPage(models.VitalQuery{Sort: "desc", Cursor: encodeCursor(cursor)})
+	assert.NoError(t, err)
+	assert.Equal(t, uint(42), plan.after.ID)
+	assert.True(t, cursor.Timestamp.Equal(plan.after.Timestamp), "The cursor should keep nanosecond precision")
+
+	_, err = planVitalPage(models.VitalQuery{Sort: "asc", Cursor: encodeCursor(cursor)})
+	assert.True(t, IsValidationError(err), "A cursor should only continue the order it was issued for")
+}
+
+func TestTrimPartialReading(t *testing.T) {
+	at := func(minute int) time.Time { return time.Date(2023, 1, 1, 8, minute, 0, 0, time.UTC) }
+	row := func(id uint, vitalID, component string, minute int) models.Vital {
+		return models.Vital{Model: gorm.Model{ID: id}, Username: "JohnDoe", VitalID: vitalID, Component: component, Timestamp: at(minute)}
+	}
+	rows := []models.Vital{
+		row(1, "HeartRate", "", 0),
+		row(2, "BloodPressure", "systolic", 1),
+		row(3, "BloodPressure", "diastolic", 1),
+		row(4, "HeartRate", "", 2),
+	}
+
+	page, hasMore := trimPartialReading(rows, 4)
+	assert.Len(t, page, 4)
+	assert.False(t, hasMore)
+
+	page, hasMore = trimPartialReading(rows, 3)
+	assert.Len(t, page, 3)
+	assert.True(t, hasMore)
+
+	page, hasMore = trimPartialReading(rows[:3], 2)
+	assert.Len(t, page, 1, "A page should not end between the components of a reading")
+	assert.True(t, hasMore)
+
+	page, hasMore = trimPartialReading(rows[1:3], 1)
+	assert.Empty(t, page, "A reading larger than the limit is left for the caller to fetch whole")
+	assert.True(t, hasMore)
+}
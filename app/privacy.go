@@ -0,0 +1,258 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"medical-vitals-management-system/models"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultMinCohortSize is the smallest population a population insight is
+// reported against when POPULATION_MIN_COHORT_SIZE is not set.
+const defaultMinCohortSize = 5
+
+// privacyBudgetWindow is the period over which a user's differential privacy
+// budget is spent.
+const privacyBudgetWindow = 24 * time.Hour
+
+// releasedStatistics is the number of noisy values a population standing
+// discloses (percentile, population mean, population size, cohort size),
+// which split the epsilon of each disclosure evenly.
+const releasedStatistics = 4
+
+// medianCohortMultiple is how many times the minimum cohort size a
+// population must be for its exact median to be reported.
+const medianCohortMultiple = 4
+
+// privacyLockClass is the first key of the PostgreSQL advisory locks that
+// serialize spending of each user's privacy budget, the second being a hash
+// of the username.
+const privacyLockClass = 72617369
+
+// PrivacySettings controls what population insights may disclose about
+// other patients.
+type PrivacySettings struct {
+	// MinCohortSize is the smallest number of users with readings a
+	// population may have for a standing to be reported against it.
+	MinCohortSize int
+	// Epsilon is the differential privacy budget spent on each standing.
+	// Zero disables noise.
+	Epsilon float64
+	// Budget caps the epsilon one user may spend per day. Zero means no cap.
+	Budget float64
+}
+
+// PrivacySettingsFromEnv reads the privacy settings from
+// POPULATION_MIN_COHORT_SIZE, POPULATION_DP_EPSILON and POPULATION_DP_BUDGET.
+func PrivacySettingsFromEnv() PrivacySettings {
+	settings := PrivacySettings{MinCohortSize: defaultMinCohortSize}
+	if size, err := strconv.Atoi(os.Getenv("POPULATION_MIN_COHORT_SIZE")); err == nil {
+		settings.MinCohortSize = size
+	}
+	if settings.MinCohortSize < 1 {
+		settings.MinCohortSize = 1
+	}
+	if epsilon, err := strconv.ParseFloat(os.Getenv("POPULATION_DP_EPSILON"), 64); err == nil && epsilon > 0 {
+		settings.Epsilon = epsilon
+	}
+	if budget, err := strconv.ParseFloat(os.Getenv("POPULATION_DP_BUDGET"), 64); err == nil && budget > 0 {
+		settings.Budget = budget
+	}
+	return settings
+}
+
+func (s PrivacySettings) mechanism() string {
+	if s.Epsilon > 0 {
+		return "laplace"
+	}
+	return "none"
+}
+
+// spentBudget returns the epsilon username has spent in the current window
+func spentBudget(db *gorm.DB, username string) (float64, error) {
+	var spent float64
+	err := db.Model(&models.PrivacyDisclosure{}).
+		Select("COALESCE(SUM(epsilon), 0)").
+		Where("username = ? AND created_at > ?", username, time.Now().Add(-privacyBudgetWindow)).
+		Row().Scan(&spent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get privacy budget: %v", err)
+	}
+	return spent, nil
+}
+
+// checkBudget refuses a request that would spend more than the remaining
+// budget of username.
+func checkBudget(db *gorm.DB, settings PrivacySettings, username string, disclosures int) error {
+	if settings.Epsilon == 0 || settings.Budget == 0 {
+		return nil
+	}
+
+	spent, err := spentBudget(db, username)
+	if err != nil {
+		return err
+	}
+	if spent+settings.Epsilon*float64(disclosures) > settings.Budget {
+		return privacyErrorf("privacy budget exhausted for %s; try again later", username)
+	}
+	return nil
+}
+
+// checkCohortSize refuses to report against a population too small to hide
+// any one of its members.
+func checkCohortSize(settings PrivacySettings, series vitalSeries, cohort models.CohortDefinition, populationSize int) error {
+	if populationSize < settings.MinCohortSize || cohort.Size < settings.MinCohortSize {
+		return privacyErrorf("the population for %s is too small to report on without identifying its members", series.label())
+	}
+	return nil
+}
+
+// privatizeStanding adds Laplace noise to the population statistics of a
+// standing, in the series' canonical unit. The median is withheld, as its
+// sensitivity does not shrink with the size of the population. Without
+// noise, the median is the exact value of one member, or the midpoint of
+// two, so it is only reported for populations of at least
+// medianCohortMultiple times the minimum cohort size.
+func privatizeStanding(settings PrivacySettings, series vitalSeries, standing models.PopulationStanding) models.PopulationStanding {
+	if settings.Epsilon == 0 {
+		if standing.PopulationSize < settings.MinCohortSize*medianCohortMultiple {
+			standing.PopulationMedian = nil
+		}
+		return standing
+	}
+
+	epsilon := settings.Epsilon / releasedStatistics
+	size := float64(standing.PopulationSize)
+	valueRange := series.MaxValue - series.MinValue
+
+	standing.Percentile = clamp(standing.Percentile+laplaceNoise(100/size/epsilon), 0, 100)
+	standing.PopulationMean = clamp(standing.PopulationMean+laplaceNoise(valueRange/size/epsilon), series.MinValue, series.MaxValue)
+	standing.PopulationMedian = nil
+	standing.Insight = standingInsight(series, standing)
+	standing.PopulationSize = int(math.Max(0, math.Round(size+laplaceNoise(1/epsilon))))
+	return standing
+}
+
+// privatizeCohortSize adds Laplace noise to the reported size of a cohort
+func privatizeCohortSize(settings PrivacySettings, cohort models.CohortDefinition) models.CohortDefinition {
+	if settings.Epsilon == 0 {
+		return cohort
+	}
+	epsilon := settings.Epsilon / releasedStatistics
+	cohort.Size = int(math.Max(0, math.Round(float64(cohort.Size)+laplaceNoise(1/epsilon))))
+	return cohort
+}
+
+// reserveDisclosures records the disclosure of a standing of each of series
+// to username before any is computed, refusing them if they would spend more
+// than the remaining budget. The check and the records are made under a lock
+// on the user's budget, so concurrent requests cannot both spend the last of
+// it.
+func reserveDisclosures(db *gorm.DB, settings PrivacySettings, username string, series []vitalSeries, cohort models.CohortDefinition) ([]models.PrivacyDisclosure, error) {
+	tx := db.Begin()
+	if db.Dialect().GetName() == "postgres" {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", privacyLockClass, username).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to lock privacy budget: %v", err)
+		}
+	}
+	if err := checkBudget(tx, settings, username, len(series)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	disclosures := make([]models.PrivacyDisclosure, len(series))
+	for i, s := range series {
+		disclosures[i] = models.PrivacyDisclosure{
+			Username:  username,
+			VitalID:   s.VitalID,
+			Component: s.Component,
+			Cohort:    cohort.Description,
+			Mechanism: settings.mechanism(),
+			Epsilon:   settings.Epsilon,
+		}
+		if err := tx.Create(&disclosures[i]).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to record disclosure: %v", err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to record disclosure: %v", err)
+	}
+	return disclosures, nil
+}
+
+// releaseDisclosures gives back the budget of reserved disclosures that were
+// not made after all.
+func releaseDisclosures(db *gorm.DB, disclosures []models.PrivacyDisclosure) {
+	ids := make([]uint, len(disclosures))
+	for i, disclosure := range disclosures {
+		ids[i] = disclosure.ID
+	}
+	if err := db.Unscoped().Where("id IN (?)", ids).Delete(&models.PrivacyDisclosure{}).Error; err != nil {
+		logrus.Errorf("Failed to release privacy disclosures %v: %v", ids, err)
+	}
+}
+
+// confirmDisclosure completes a reserved disclosure with the true size of
+// the population the standing was computed against. The size reported to
+// the user is noisy, but the record is for auditing what was disclosed.
+func confirmDisclosure(db *gorm.DB, disclosure models.PrivacyDisclosure, populationSize int) error {
+	if err := db.Model(&disclosure).Update("population_size", populationSize).Error; err != nil {
+		return fmt.Errorf("failed to record disclosure: %v", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"username":        disclosure.Username,
+		"vital":           seriesKey(disclosure.VitalID, disclosure.Component),
+		"cohort":          disclosure.Cohort,
+		"population_size": populationSize,
+		"mechanism":       disclosure.Mechanism,
+		"epsilon":         disclosure.Epsilon,
+	}).Info("Population insight disclosed")
+	return nil
+}
+
+// privacyReport summarizes the privacy cost of a response for username
+func privacyReport(db *gorm.DB, settings PrivacySettings, username string, disclosures int) (models.PrivacyReport, error) {
+	report := models.PrivacyReport{
+		Mechanism:     settings.mechanism(),
+		MinCohortSize: settings.MinCohortSize,
+		EpsilonSpent:  settings.Epsilon * float64(disclosures),
+	}
+	if settings.Epsilon > 0 && settings.Budget > 0 {
+		spent, err := spentBudget(db, username)
+		if err != nil {
+			return models.PrivacyReport{}, err
+		}
+		remaining := math.Max(0, settings.Budget-spent)
+		report.BudgetRemaining = &remaining
+	}
+	return report, nil
+}
+
+// laplaceNoise draws from a Laplace distribution centred on zero, using a
+// cryptographic source so the noise cannot be predicted and subtracted.
+func laplaceNoise(scale float64) float64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	// Uniform in (-0.5, 0.5), excluding the endpoints so the logarithm is finite.
+	u := (float64(binary.BigEndian.Uint64(buf[:])>>11)+0.5)/(1<<53) - 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+func clamp(value, min, max float64) float64 {
+	return math.Max(min, math.Min(max, value))
+}
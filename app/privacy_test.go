@@ -0,0 +1,81 @@
+package app
+
+import (
+	"math"
+	"medical-vitals-management-system/models"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivacySettingsFromEnv(t *testing.T) {
+	t.Setenv("POPULATION_MIN_COHORT_SIZE", "")
+	t.Setenv("POPULATION_DP_EPSILON", "")
+	t.Setenv("POPULATION_DP_BUDGET", "")
+	settings := PrivacySettingsFromEnv()
+	assert.Equal(t, defaultMinCohortSize, settings.MinCohortSize)
+	assert.Equal(t, "none", settings.mechanism())
+
+	t.Setenv("POPULATION_MIN_COHORT_SIZE", "0")
+	t.Setenv("POPULATION_DP_EPSILON", "0.5")
+	settings = PrivacySettingsFromEnv()
+	assert.Equal(t, 1, settings.MinCohortSize, "A cohort size below one would allow empty populations")
+	assert.Equal(t, "laplace", settings.mechanism())
+}
+
+func TestCheckCohortSize(t *testing.T) {
+	settings := PrivacySettings{MinCohortSize: 5}
+	series := vitalSeries{VitalID: "HeartRate", Unit: "bpm"}
+
+	err := checkCohortSize(settings, series, models.CohortDefinition{Size: 10}, 4)
+	assert.True(t, IsPrivacyError(err))
+	assert.NotContains(t, err.Error(), "4", "The refusal should not reveal the population size")
+
+	err = checkCohortSize(settings, series, models.CohortDefinition{Size: 4}, 5)
+	assert.True(t, IsPrivacyError(err), "A small cohort should be refused even if enough members have readings")
+
+	assert.NoError(t, checkCohortSize(settings, series, models.CohortDefinition{Size: 5}, 5))
+}
+
+func TestPrivatizeStanding(t *testing.T) {
+	series := vitalSeries{VitalID: "HeartRate", Unit: "bpm", MinValue: 20, MaxValue: 300}
+	population := map[string]float64{"a": 60, "b": 64, "c": 72, "d": 80, "e": 90}
+	standing := populationStanding(series, 72, population)
+
+	assert.Equal(t, standing, privatizeStanding(PrivacySettings{}, series, standing), "Noise should be off without an epsilon")
+
+	exact := privatizeStanding(PrivacySettings{MinCohortSize: 5}, series, standing)
+	assert.Nil(t, exact.PopulationMedian, "The exact median of a small population should be withheld")
+	assert.Equal(t, standing.PopulationMean, exact.PopulationMean)
+
+	large := make(map[string]float64)
+	for i := 0; i < 20; i++ {
+		large[strconv.Itoa(i)] = float64(60 + i)
+	}
+	exact = privatizeStanding(PrivacySettings{MinCohortSize: 5}, series, populationStanding(series, 72, large))
+	assert.NotNil(t, exact.PopulationMedian, "The exact median of a large population should be reported")
+
+	for i := 0; i < 100; i++ {
+		noisy := privatizeStanding(PrivacySettings{Epsilon: 0.01}, series, standing)
+		assert.Nil(t, noisy.PopulationMedian, "The median should be withheld")
+		assert.Equal(t, 72.0, noisy.UserValue, "The user's own value needs no noise")
+		assert.True(t, noisy.Percentile >= 0 && noisy.Percentile <= 100)
+		assert.True(t, noisy.PopulationMean >= series.MinValue && noisy.PopulationMean <= series.MaxValue)
+		assert.True(t, noisy.PopulationSize >= 0)
+		assert.Contains(t, noisy.Insight, "percentile")
+	}
+}
+
+func TestLaplaceNoise(t *testing.T) {
+	const samples = 20000
+	var sum, absSum float64
+	for i := 0; i < samples; i++ {
+		noise := laplaceNoise(2)
+		assert.False(t, math.IsInf(noise, 0) || math.IsNaN(noise))
+		sum += noise
+		absSum += math.Abs(noise)
+	}
+	assert.InDelta(t, 0, sum/samples, 0.1, "Noise should be centred on zero")
+	assert.InDelta(t, 2, absSum/samples, 0.1, "Mean absolute noise should equal the scale")
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"fmt"
+	"medical-vitals-management-system/models"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// HasPermission reports whether the role of principal grants permission
+func HasPermission(principal models.Principal, permission string) bool {
+	for _, granted := range principal.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks that the role of principal grants permission
+func Authorize(principal models.Principal, permission string) error {
+	if !HasPermission(principal, permission) {
+		return forbiddenErrorf("the %s role does not grant %s", principal.Role, permission)
+	}
+	return nil
+}
+
+// AuthorizePatient resolves whose records a request by principal concerns:
+// username, or the principal if the request names nobody. The principal
+// needs permission and, for anyone else's records, either access to all
+// patients or to the patients assigned to them, of whom the user is one.
+// Devices only reach the patients they were registered for.
+func AuthorizePatient(db *gorm.DB, principal models.Principal, permission, username string) (string, error) {
+	if username == "" {
+		username = principal.Username
+	}
+	if err := Authorize(principal, permission); err != nil {
+		return username, err
+	}
+	if principal.DeviceID != 0 {
+		if !containsString(principal.DevicePatients, username) {
+			return username, forbiddenErrorf("device %d may not record vitals of %s", principal.DeviceID, username)
+		}
+		return username, nil
+	}
+	if username == principal.Username || HasPermission(principal, models.PermAccessAll) {
+		return username, nil
+	}
+	if HasPermission(principal, models.PermAccessAssigned) {
+		assigned, err := isAssigned(db, principal.Username, username)
+		if err != nil {
+			return username, err
+		}
+		if assigned {
+			return username, nil
+		}
+	}
+	return username, forbiddenErrorf("%s may not access the records of %s", principal.Username, username)
+}
+
+// AccessiblePatients lists the users whose records principal may access:
+// the principal and the patients assigned to them, or nil if the principal
+// may access everyone's.
+func AccessiblePatients(db *gorm.DB, principal models.Principal) ([]string, error) {
+	if HasPermission(principal, models.PermAccessAll) {
+		return nil, nil
+	}
+	patients := []string{principal.Username}
+	if HasPermission(principal, models.PermAccessAssigned) {
+		assigned, err := AssignedPatients(db, principal.Username)
+		if err != nil {
+			return nil, err
+		}
+		patients = uniqueStrings(append(patients, assigned...))
+	}
+	return patients, nil
+}
+
+// isAssigned reports whether patient is in the care of clinician now
+func isAssigned(db *gorm.DB, clinician, patient string) (bool, error) {
+	var count int64
+	query := db.Model(&models.ClinicianAssignment{}).Where("clinician = ? AND patient = ?", clinician, patient)
+	err := activeAt(query, time.Now()).Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check clinician assignment: %v", err)
+	}
+	return count > 0, nil
+}
+
+// rolePermissions lists the permissions granted by the role named role
+func rolePermissions(db *gorm.DB, role string) ([]string, error) {
+	var stored models.Role
+	err := db.Preload("Permissions").Where("name = ?", role).First(&stored).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get permissions of role %s: %v", role, err)
+	}
+
+	permissions := make([]string, 0, len(stored.Permissions))
+	for _, permission := range stored.Permissions {
+		permissions = append(permissions, permission.Name)
+	}
+	return permissions, nil
+}
+
+// GetRoles lists the roles with their permissions
+func GetRoles(db *gorm.DB) ([]models.Role, error) {
+	var roles []models.Role
+	if err := db.Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+		return nil, fmt.Errorf("failed to get roles: %v", err)
+	}
+	return roles, nil
+}
+
+// SetUserRole gives username the role named role
+func SetUserRole(db *gorm.DB, username, role string) error {
+	var count int64
+	if err := db.Model(&models.Role{}).Where("name = ?", role).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check role: %v", err)
+	}
+	if count == 0 {
+		return validationErrorf("unknown role %q", role)
+	}
+
+	result := db.Model(&models.User{}).Where("username = ?", username).Update("role", role)
+	if result.Error != nil {
+		return fmt.Errorf("failed to set role: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return notFoundErrorf("user %s not found", username)
+	}
+	return nil
+}
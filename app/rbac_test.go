@@ -0,0 +1,39 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizePatient(t *testing.T) {
+	patient := models.Principal{Username: "JohnDoe", Role: models.RolePatient, Permissions: []string{models.PermReadVitals}}
+	admin := models.Principal{Username: "root", Role: models.RoleAdmin, Permissions: []string{models.PermReadUsers, models.PermAccessAll}}
+
+	username, err := AuthorizePatient(nil, patient, models.PermReadVitals, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "JohnDoe", username, "Requests naming nobody should concern the caller")
+
+	_, err = AuthorizePatient(nil, patient, models.PermReadVitals, "JohnDoe")
+	assert.NoError(t, err)
+
+	_, err = AuthorizePatient(nil, patient, models.PermReadVitals, "JaneDoe")
+	assert.True(t, IsForbiddenError(err), "Patients should not reach the records of other patients")
+
+	_, err = AuthorizePatient(nil, patient, models.PermWriteVitals, "JohnDoe")
+	assert.True(t, IsForbiddenError(err), "Permissions the role lacks should be refused even for the caller's own records")
+
+	_, err = AuthorizePatient(nil, admin, models.PermReadUsers, "JaneDoe")
+	assert.NoError(t, err)
+
+	_, err = AuthorizePatient(nil, admin, models.PermReadVitals, "JaneDoe")
+	assert.True(t, IsForbiddenError(err), "Access to every patient should not grant permissions the role lacks")
+}
+
+func TestAuthorize(t *testing.T) {
+	admin := models.Principal{Username: "root", Role: models.RoleAdmin, Permissions: []string{models.PermReadAudit}}
+	assert.NoError(t, Authorize(admin, models.PermReadAudit))
+	assert.True(t, IsForbiddenError(Authorize(admin, models.PermManageVitalTypes)))
+	assert.True(t, IsForbiddenError(Authorize(models.Principal{}, models.PermReadAudit)))
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"fmt"
+	"medical-vitals-management-system/models"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Revision actions
+const (
+	revisionUpdate = "update"
+	revisionDelete = "delete"
+)
+
+func validateChange(change models.VitalChange) error {
+	if change.Actor == "" {
+		return validationErrorf("actor is required to change a vital")
+	}
+	return nil
+}
+
+// recordRevision stores the revision of row that replaces its value with
+// newValue in newUnit, or deletes it if newValue is nil.
+func recordRevision(tx *gorm.DB, row models.Vital, newValue *float64, newUnit string, change models.VitalChange, at time.Time) error {
+	oldValue := row.Value
+	revision := models.VitalRevision{
+		VitalRowID: row.ID,
+		Username:   row.Username,
+		VitalID:    row.VitalID,
+		Component:  row.Component,
+		Timestamp:  row.Timestamp,
+		Action:     revisionUpdate,
+		OldValue:   &oldValue,
+		OldUnit:    row.Unit,
+		NewValue:   newValue,
+		NewUnit:    newUnit,
+		Actor:      change.Actor,
+		Reason:     change.Reason,
+		RevisedAt:  at,
+	}
+	if newValue == nil {
+		revision.Action = revisionDelete
+	}
+
+	if err := tx.Create(&revision).Error; err != nil {
+		return fmt.Errorf("failed to record vital revision: %v", err)
+	}
+	return nil
+}
+
+// GetVitalHistory lists the revisions of a reading, identified by its
+// username, vital ID or LOINC code and timestamp, oldest first. Every
+// component of a composite reading is included.
+func GetVitalHistory(db *gorm.DB, username, vitalID string, timestamp time.Time) ([]models.VitalRevision, error) {
+	vitalIDs, err := canonicalVitalIDs(db, []string{vitalID})
+	if err != nil {
+		return nil, err
+	}
+	vitalID = vitalIDs[0]
+
+	var count int64
+	err = db.Unscoped().Model(&models.Vital{}).
+		Where("username = ? AND vital_id = ? AND timestamp = ?", username, vitalID, timestamp).
+		Count(&count).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to check vital existence: %v", err)
+	}
+	if count == 0 {
+		return nil, notFoundErrorf("no %s reading at %s for %s", vitalID, timestamp.Format(time.RFC3339Nano), username)
+	}
+
+	revisions := []models.VitalRevision{}
+	err = db.Where("username = ? AND vital_id = ? AND timestamp = ?", username, vitalID, timestamp).
+		Order("revised_at, id").
+		Find(&revisions).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vital history: %v", err)
+	}
+	return revisions, nil
+}
+
+// GetVitalsAsOf returns a user's vitals as they were stored at query.AsOf,
+// ordered by timestamp and ID: rows inserted by then, with the value they
+// had before any later revision, and without rows deleted by then.
+func GetVitalsAsOf(db *gorm.DB, query models.VitalAsOfQuery) ([]models.Vital, error) {
+	if query.AsOf.IsZero() {
+		return nil, validationErrorf("as_of is required")
+	}
+
+	scope := db.Unscoped().Where("username = ? AND created_at <= ?", query.Username, query.AsOf)
+	if len(query.VitalIDs) > 0 {
+		vitalIDs, err := canonicalVitalIDs(db, query.VitalIDs)
+		if err != nil {
+			return nil, err
+		}
+		scope = scope.Where("vital_id IN (?)", vitalIDs)
+	}
+	if query.From != nil {
+		scope = scope.Where("timestamp >= ?", *query.From)
+	}
+	if query.To != nil {
+		scope = scope.Where("timestamp <= ?", *query.To)
+	}
+
+	var rows []models.Vital
+	if err := scope.Order("timestamp, id").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to get vitals: %v", err)
+	}
+
+	var revisions []models.VitalRevision
+	err := db.Where("username = ? AND revised_at > ?", query.Username, query.AsOf).
+		Order("revised_at, id").
+		Find(&revisions).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vital revisions: %v", err)
+	}
+	return vitalsAsOf(rows, revisions, query.AsOf), nil
+}
+
+// vitalsAsOf rewinds rows to their state at asOf, given the revisions made
+// after it in the order they were made.
+func vitalsAsOf(rows []models.Vital, revisions []models.VitalRevision, asOf time.Time) []models.Vital {
+	firstRevision := make(map[uint]models.VitalRevision)
+	for _, revision := range revisions {
+		if _, ok := firstRevision[revision.VitalRowID]; !ok {
+			firstRevision[revision.VitalRowID] = revision
+		}
+	}
+
+	vitals := make([]models.Vital, 0, len(rows))
+	for _, row := range rows {
+		if revision, ok := firstRevision[row.ID]; ok && revision.OldValue != nil {
+			row.Value = *revision.OldValue
+			row.Unit = revision.OldUnit
+			row.DeletedAt = nil
+		} else if row.DeletedAt != nil && !row.DeletedAt.After(asOf) {
+			continue
+		}
+		vitals = append(vitals, row)
+	}
+	return vitals
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVitalsAsOf(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2023, 1, 1, hour, 0, 0, 0, time.UTC) }
+	deletedAt := at(12)
+	rows := []models.Vital{
+		{Model: gorm.Model{ID: 1}, Username: "JohnDoe", VitalID: "HeartRate", Value: 80, Unit: "bpm"},
+		{Model: gorm.Model{ID: 2}, Username: "JohnDoe", VitalID: "HeartRate", Value: 70, Unit: "bpm"},
+		{Model: gorm.Model{ID: 3, DeletedAt: &deletedAt}, Username: "JohnDoe", VitalID: "HeartRate", Value: 90, Unit: "bpm"},
+	}
+	revisions := []models.VitalRevision{
+		{VitalRowID: 1, Action: revisionUpdate, OldValue: floatPtr(75), OldUnit: "bpm", NewValue: floatPtr(78), RevisedAt: at(11)},
+		{VitalRowID: 1, Action: revisionUpdate, OldValue: floatPtr(78), OldUnit: "bpm", NewValue: floatPtr(80), RevisedAt: at(13)},
+	}
+
+	vitals := vitalsAsOf(rows, revisions, at(10))
+	assert.Len(t, vitals, 3, "Rows deleted after the time should be included")
+	assert.Equal(t, 75.0, vitals[0].Value, "Revised rows should show their value before the first later revision")
+	assert.Equal(t, 70.0, vitals[1].Value, "Unrevised rows should show their current value")
+
+	vitals = vitalsAsOf(rows, revisions[1:], at(12))
+	assert.Len(t, vitals, 2, "Rows deleted by the time should be left out")
+	assert.Equal(t, 78.0, vitals[0].Value)
+}
+
+func TestValidateChange(t *testing.T) {
+	assert.NoError(t, validateChange(models.VitalChange{Actor: "dr.smith", Reason: "transcription error"}))
+	err := validateChange(models.VitalChange{Reason: "transcription error"})
+	assert.True(t, IsValidationError(err), "A change without an actor should be rejected")
+}
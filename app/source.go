@@ -0,0 +1,74 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"strings"
+)
+
+// sourceTypes are the kinds of source a reading may come from
+var sourceTypes = map[string]bool{
+	models.SourceManual:          true,
+	models.SourceSmartwatch:      true,
+	models.SourceHospitalMonitor: true,
+	models.SourceImport:          true,
+}
+
+// deviceSourceTypes are the source types a registered device may have
+var deviceSourceTypes = map[string]bool{
+	models.SourceSmartwatch:      true,
+	models.SourceHospitalMonitor: true,
+}
+
+// normalizeSource validates the provenance of a reading, defaulting its type
+// to manual entry.
+func normalizeSource(source models.VitalSource) (models.VitalSource, error) {
+	source.Type = strings.ToLower(strings.TrimSpace(source.Type))
+	if source.Type == "" {
+		source.Type = models.SourceManual
+	}
+	if !sourceTypes[source.Type] {
+		return source, validationErrorf("unknown source type %q", source.Type)
+	}
+	source.Firmware = strings.TrimSpace(source.Firmware)
+	source.Method = strings.TrimSpace(source.Method)
+	source.BodySite = strings.TrimSpace(source.BodySite)
+	return source, nil
+}
+
+// validateSourceFilter checks that filter only names known source types
+func validateSourceFilter(filter models.SourceFilter) error {
+	for _, source := range append(append([]string(nil), filter.Sources...), filter.ExcludeSources...) {
+		if !sourceTypes[source] {
+			return validationErrorf("unknown source type %q", source)
+		}
+	}
+	return nil
+}
+
+// sourceCondition builds the WHERE condition selecting the vitals matching
+// filter, or an empty condition if the filter is empty.
+func sourceCondition(filter models.SourceFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if len(filter.Sources) > 0 {
+		conditions = append(conditions, "source_type IN (?)")
+		args = append(args, filter.Sources)
+	}
+	if len(filter.ExcludeSources) > 0 {
+		conditions = append(conditions, "source_type NOT IN (?)")
+		args = append(args, filter.ExcludeSources)
+	}
+	if len(filter.DeviceIDs) > 0 {
+		conditions = append(conditions, "device_id IN (?)")
+		args = append(args, filter.DeviceIDs)
+	}
+	if len(filter.Methods) > 0 {
+		conditions = append(conditions, "method IN (?)")
+		args = append(args, filter.Methods)
+	}
+	if len(filter.BodySites) > 0 {
+		conditions = append(conditions, "body_site IN (?)")
+		args = append(args, filter.BodySites)
+	}
+	return strings.Join(conditions, " AND "), args
+}
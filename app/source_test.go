@@ -0,0 +1,34 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeSource(t *testing.T) {
+	source, err := normalizeSource(models.VitalSource{Method: " oscillometric "})
+	assert.NoError(t, err)
+	assert.Equal(t, models.VitalSource{Type: models.SourceManual, Method: "oscillometric"}, source, "Readings should default to manual entry")
+
+	source, err = normalizeSource(models.VitalSource{Type: "Smartwatch"})
+	assert.NoError(t, err)
+	assert.Equal(t, models.SourceSmartwatch, source.Type)
+
+	_, err = normalizeSource(models.VitalSource{Type: "guess"})
+	assert.True(t, IsValidationError(err))
+}
+
+func TestSourceCondition(t *testing.T) {
+	condition, args := sourceCondition(models.SourceFilter{})
+	assert.Empty(t, condition)
+	assert.Empty(t, args)
+
+	condition, args = sourceCondition(models.SourceFilter{ExcludeSources: []string{models.SourceManual}, DeviceIDs: []uint{3}})
+	assert.Equal(t, "source_type NOT IN (?) AND device_id IN (?)", condition)
+	assert.Equal(t, []interface{}{[]string{models.SourceManual}, []uint{3}}, args)
+
+	assert.NoError(t, validateSourceFilter(models.SourceFilter{Sources: []string{models.SourceHospitalMonitor}}))
+	assert.True(t, IsValidationError(validateSourceFilter(models.SourceFilter{ExcludeSources: []string{"guess"}})))
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"math"
+	"medical-vitals-management-system/models"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Statistics that can be requested in models.AggregateRequest. Percentiles
+// are requested as "p" followed by the percentile, e.g. "p5" or "p99.9".
+const (
+	StatCount  = "count"
+	StatMean   = "mean"
+	StatMin    = "min"
+	StatMax    = "max"
+	StatMedian = "median"
+	StatStdDev = "stddev"
+	StatFirst  = "first"
+	StatLast   = "last"
+)
+
+// defaultStatistics are computed when a request does not name any
+var defaultStatistics = []string{StatMean}
+
+// statisticSet is the parsed form of the statistics a caller asked for
+type statisticSet struct {
+	names       map[string]bool
+	percentiles map[string]float64
+}
+
+func (s statisticSet) has(name string) bool {
+	return s.names[name]
+}
+
+// needsValues reports whether the set includes statistics that need every
+// value rather than running totals.
+func (s statisticSet) needsValues() bool {
+	return s.has(StatMedian) || len(s.percentiles) > 0
+}
+
+// orderedPercentiles lists the requested order statistics, the median first,
+// with the fraction each corresponds to.
+func (s statisticSet) orderedPercentiles() ([]string, []float64) {
+	var names []string
+	var fractions []float64
+	if s.has(StatMedian) {
+		names = append(names, StatMedian)
+		fractions = append(fractions, 0.5)
+	}
+
+	percentileNames := make([]string, 0, len(s.percentiles))
+	for name := range s.percentiles {
+		percentileNames = append(percentileNames, name)
+	}
+	sort.Strings(percentileNames)
+	for _, name := range percentileNames {
+		names = append(names, name)
+		fractions = append(fractions, s.percentiles[name]/100)
+	}
+	return names, fractions
+}
+
+// parseStatistics validates the statistic names of a request
+func parseStatistics(names []string) (statisticSet, error) {
+	if len(names) == 0 {
+		names = defaultStatistics
+	}
+
+	set := statisticSet{names: make(map[string]bool), percentiles: make(map[string]float64)}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case StatCount, StatMean, StatMin, StatMax, StatMedian, StatStdDev, StatFirst, StatLast:
+			set.names[name] = true
+		default:
+			if !strings.HasPrefix(name, "p") {
+				return statisticSet{}, validationErrorf("unknown statistic: %s", name)
+			}
+			percentile, err := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+			if err != nil || percentile < 0 || percentile > 100 {
+				return statisticSet{}, validationErrorf("invalid percentile: %s", name)
+			}
+			set.percentiles[name] = percentile
+		}
+	}
+	return set, nil
+}
+
+// computeStatistics summarizes values, which must be in time order, into the
+// requested statistics. It returns false if there are no values.
+func computeStatistics(values []float64, set statisticSet, unit string) (models.VitalStatistics, bool) {
+	if len(values) == 0 {
+		return models.VitalStatistics{}, false
+	}
+
+	stats := models.VitalStatistics{Unit: unit, Count: len(values)}
+
+	var sum float64
+	min, max := values[0], values[0]
+	for _, value := range values {
+		sum += value
+		min = math.Min(min, value)
+		max = math.Max(max, value)
+	}
+	mean := sum / float64(len(values))
+
+	if set.has(StatMean) {
+		stats.Mean = floatPtr(mean)
+	}
+	if set.has(StatMin) {
+		stats.Min = floatPtr(min)
+	}
+	if set.has(StatMax) {
+		stats.Max = floatPtr(max)
+	}
+	if set.has(StatFirst) {
+		stats.First = floatPtr(values[0])
+	}
+	if set.has(StatLast) {
+		stats.Last = floatPtr(values[len(values)-1])
+	}
+	if set.has(StatStdDev) {
+		stats.StdDev = floatPtr(sampleStdDev(values, mean))
+	}
+
+	if set.needsValues() {
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+
+		if set.has(StatMedian) {
+			stats.Median = floatPtr(percentile(sorted, 50))
+		}
+		if len(set.percentiles) > 0 {
+			stats.Percentiles = make(map[string]float64, len(set.percentiles))
+			for name, p := range set.percentiles {
+				stats.Percentiles[name] = percentile(sorted, p)
+			}
+		}
+	}
+
+	return stats, true
+}
+
+// sampleStdDev returns the sample standard deviation of values, or 0 when
+// there is a single value.
+func sampleStdDev(values []float64, mean float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+
+	var squares float64
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	return math.Sqrt(squares / float64(len(values)-1))
+}
+
+// percentile returns the p-th percentile of sorted values, interpolating
+// linearly between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// midRankPercentile returns the percentile rank of value within sorted: the
+// share of values below it plus half the share tied with it. Values within a
+// small relative tolerance count as ties, so a mean that went through a
+// database round trip still matches itself.
+func midRankPercentile(sorted []float64, value float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	var below, tied int
+	for _, v := range sorted {
+		switch {
+		case approximatelyEqual(v, value):
+			tied++
+		case v < value:
+			below++
+		}
+	}
+	return (float64(below) + 0.5*float64(tied)) / float64(len(sorted)) * 100
+}
+
+func approximatelyEqual(a, b float64) bool {
+	tolerance := 1e-9 * math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+	return math.Abs(a-b) <= tolerance
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeStatistics(t *testing.T) {
+	set, err := parseStatistics([]string{"count", "mean", "min", "max", "median", "stddev", "first", "last", "p5", "p95"})
+	assert.NoError(t, err, "Error parsing statistics")
+
+	values := []float64{72, 60, 80, 68, 90}
+	stats, ok := computeStatistics(values, set, "bpm")
+	assert.True(t, ok)
+	assert.Equal(t, "bpm", stats.Unit)
+	assert.Equal(t, 5, stats.Count)
+	assert.InDelta(t, 74.0, *stats.Mean, 1e-9)
+	assert.Equal(t, 60.0, *stats.Min)
+	assert.Equal(t, 90.0, *stats.Max)
+	assert.Equal(t, 72.0, *stats.Median)
+	assert.InDelta(t, 11.489, *stats.StdDev, 0.001)
+	assert.Equal(t, 72.0, *stats.First, "First should follow time order, not value order")
+	assert.Equal(t, 90.0, *stats.Last)
+	assert.InDelta(t, 61.6, stats.Percentiles["p5"], 1e-9)
+	assert.InDelta(t, 88.0, stats.Percentiles["p95"], 1e-9)
+
+	_, ok = computeStatistics(nil, set, "bpm")
+	assert.False(t, ok, "No values should produce no statistics")
+}
+
+func TestParseStatistics(t *testing.T) {
+	set, err := parseStatistics(nil)
+	assert.NoError(t, err)
+	assert.True(t, set.has(StatMean), "Mean should be computed by default")
+
+	_, err = parseStatistics([]string{"mode"})
+	assert.True(t, IsValidationError(err), "Unknown statistic should be rejected")
+
+	_, err = parseStatistics([]string{"p101"})
+	assert.True(t, IsValidationError(err), "Out of range percentile should be rejected")
+}
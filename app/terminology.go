@@ -0,0 +1,168 @@
+package app
+
+import (
+	"fmt"
+	"medical-vitals-management-system/models"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	loincSystem = "http://loinc.org"
+	ucumSystem  = "http://unitsofmeasure.org"
+)
+
+// ucumCodes maps units to their UCUM codes
+var ucumCodes = map[string]string{
+	"°C":     "Cel",
+	"°F":     "[degF]",
+	"K":      "K",
+	"bpm":    "/min",
+	"mmHg":   "mm[Hg]",
+	"kPa":    "kPa",
+	"kg":     "kg",
+	"g":      "g",
+	"lb":     "[lb_av]",
+	"%":      "%",
+	"mg/dL":  "mg/dL",
+	"mmol/L": "mmol/L",
+}
+
+// UCUMCode returns the UCUM code of a unit, or an empty string for units
+// without one.
+func UCUMCode(unit string) string {
+	return ucumCodes[NormalizeUnit(unit)]
+}
+
+// isLOINC reports whether code has the form of a LOINC code, one to seven
+// digits, a hyphen and a valid mod 10 check digit, such as 8867-4.
+func isLOINC(code string) bool {
+	i := strings.Index(code, "-")
+	if i < 1 || i > 7 || i != len(code)-2 {
+		return false
+	}
+	for _, r := range code[:i] + code[i+1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return loincCheckDigit(code[:i]) == code[i+1]
+}
+
+// loincCheckDigit computes the mod 10 check digit of the numeric part of a
+// LOINC code, doubling every other digit starting from the rightmost.
+func loincCheckDigit(digits string) byte {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		digit := int(digits[i] - '0')
+		if (len(digits)-1-i)%2 == 0 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// validateLOINCCodes checks the LOINC codes of a vital type and its
+// components, which may be left empty.
+func validateLOINCCodes(vitalType models.VitalType) error {
+	if vitalType.LoincCode != "" && !isLOINC(vitalType.LoincCode) {
+		return validationErrorf("invalid LOINC code %q for %s", vitalType.LoincCode, vitalType.VitalID)
+	}
+	for _, component := range vitalType.Components {
+		if component.LoincCode != "" && !isLOINC(component.LoincCode) {
+			return validationErrorf("invalid LOINC code %q for %s %s", component.LoincCode, vitalType.VitalID, component.Name)
+		}
+	}
+	return nil
+}
+
+// checkLOINCUnique rejects a vital type whose LOINC code already identifies
+// another type, since readings may be submitted under either.
+func checkLOINCUnique(db *gorm.DB, vitalType models.VitalType) error {
+	if vitalType.LoincCode == "" {
+		return nil
+	}
+
+	var count int64
+	err := db.Model(&models.VitalType{}).
+		Where("(loinc_code = ? OR vital_id = ?) AND vital_id <> ?", vitalType.LoincCode, vitalType.LoincCode, vitalType.VitalID).
+		Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("failed to check LOINC code: %v", err)
+	}
+	if count > 0 {
+		return validationErrorf("LOINC code %s already identifies another vital type", vitalType.LoincCode)
+	}
+	return nil
+}
+
+// describeTerminology fills in the UCUM codes of the units of a vital type
+// and its components.
+func describeTerminology(vitalType *models.VitalType) {
+	vitalType.UCUMUnit = UCUMCode(vitalType.Unit)
+	for i := range vitalType.Components {
+		vitalType.Components[i].UCUMUnit = UCUMCode(vitalType.Components[i].Unit)
+	}
+}
+
+// loincCode returns the LOINC code of the series key of vitalType, which is
+// the type's own code for a key without a component.
+func loincCode(vitalType models.VitalType, key string) string {
+	_, component := splitSeriesKey(key)
+	if component == "" {
+		return vitalType.LoincCode
+	}
+	for _, c := range vitalType.Components {
+		if c.Name == component {
+			return c.LoincCode
+		}
+	}
+	return ""
+}
+
+// LOINCCodes maps the series keys of the catalog, and the vital IDs of
+// composite types, to their LOINC codes. Series without a code are left out.
+func LOINCCodes(db *gorm.DB) (map[string]string, error) {
+	vitalTypes, err := GetVitalTypes(db, false)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make(map[string]string)
+	for _, vitalType := range vitalTypes {
+		for _, key := range conceptKeys(vitalType) {
+			if code := loincCode(vitalType, key); code != "" {
+				codes[key] = code
+			}
+		}
+	}
+	return codes, nil
+}
+
+// canonicalVitalIDs replaces the LOINC codes among vitalIDs with the vital
+// IDs of the types they identify. Other values are kept as given, so that
+// readings of deleted vital types can still be addressed.
+func canonicalVitalIDs(db *gorm.DB, vitalIDs []string) ([]string, error) {
+	canonical := make([]string, len(vitalIDs))
+	for i, vitalID := range vitalIDs {
+		canonical[i] = vitalID
+		if !isLOINC(vitalID) {
+			continue
+		}
+
+		vitalType, err := GetVitalType(db, vitalID)
+		if err != nil {
+			if IsValidationError(err) {
+				continue
+			}
+			return nil, err
+		}
+		canonical[i] = vitalType.VitalID
+	}
+	return canonical, nil
+}
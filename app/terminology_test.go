@@ -0,0 +1,46 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsLOINC(t *testing.T) {
+	for _, code := range []string{"8867-4", "8310-5", "85354-9", "8480-6", "8462-4", "59408-5", "8889-8"} {
+		assert.True(t, isLOINC(code), "%s should be a valid LOINC code", code)
+	}
+	assert.False(t, isLOINC("8867-5"), "A wrong check digit should be rejected")
+	assert.False(t, isLOINC("HeartRate"))
+	assert.False(t, isLOINC("8867"), "The check digit is required")
+	assert.False(t, isLOINC("-4"))
+	assert.False(t, isLOINC("12345678-0"), "The numeric part has at most seven digits")
+}
+
+func TestUCUMCode(t *testing.T) {
+	assert.Equal(t, "/min", UCUMCode("bpm"))
+	assert.Equal(t, "Cel", UCUMCode("celsius"), "Unit aliases should be normalized first")
+	assert.Equal(t, "mm[Hg]", UCUMCode("mmHg"))
+	assert.Empty(t, UCUMCode("furlongs"))
+}
+
+func TestValidateLOINCCodes(t *testing.T) {
+	assert.NoError(t, validateLOINCCodes(bloodPressureType()))
+	assert.NoError(t, validateLOINCCodes(models.VitalType{VitalID: "Glucose"}), "Codes are optional")
+
+	bloodPressure := bloodPressureType()
+	bloodPressure.Components[0].LoincCode = "8480-7"
+	assert.Error(t, validateLOINCCodes(bloodPressure), "Component codes should be checked")
+
+	assert.Error(t, validateVitalType(models.VitalType{VitalID: "8867-4", MinValue: 20, MaxValue: 300}),
+		"A vital ID that reads as a LOINC code should be rejected")
+}
+
+func TestLOINCCodeOfSeries(t *testing.T) {
+	bloodPressure := bloodPressureType()
+	assert.Equal(t, "85354-9", loincCode(bloodPressure, "BloodPressure"))
+	assert.Equal(t, "8462-4", loincCode(bloodPressure, "BloodPressure.diastolic"))
+	assert.Empty(t, loincCode(bloodPressure, "BloodPressure.mean"))
+	assert.Equal(t, "8480-6", seriesOf(bloodPressure)[0].LOINC)
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"strings"
+)
+
+// unitDefinition places a unit on the scale of the base unit of its
+// dimension: base = value*scale + offset. Every conversion supported is
+// affine, so means, medians and ranges convert the same way single values do.
+type unitDefinition struct {
+	dimension string
+	scale     float64
+	offset    float64
+}
+
+var unitDefinitions = map[string]unitDefinition{
+	"°C":     {dimension: "temperature", scale: 1},
+	"°F":     {dimension: "temperature", scale: 5.0 / 9.0, offset: -32 * 5.0 / 9.0},
+	"K":      {dimension: "temperature", scale: 1, offset: -273.15},
+	"bpm":    {dimension: "rate", scale: 1},
+	"mmHg":   {dimension: "pressure", scale: 1},
+	"kPa":    {dimension: "pressure", scale: 7.50061683},
+	"kg":     {dimension: "mass", scale: 1},
+	"g":      {dimension: "mass", scale: 0.001},
+	"lb":     {dimension: "mass", scale: 0.45359237},
+	"%":      {dimension: "fraction", scale: 1},
+	"mg/dL":  {dimension: "glucose", scale: 1},
+	"mmol/L": {dimension: "glucose", scale: 18.0182},
+}
+
+// unitAliases maps the spellings clients commonly send to the unit names
+// used in unitDefinitions.
+var unitAliases = map[string]string{
+	"c":           "°C",
+	"degc":        "°C",
+	"cel":         "°C",
+	"celsius":     "°C",
+	"°c":          "°C",
+	"f":           "°F",
+	"degf":        "°F",
+	"[degf]":      "°F",
+	"fahrenheit":  "°F",
+	"°f":          "°F",
+	"k":           "K",
+	"kelvin":      "K",
+	"bpm":         "bpm",
+	"{beats}/min": "bpm",
+	"mmhg":        "mmHg",
+	"mm[hg]":      "mmHg",
+	"kpa":         "kPa",
+	"kg":          "kg",
+	"g":           "g",
+	"lb":          "lb",
+	"lbs":         "lb",
+	"[lb_av]":     "lb",
+	"%":           "%",
+	"mg/dl":       "mg/dL",
+	"mmol/l":      "mmol/L",
+}
+
+// NormalizeUnit returns the canonical spelling of unit, or unit unchanged if
+// it is not a known alias.
+func NormalizeUnit(unit string) string {
+	trimmed := strings.TrimSpace(unit)
+	if normalized, ok := unitAliases[strings.ToLower(trimmed)]; ok {
+		return normalized
+	}
+	return trimmed
+}
+
+// unitConversion returns the scale and offset that convert a value in unit
+// from into unit to.
+func unitConversion(from, to string) (float64, float64, error) {
+	from, to = NormalizeUnit(from), NormalizeUnit(to)
+	if from == to {
+		return 1, 0, nil
+	}
+
+	fromDef, ok := unitDefinitions[from]
+	if !ok {
+		return 0, 0, validationErrorf("unknown unit: %s", from)
+	}
+	toDef, ok := unitDefinitions[to]
+	if !ok {
+		return 0, 0, validationErrorf("unknown unit: %s", to)
+	}
+	if fromDef.dimension != toDef.dimension {
+		return 0, 0, validationErrorf("cannot convert %s to %s", from, to)
+	}
+
+	scale := fromDef.scale / toDef.scale
+	offset := (fromDef.offset - toDef.offset) / toDef.scale
+	return scale, offset, nil
+}
+
+// unitScaling is the affine conversion value*scale + offset between two units
+type unitScaling struct {
+	scale  float64
+	offset float64
+}
+
+// conversionsTo lists every known unit that converts into unit, including
+// unit itself, for building conversions that run inside the database.
+func conversionsTo(unit string) map[string]unitScaling {
+	unit = NormalizeUnit(unit)
+	conversions := map[string]unitScaling{unit: {scale: 1}}
+
+	target, ok := unitDefinitions[unit]
+	if !ok {
+		return conversions
+	}
+	for from, definition := range unitDefinitions {
+		if definition.dimension != target.dimension || from == unit {
+			continue
+		}
+		scale, offset, err := unitConversion(from, unit)
+		if err == nil {
+			conversions[from] = unitScaling{scale: scale, offset: offset}
+		}
+	}
+	return conversions
+}
+
+// ConvertValue converts value from one unit to another
+func ConvertValue(value float64, from, to string) (float64, error) {
+	scale, offset, err := unitConversion(from, to)
+	if err != nil {
+		return 0, err
+	}
+	return value*scale + offset, nil
+}
+
+// resolveUnit picks the unit to use for a series: its canonical unit when
+// none is given, otherwise the requested unit if it converts to it.
+func resolveUnit(series vitalSeries, requested string) (string, error) {
+	if strings.TrimSpace(requested) == "" {
+		return series.Unit, nil
+	}
+
+	unit := NormalizeUnit(requested)
+	if _, _, err := unitConversion(series.Unit, unit); err != nil {
+		return "", validationErrorf("unit %s is not valid for %s: %v", requested, series.label(), err)
+	}
+	return unit, nil
+}
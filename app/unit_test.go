@@ -0,0 +1,44 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertValue(t *testing.T) {
+	value, err := ConvertValue(98.6, "F", "°C")
+	assert.NoError(t, err, "Error converting Fahrenheit to Celsius")
+	assert.InDelta(t, 37.0, value, 1e-9, "Temperature conversion mismatch")
+
+	value, err = ConvertValue(5.5, "mmol/L", "mg/dL")
+	assert.NoError(t, err, "Error converting glucose units")
+	assert.InDelta(t, 99.1, value, 0.01, "Glucose conversion mismatch")
+
+	value, err = ConvertValue(150, "lbs", "kg")
+	assert.NoError(t, err, "Error converting weight units")
+	assert.InDelta(t, 68.04, value, 0.01, "Weight conversion mismatch")
+
+	_, err = ConvertValue(70, "bpm", "°C")
+	assert.Error(t, err, "Converting between dimensions should fail")
+}
+
+func TestNormalizeVitalValue(t *testing.T) {
+	vitalType := models.VitalType{VitalID: "Temperature", Unit: "°C", MinValue: 25, MaxValue: 45, Precision: 1, Active: true}
+	series := seriesOf(vitalType)[0]
+
+	value, err := normalizeVitalValue(series, 98.6, "°F")
+	assert.NoError(t, err, "Fahrenheit reading should be accepted")
+	assert.Equal(t, 37.0, value, "Reading should be stored in the canonical unit")
+
+	value, err = normalizeVitalValue(series, 36.6, "")
+	assert.NoError(t, err, "Reading without a unit should use the canonical unit")
+	assert.Equal(t, 36.6, value)
+
+	_, err = normalizeVitalValue(series, 98.6, "")
+	assert.Error(t, err, "Fahrenheit value sent without a unit is out of range")
+
+	_, err = normalizeVitalValue(series, 70, "bpm")
+	assert.True(t, IsValidationError(err), "Incompatible unit should be a validation error")
+}
@@ -15,6 +15,29 @@ func CreateUser(db *gorm.DB, user models.User) error {
 	return nil
 }
 
+// RegisterUser creates a patient who logs in with password. Other roles are
+// given by admins once the user exists.
+func RegisterUser(db *gorm.DB, user models.User, password string) error {
+	user.Role = models.RolePatient
+	if len(password) < minPasswordLength {
+		return validationErrorf("password must be at least %d characters", minPasswordLength)
+	}
+
+	tx := db.Begin()
+	if err := CreateUser(tx, user); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := SetPassword(tx, user.Username, password); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to create user: %v", err)
+	}
+	return nil
+}
+
 func GetUser(db *gorm.DB, username string) (models.User, error) {
 	var user models.User
 	err := db.Where("username = ?", username).First(&user).Error
@@ -24,18 +47,34 @@ func GetUser(db *gorm.DB, username string) (models.User, error) {
 	return user, nil
 }
 
+// UpdateUser updates the profile of user.Username. The role is changed with
+// SetUserRole.
 func UpdateUser(db *gorm.DB, user models.User) error {
-	err := db.Save(&user).Error
+	err := db.Model(&models.User{}).Where("username = ?", user.Username).
+		Updates(map[string]interface{}{"age": user.Age, "gender": user.Gender}).Error
 	if err != nil {
 		return fmt.Errorf("failed to update user: %v", err)
 	}
 	return nil
 }
 
-// DeleteUser deletes a user record from the database
+// DeleteUser deletes a user record from the database, along with the
+// password and refresh tokens of the user.
 func DeleteUser(db *gorm.DB, username string) error {
-	err := db.Where("username = ?", username).Delete(&models.User{}).Error
-	if err != nil {
+	tx := db.Begin()
+	if err := tx.Where("username = ?", username).Delete(&models.User{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+	if err := tx.Unscoped().Where("username = ?", username).Delete(&models.Credential{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete user credentials: %v", err)
+	}
+	if err := revokeRefreshTokens(tx, "username = ?", username); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
 		return fmt.Errorf("failed to delete user: %v", err)
 	}
 	return nil
@@ -3,74 +3,407 @@ package app
 import (
 	"fmt"
 	"medical-vitals-management-system/models"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
-// CreateVital inserts a new vital record into the database
-func CreateVital(db *gorm.DB, vital models.Vital) error {
-	validVitalIDs := map[string]bool{
-		"HeartRate":   true,
-		"Temperature": true,
+// CreateVital inserts a new vital reading into the database. Values are given
+// in the reading's units, or in the canonical units of the vital type if none
+// are given, and are stored converted to the canonical units. Composite
+// readings are stored as one row per component. The stored rows are then
+// checked against the alert rules.
+func CreateVital(db *gorm.DB, reading models.VitalReading) error {
+	vitalType, err := GetActiveVitalType(db, reading.VitalID)
+	if err != nil {
+		return err
 	}
 
-	if !validVitalIDs[vital.VitalID] {
-
-		return fmt.Errorf("invalid vitalID: %s", vital.VitalID)
-
+	vitals, err := readingToVitals(vitalType, reading)
+	if err != nil {
+		return err
 	}
 
-	err := db.Create(&vital).Error
-	if err != nil {
+	tx := db.Begin()
+	for i := range vitals {
+		if err := tx.Create(&vitals[i]).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to insert vital: %v", err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
 		return fmt.Errorf("failed to insert vital: %v", err)
 	}
+	raiseAlerts(db, vitals)
 	return nil
 }
 
-// GetVitals retrieves vital records for a user over a specified period
-func GetVitals(db *gorm.DB, username string, period []string) ([]models.Vital, error) {
-	var vitals []models.Vital
-	if len(period) != 2 {
-		return nil, fmt.Errorf("period should have exactly 2 elements")
+// GetVitals retrieves a page of the vitals matching query, ordered by
+// timestamp and then by ID so that pages are stable under concurrent inserts.
+// Composite readings are returned whole: a page ends early rather than split
+// the components of one reading across two pages.
+func GetVitals(db *gorm.DB, query models.VitalQuery) (models.VitalPage, error) {
+	plan, err := planVitalPage(query)
+	if err != nil {
+		return models.VitalPage{}, err
 	}
 
-	err := db.Where("username = ? AND timestamp BETWEEN ? AND ?", username, period[0], period[1]).Find(&vitals).Error
-	if err != nil {
-		return nil, fmt.Errorf("failed to get vitals: %v", err)
+	if err := validateSourceFilter(query.Source); err != nil {
+		return models.VitalPage{}, err
 	}
 
-	return vitals, nil
+	scope := db.Where("username = ?", query.Username)
+	if len(query.VitalIDs) > 0 {
+		vitalIDs, err := canonicalVitalIDs(db, query.VitalIDs)
+		if err != nil {
+			return models.VitalPage{}, err
+		}
+		scope = scope.Where("vital_id IN (?)", vitalIDs)
+	}
+	if query.From != nil {
+		scope = scope.Where("timestamp >= ?", *query.From)
+	}
+	if query.To != nil {
+		scope = scope.Where("timestamp <= ?", *query.To)
+	}
+	if query.MinValue != nil {
+		scope = scope.Where("value >= ?", *query.MinValue)
+	}
+	if query.MaxValue != nil {
+		scope = scope.Where("value <= ?", *query.MaxValue)
+	}
+	if condition, args := sourceCondition(query.Source); condition != "" {
+		scope = scope.Where(condition, args...)
+	}
+
+	order := "timestamp, id"
+	if plan.descending {
+		order = "timestamp DESC, id DESC"
+	}
+	scope = scope.Order(order)
+
+	if plan.after != nil {
+		direction := ">"
+		if plan.descending {
+			direction = "<"
+		}
+		scope = scope.Where(fmt.Sprintf("timestamp %[1]s ? OR (timestamp = ? AND id %[1]s ?)", direction),
+			plan.after.Timestamp, plan.after.Timestamp, plan.after.ID)
+	}
+
+	var vitals []models.Vital
+	if err := scope.Limit(plan.limit + 1).Find(&vitals).Error; err != nil {
+		return models.VitalPage{}, fmt.Errorf("failed to get vitals: %v", err)
+	}
+
+	page := models.VitalPage{Sort: plan.sort, Limit: plan.limit}
+	page.Vitals, page.HasMore = trimPartialReading(vitals, plan.limit)
+	if len(page.Vitals) == 0 && page.HasMore {
+		// The first reading alone has more components than the limit, so the
+		// page holds that reading whole.
+		err := scope.Where("vital_id = ? AND timestamp = ?", vitals[0].VitalID, vitals[0].Timestamp).Find(&page.Vitals).Error
+		if err != nil {
+			return models.VitalPage{}, fmt.Errorf("failed to get vitals: %v", err)
+		}
+	}
+	if page.HasMore {
+		last := page.Vitals[len(page.Vitals)-1]
+		page.NextCursor = encodeCursor(vitalCursor{Timestamp: last.Timestamp, ID: last.ID, Sort: plan.sort})
+	}
+	return page, nil
 }
 
-// UpdateVital updates an existing vital record in the database
-func UpdateVital(db *gorm.DB, username, vitalID, timestamp string, newValue float64) error {
-	err := db.Model(&models.Vital{}).
-		Where("username = ? AND vital_id = ? AND timestamp = ?", username, vitalID, timestamp).
-		Update("value", newValue).Error
+// UpdateVital replaces the value of an existing vital reading, identified by
+// its username, vital ID and timestamp. Composite readings must give every
+// component, as on insert. Each row whose value or unit changes gets a
+// revision recording the change.
+func UpdateVital(db *gorm.DB, reading models.VitalReading, change models.VitalChange) error {
+	if err := validateChange(change); err != nil {
+		return err
+	}
+
+	vitalType, err := GetActiveVitalType(db, reading.VitalID)
+	if err != nil {
+		return err
+	}
+
+	vitals, err := readingToVitals(vitalType, reading)
 	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	tx := db.Begin()
+	for _, vital := range vitals {
+		query := tx.Where("username = ? AND vital_id = ? AND timestamp = ?", vital.Username, vital.VitalID, vital.Timestamp)
+		if vital.Component != "" {
+			query = query.Where("component = ?", vital.Component)
+		}
+
+		var existing []models.Vital
+		if err := query.Find(&existing).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to edit vital: %v", err)
+		}
+		if len(existing) == 0 {
+			tx.Rollback()
+			return notFoundErrorf("no %s reading at %s for %s", vitalType.VitalID, reading.Timestamp.Format(time.RFC3339Nano), reading.Username)
+		}
+
+		for _, row := range existing {
+			if row.Value == vital.Value && row.Unit == vital.Unit {
+				continue
+			}
+			value := vital.Value
+			if err := recordRevision(tx, row, &value, vital.Unit, change, now); err != nil {
+				tx.Rollback()
+				return err
+			}
+			err := tx.Model(&row).Updates(map[string]interface{}{"value": vital.Value, "unit": vital.Unit}).Error
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to edit vital: %v", err)
+			}
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
 		return fmt.Errorf("failed to edit vital: %v", err)
 	}
 	return nil
 }
 
-// DeleteVital deletes a vital record for a user using the vital ID and timestamp
+// DeleteVital deletes a vital reading for a user using the vital ID, or the
+// LOINC code of its type, and timestamp, including every component of a
+// composite reading. Each deleted row gets a revision recording its last value.
 func DeleteVital(db *gorm.DB, request models.DeleteVitalRequest) error {
-	fmt.Printf("Deleting vital: %+v\n", request)
+	change := models.VitalChange{Actor: request.Actor, Reason: request.Reason}
+	if err := validateChange(change); err != nil {
+		return err
+	}
 
-	var vital models.Vital
-	err := db.Where("username = ? AND vital_id = ? AND timestamp = ?", request.Username, request.VitalID, request.Timestamp).
-		First(&vital).Error
+	vitalIDs, err := canonicalVitalIDs(db, []string{request.VitalID})
+	if err != nil {
+		return err
+	}
+	request.VitalID = vitalIDs[0]
+
+	var rows []models.Vital
+	err = db.Where("username = ? AND vital_id = ? AND timestamp = ?", request.Username, request.VitalID, request.Timestamp).
+		Find(&rows).Error
 	if err != nil {
-		if gorm.IsRecordNotFoundError(err) {
-			return nil
-		}
 		return fmt.Errorf("failed to check vital existence: %v", err)
 	}
+	if len(rows) == 0 {
+		return nil
+	}
 
-	err = db.Delete(&vital).Error
+	now := time.Now().UTC()
+	tx := db.Begin()
+	for _, row := range rows {
+		if err := recordRevision(tx, row, nil, "", change, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Where("username = ? AND vital_id = ? AND timestamp = ?", request.Username, request.VitalID, request.Timestamp).
+		Delete(&models.Vital{}).Error
 	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete vital: %v", err)
+	}
+	if err := tx.Commit().Error; err != nil {
 		return fmt.Errorf("failed to delete vital: %v", err)
 	}
 
 	return nil
 }
+
+// ConvertVitals converts each vital to the unit requested for it in units,
+// keyed by vital ID or, for a single component, by "VitalID.component".
+// Vitals with no requested unit, and vitals recorded before units were
+// tracked, are left as stored.
+func ConvertVitals(db *gorm.DB, vitals []models.Vital, units map[string]string) ([]models.Vital, error) {
+	if len(units) == 0 {
+		return vitals, nil
+	}
+
+	outputUnits := make(map[string]string)
+	for _, vital := range vitals {
+		key := seriesKey(vital.VitalID, vital.Component)
+		if _, resolved := outputUnits[key]; resolved {
+			continue
+		}
+
+		requested, ok := units[key]
+		if !ok {
+			requested = units[vital.VitalID]
+		}
+		if requested == "" {
+			outputUnits[key] = ""
+			continue
+		}
+
+		vitalType, err := GetVitalType(db, vital.VitalID)
+		if err != nil {
+			return nil, err
+		}
+		series, err := selectSeries(vitalType, vital.Component)
+		if err != nil {
+			return nil, err
+		}
+		if outputUnits[key], err = resolveUnit(series[0], requested); err != nil {
+			return nil, err
+		}
+	}
+
+	converted := make([]models.Vital, 0, len(vitals))
+	for _, vital := range vitals {
+		unit := outputUnits[seriesKey(vital.VitalID, vital.Component)]
+		if unit != "" && vital.Unit != "" {
+			value, err := ConvertValue(vital.Value, vital.Unit, unit)
+			if err != nil {
+				return nil, err
+			}
+			vital.Value = value
+			vital.Unit = unit
+		}
+		converted = append(converted, vital)
+	}
+	return converted, nil
+}
+
+// GroupVitalReadings collects vital rows into readings, merging the component
+// rows of composite readings. Readings are returned in the order their first
+// row appears.
+func GroupVitalReadings(vitals []models.Vital) []models.VitalReading {
+	type readingKey struct {
+		username  string
+		vitalID   string
+		timestamp int64
+	}
+
+	var readings []models.VitalReading
+	index := make(map[readingKey]int)
+	for _, vital := range vitals {
+		key := readingKey{vital.Username, vital.VitalID, vital.Timestamp.UnixNano()}
+		i, ok := index[key]
+		if !ok {
+			i = len(readings)
+			index[key] = i
+			readings = append(readings, models.VitalReading{
+				Username:  vital.Username,
+				VitalID:   vital.VitalID,
+				Timestamp: vital.Timestamp,
+				Source: models.VitalSource{
+					Type:     vital.SourceType,
+					DeviceID: vital.DeviceID,
+					Firmware: vital.Firmware,
+					Method:   vital.Method,
+					BodySite: vital.BodySite,
+				},
+			})
+		}
+
+		reading := &readings[i]
+		if vital.Component == "" {
+			value := vital.Value
+			reading.Value = &value
+			reading.Unit = vital.Unit
+			continue
+		}
+		if reading.Components == nil {
+			reading.Components = make(map[string]float64)
+			reading.ComponentUnits = make(map[string]string)
+		}
+		reading.Components[vital.Component] = vital.Value
+		reading.ComponentUnits[vital.Component] = vital.Unit
+	}
+	return readings
+}
+
+// readingToVitals validates a reading against its vital type and converts it
+// into the rows to store, one per series, in canonical units.
+func readingToVitals(vitalType models.VitalType, reading models.VitalReading) ([]models.Vital, error) {
+	series := seriesOf(vitalType)
+
+	var err error
+	if reading.Source, err = normalizeSource(reading.Source); err != nil {
+		return nil, err
+	}
+
+	if len(vitalType.Components) == 0 {
+		if reading.Value == nil || len(reading.Components) > 0 {
+			return nil, validationErrorf("%s requires a single value", vitalType.VitalID)
+		}
+
+		value, err := normalizeVitalValue(series[0], *reading.Value, reading.Unit)
+		if err != nil {
+			return nil, err
+		}
+		return []models.Vital{newVitalRow(reading, series[0], value)}, nil
+	}
+
+	if reading.Value != nil || len(reading.Components) == 0 {
+		return nil, validationErrorf("%s requires component values", vitalType.VitalID)
+	}
+
+	known := make(map[string]bool)
+	vitals := make([]models.Vital, 0, len(series))
+	for _, s := range series {
+		known[s.Component] = true
+
+		value, ok := reading.Components[s.Component]
+		if !ok {
+			return nil, validationErrorf("missing component %s for %s", s.Component, vitalType.VitalID)
+		}
+
+		unit := reading.ComponentUnits[s.Component]
+		if unit == "" {
+			unit = reading.Unit
+		}
+
+		value, err := normalizeVitalValue(s, value, unit)
+		if err != nil {
+			return nil, err
+		}
+		vitals = append(vitals, newVitalRow(reading, s, value))
+	}
+
+	for component := range reading.Components {
+		if !known[component] {
+			return nil, validationErrorf("unknown component %s for %s", component, vitalType.VitalID)
+		}
+	}
+	return vitals, nil
+}
+
+func newVitalRow(reading models.VitalReading, series vitalSeries, value float64) models.Vital {
+	return models.Vital{
+		Username:   reading.Username,
+		VitalID:    series.VitalID,
+		Component:  series.Component,
+		Value:      value,
+		Unit:       series.Unit,
+		Timestamp:  reading.Timestamp,
+		SourceType: reading.Source.Type,
+		DeviceID:   reading.Source.DeviceID,
+		Firmware:   reading.Source.Firmware,
+		Method:     reading.Source.Method,
+		BodySite:   reading.Source.BodySite,
+	}
+}
+
+// normalizeVitalValue converts a value given in unit to the canonical unit of
+// its series and validates it against the series' range.
+func normalizeVitalValue(series vitalSeries, value float64, unit string) (float64, error) {
+	inputUnit, err := resolveUnit(series, unit)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err = ConvertValue(value, inputUnit, series.Unit)
+	if err != nil {
+		return 0, err
+	}
+	return validateVitalValue(series, value)
+}
@@ -112,3 +112,59 @@ func TestDeleteVitalWithMock(t *testing.T) {
 	assert.NoError(t, err, "Error deleting vital record")
 
 }
+
+func bloodPressureType() models.VitalType {
+	return models.VitalType{
+		VitalID:   "BloodPressure",
+		Active:    true,
+		LoincCode: "85354-9",
+		Components: []models.VitalComponent{
+			{Name: "systolic", Unit: "mmHg", MinValue: 40, MaxValue: 300, LoincCode: "8480-6"},
+			{Name: "diastolic", Unit: "mmHg", MinValue: 20, MaxValue: 200, LoincCode: "8462-4"},
+		},
+	}
+}
+
+func TestReadingToVitalsComposite(t *testing.T) {
+	timestamp := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	reading := models.VitalReading{
+		Username:   "JohnDoe",
+		VitalID:    "BloodPressure",
+		Components: map[string]float64{"systolic": 120, "diastolic": 80},
+		Timestamp:  timestamp,
+	}
+
+	vitals, err := readingToVitals(bloodPressureType(), reading)
+	assert.NoError(t, err, "Error converting composite reading")
+	assert.Len(t, vitals, 2, "Composite reading should produce one row per component")
+	assert.Equal(t, "systolic", vitals[0].Component)
+	assert.Equal(t, 120.0, vitals[0].Value)
+	assert.Equal(t, "diastolic", vitals[1].Component)
+	assert.Equal(t, 80.0, vitals[1].Value)
+
+	reading.Components = map[string]float64{"systolic": 120}
+	_, err = readingToVitals(bloodPressureType(), reading)
+	assert.Error(t, err, "Missing component should be rejected")
+
+	reading.Components = map[string]float64{"systolic": 120, "diastolic": 80, "mean": 93}
+	_, err = readingToVitals(bloodPressureType(), reading)
+	assert.Error(t, err, "Unknown component should be rejected")
+
+	value := 120.0
+	_, err = readingToVitals(bloodPressureType(), models.VitalReading{VitalID: "BloodPressure", Value: &value})
+	assert.Error(t, err, "Single value for a composite vital should be rejected")
+}
+
+func TestGroupVitalReadings(t *testing.T) {
+	timestamp := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	vitals := []models.Vital{
+		{Username: "JohnDoe", VitalID: "BloodPressure", Component: "systolic", Value: 120, Unit: "mmHg", Timestamp: timestamp},
+		{Username: "JohnDoe", VitalID: "HeartRate", Value: 75, Unit: "bpm", Timestamp: timestamp},
+		{Username: "JohnDoe", VitalID: "BloodPressure", Component: "diastolic", Value: 80, Unit: "mmHg", Timestamp: timestamp},
+	}
+
+	readings := GroupVitalReadings(vitals)
+	assert.Len(t, readings, 2, "Component rows should be merged into one reading")
+	assert.Equal(t, map[string]float64{"systolic": 120, "diastolic": 80}, readings[0].Components)
+	assert.Equal(t, 75.0, *readings[1].Value)
+}
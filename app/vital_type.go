@@ -0,0 +1,307 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"medical-vitals-management-system/models"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// vitalSeries is one stored value of a vital type: the type itself for simple
+// vitals, or one of its components for composite vitals.
+type vitalSeries struct {
+	VitalID   string
+	Component string
+	Unit      string
+	MinValue  float64
+	MaxValue  float64
+	// NormalLow and NormalHigh bound the normal values, if known.
+	NormalLow  *float64
+	NormalHigh *float64
+	Precision  int
+	LOINC      string
+}
+
+// seriesOf lists the values a reading of vitalType is made of
+func seriesOf(vitalType models.VitalType) []vitalSeries {
+	if len(vitalType.Components) == 0 {
+		return []vitalSeries{{
+			VitalID:    vitalType.VitalID,
+			Unit:       vitalType.Unit,
+			MinValue:   vitalType.MinValue,
+			MaxValue:   vitalType.MaxValue,
+			NormalLow:  vitalType.NormalLow,
+			NormalHigh: vitalType.NormalHigh,
+			Precision:  vitalType.Precision,
+			LOINC:      vitalType.LoincCode,
+		}}
+	}
+
+	series := make([]vitalSeries, 0, len(vitalType.Components))
+	for _, component := range vitalType.Components {
+		series = append(series, vitalSeries{
+			VitalID:    vitalType.VitalID,
+			Component:  component.Name,
+			Unit:       component.Unit,
+			MinValue:   component.MinValue,
+			MaxValue:   component.MaxValue,
+			NormalLow:  component.NormalLow,
+			NormalHigh: component.NormalHigh,
+			Precision:  component.Precision,
+			LOINC:      component.LoincCode,
+		})
+	}
+	return series
+}
+
+// Key identifies the series in API responses, e.g. "HeartRate" or
+// "BloodPressure.systolic".
+func (s vitalSeries) Key() string {
+	return seriesKey(s.VitalID, s.Component)
+}
+
+func (s vitalSeries) label() string {
+	if s.Component == "" {
+		return s.VitalID
+	}
+	return s.VitalID + " " + s.Component
+}
+
+func seriesKey(vitalID, component string) string {
+	if component == "" {
+		return vitalID
+	}
+	return vitalID + "." + component
+}
+
+// CreateVitalType adds a new vital type to the catalog
+func CreateVitalType(db *gorm.DB, vitalType models.VitalType) error {
+	normalizeVitalTypeUnits(&vitalType)
+	if err := validateVitalType(vitalType); err != nil {
+		return err
+	}
+
+	exists, err := VitalTypeExists(db, vitalType.VitalID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return validationErrorf("vital type already exists: %s", vitalType.VitalID)
+	}
+	if err := checkLOINCUnique(db, vitalType); err != nil {
+		return err
+	}
+
+	err = db.Create(&vitalType).Error
+	if err != nil {
+		return fmt.Errorf("failed to create vital type: %v", err)
+	}
+	return nil
+}
+
+// GetVitalTypes lists the catalog, optionally restricted to active types
+func GetVitalTypes(db *gorm.DB, activeOnly bool) ([]models.VitalType, error) {
+	var vitalTypes []models.VitalType
+	query := db.Preload("Components").Order("vital_id")
+	if activeOnly {
+		query = query.Where("active = ?", true)
+	}
+	if err := query.Find(&vitalTypes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get vital types: %v", err)
+	}
+	for i := range vitalTypes {
+		describeTerminology(&vitalTypes[i])
+	}
+	return vitalTypes, nil
+}
+
+// GetVitalType fetches a single vital type by its vital ID or, failing that,
+// by its LOINC code.
+func GetVitalType(db *gorm.DB, vitalID string) (models.VitalType, error) {
+	var vitalType models.VitalType
+	err := db.Preload("Components").Where("vital_id = ?", vitalID).First(&vitalType).Error
+	if gorm.IsRecordNotFoundError(err) && isLOINC(vitalID) {
+		vitalType = models.VitalType{}
+		err = db.Preload("Components").Where("loinc_code = ?", vitalID).First(&vitalType).Error
+	}
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return models.VitalType{}, validationErrorf("unknown vitalID: %s", vitalID)
+		}
+		return models.VitalType{}, fmt.Errorf("failed to get vital type: %v", err)
+	}
+	describeTerminology(&vitalType)
+	return vitalType, nil
+}
+
+// UpdateVitalType replaces the definition of an existing vital type,
+// including its list of components.
+func UpdateVitalType(db *gorm.DB, vitalType models.VitalType) error {
+	normalizeVitalTypeUnits(&vitalType)
+	if err := validateVitalType(vitalType); err != nil {
+		return err
+	}
+
+	existing, err := GetVitalType(db, vitalType.VitalID)
+	if err != nil {
+		return err
+	}
+	if err := checkLOINCUnique(db, vitalType); err != nil {
+		return err
+	}
+
+	vitalType.Model = existing.Model
+	for i := range vitalType.Components {
+		vitalType.Components[i].Model = gorm.Model{}
+		vitalType.Components[i].VitalTypeID = existing.ID
+	}
+
+	tx := db.Begin()
+	if err := tx.Unscoped().Where("vital_type_id = ?", existing.ID).Delete(&models.VitalComponent{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update vital type components: %v", err)
+	}
+	if err := tx.Save(&vitalType).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update vital type: %v", err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to update vital type: %v", err)
+	}
+	return nil
+}
+
+// DeleteVitalType permanently removes a vital type from the catalog. Existing
+// readings are kept; deactivating the type is usually preferable to deleting it.
+func DeleteVitalType(db *gorm.DB, vitalID string) error {
+	existing, err := GetVitalType(db, vitalID)
+	if err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	if err := tx.Unscoped().Where("vital_type_id = ?", existing.ID).Delete(&models.VitalComponent{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete vital type components: %v", err)
+	}
+	if err := tx.Unscoped().Delete(&existing).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete vital type: %v", err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to delete vital type: %v", err)
+	}
+	return nil
+}
+
+func VitalTypeExists(db *gorm.DB, vitalID string) (bool, error) {
+	var count int64
+	if err := db.Model(&models.VitalType{}).Where("vital_id = ?", vitalID).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to check vital type existence: %v", err)
+	}
+	return count > 0, nil
+}
+
+// GetActiveVitalType fetches a vital type and rejects it if it is disabled,
+// for use on paths that write new readings.
+func GetActiveVitalType(db *gorm.DB, vitalID string) (models.VitalType, error) {
+	vitalType, err := GetVitalType(db, vitalID)
+	if err != nil {
+		return models.VitalType{}, err
+	}
+	if !vitalType.Active {
+		return models.VitalType{}, validationErrorf("vitalID is not active: %s", vitalID)
+	}
+	return vitalType, nil
+}
+
+// selectSeries returns the series of vitalType, narrowed to a single
+// component if one is given.
+func selectSeries(vitalType models.VitalType, component string) ([]vitalSeries, error) {
+	series := seriesOf(vitalType)
+	if component == "" {
+		return series, nil
+	}
+
+	for _, s := range series {
+		if s.Component == component {
+			return []vitalSeries{s}, nil
+		}
+	}
+	return nil, validationErrorf("%s has no component %s", vitalType.VitalID, component)
+}
+
+func normalizeVitalTypeUnits(vitalType *models.VitalType) {
+	vitalType.Unit = NormalizeUnit(vitalType.Unit)
+	for i := range vitalType.Components {
+		vitalType.Components[i].Unit = NormalizeUnit(vitalType.Components[i].Unit)
+	}
+}
+
+func validateVitalType(vitalType models.VitalType) error {
+	if vitalType.VitalID == "" {
+		return validationErrorf("vital_id is required")
+	}
+	if strings.Contains(vitalType.VitalID, ".") {
+		return validationErrorf("vital_id must not contain '.'")
+	}
+	if isLOINC(vitalType.VitalID) {
+		return validationErrorf("vital_id must not be a LOINC code; set loinc_code instead")
+	}
+
+	names := make(map[string]bool)
+	for _, component := range vitalType.Components {
+		if component.Name == "" {
+			return validationErrorf("component name is required")
+		}
+		if names[component.Name] {
+			return validationErrorf("duplicate component: %s", component.Name)
+		}
+		names[component.Name] = true
+	}
+	if err := validateLOINCCodes(vitalType); err != nil {
+		return err
+	}
+
+	for _, series := range seriesOf(vitalType) {
+		if series.MinValue > series.MaxValue {
+			return validationErrorf("min_value must not be greater than max_value for %s", series.label())
+		}
+		if series.Precision < 0 {
+			return validationErrorf("precision must not be negative for %s", series.label())
+		}
+		if series.NormalLow != nil && series.NormalHigh != nil && *series.NormalLow > *series.NormalHigh {
+			return validationErrorf("normal_low must not be greater than normal_high for %s", series.label())
+		}
+	}
+	return nil
+}
+
+// normalFlag says whether value is "low" or "high" for its series, or returns
+// an empty string for values in the normal range or series without one.
+func normalFlag(series vitalSeries, value float64) string {
+	if series.NormalLow != nil && value < *series.NormalLow {
+		return "low"
+	}
+	if series.NormalHigh != nil && value > *series.NormalHigh {
+		return "high"
+	}
+	return ""
+}
+
+// validateVitalValue checks a value against the allowed range of its series
+// and rounds it to the series' precision.
+func validateVitalValue(series vitalSeries, value float64) (float64, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, validationErrorf("invalid value for %s", series.label())
+	}
+	if value < series.MinValue || value > series.MaxValue {
+		return 0, validationErrorf("value %v for %s is outside the allowed range [%v, %v] %s",
+			value, series.label(), series.MinValue, series.MaxValue, series.Unit)
+	}
+
+	scale := math.Pow(10, float64(series.Precision))
+	return math.Round(value*scale) / scale, nil
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"medical-vitals-management-system/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateVitalValue(t *testing.T) {
+	vitalType := models.VitalType{VitalID: "Temperature", Unit: "°C", MinValue: 25, MaxValue: 45, Precision: 1, Active: true}
+	series := seriesOf(vitalType)[0]
+
+	value, err := validateVitalValue(series, 37.04)
+	assert.NoError(t, err, "Value within range should be accepted")
+	assert.Equal(t, 37.0, value, "Value should be rounded to the type's precision")
+
+	_, err = validateVitalValue(series, 98.6)
+	assert.Error(t, err, "Value outside range should be rejected")
+	assert.True(t, IsValidationError(err), "Range error should be a validation error")
+}
+
+func TestValidateVitalType(t *testing.T) {
+	assert.NoError(t, validateVitalType(models.VitalType{VitalID: "SpO2", MinValue: 50, MaxValue: 100}))
+	assert.Error(t, validateVitalType(models.VitalType{VitalID: "SpO2", MinValue: 100, MaxValue: 50}), "Inverted range should be rejected")
+	assert.Error(t, validateVitalType(models.VitalType{MinValue: 0, MaxValue: 1}), "Missing vital ID should be rejected")
+
+	low, high := 100.0, 95.0
+	assert.Error(t, validateVitalType(models.VitalType{VitalID: "SpO2", MinValue: 50, MaxValue: 100, NormalLow: &low, NormalHigh: &high}), "Inverted normal range should be rejected")
+}
+
+func TestValidateCompositeVitalType(t *testing.T) {
+	bloodPressure := models.VitalType{
+		VitalID: "BloodPressure",
+		Components: []models.VitalComponent{
+			{Name: "systolic", Unit: "mmHg", MinValue: 40, MaxValue: 300},
+			{Name: "diastolic", Unit: "mmHg", MinValue: 20, MaxValue: 200},
+		},
+	}
+	assert.NoError(t, validateVitalType(bloodPressure))
+
+	series := seriesOf(bloodPressure)
+	assert.Len(t, series, 2, "Composite type should have one series per component")
+	assert.Equal(t, "BloodPressure.systolic", series[0].Key())
+
+	bloodPressure.Components[1].Name = "systolic"
+	assert.Error(t, validateVitalType(bloodPressure), "Duplicate component names should be rejected")
+}
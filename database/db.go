@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"medical-vitals-management-system/models"
 	"os"
+	"time"
 
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"github.com/joho/godotenv"
@@ -33,7 +34,215 @@ func InitDB() (*gorm.DB, error) {
 		return nil, err
 	}
 
-	db.AutoMigrate(&models.User{}, &models.Vital{})
+	err = db.AutoMigrate(&models.User{}, &models.Vital{}, &models.VitalType{}, &models.VitalComponent{}, &models.PrivacyDisclosure{}, &models.HL7DeadLetter{}, &models.VitalRevision{}, &models.AuditEntry{}, &models.Credential{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.Role{}, &models.Permission{}, &models.ClinicianAssignment{}, &models.CareTeam{}, &models.Device{}, &models.AlertRule{}, &models.Alert{}, &models.SchemaMigration{}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate the schema: %v", err)
+	}
+	db.Model(&models.Vital{}).AddIndex("idx_vitals_username_timestamp_id", "username", "timestamp", "id")
+	// A rule raises at most one unresolved alert per patient at a time.
+	err = db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_unresolved_rule_patient ON alerts (rule_id, patient) WHERE status <> '%s' AND deleted_at IS NULL", models.AlertResolved)).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to index unresolved alerts: %v", err)
+	}
+	if err := protectAppendOnly(db, "audit_entries", "vital_revisions"); err != nil {
+		return nil, err
+	}
+	if err := seedVitalTypes(db); err != nil {
+		return nil, err
+	}
+	if err := seedRoles(db); err != nil {
+		return nil, err
+	}
+	if err := runMigrations(db); err != nil {
+		return nil, err
+	}
 	logrus.Info("Successfully connected to the database")
 	return db, nil
 }
+
+// migrationLockKey is the PostgreSQL advisory lock that keeps instances
+// starting at the same time from applying a migration twice.
+const migrationLockKey = 7261736903
+
+// migrations are the one-off changes to stored data, applied in order the
+// first time the system starts after each is added.
+var migrations = []struct {
+	Name  string
+	Apply func(tx *gorm.DB) error
+}{
+	// Assignments made before they had dates count from when they were made.
+	{"clinician_assignment_start_dates", func(tx *gorm.DB) error {
+		return tx.Model(&models.ClinicianAssignment{}).Where("start_date IS NULL").UpdateColumn("start_date", gorm.Expr("created_at")).Error
+	}},
+	// Readings stored before sources were tracked default to manual entry,
+	// apart from those pushed by a device.
+	{"vital_device_sources", func(tx *gorm.DB) error {
+		return tx.Exec("UPDATE vitals SET source_type = devices.source_type FROM devices WHERE vitals.device_id = devices.id AND vitals.source_type = ?", models.SourceManual).Error
+	}},
+}
+
+// runMigrations applies the migrations not yet applied, each in a
+// transaction with the record of it.
+func runMigrations(db *gorm.DB) error {
+	for _, migration := range migrations {
+		tx := db.Begin()
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockKey).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to lock migrations: %v", err)
+		}
+
+		var applied int
+		if err := tx.Model(&models.SchemaMigration{}).Where("name = ?", migration.Name).Count(&applied).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to check migration %s: %v", migration.Name, err)
+		}
+		if applied > 0 {
+			tx.Rollback()
+			continue
+		}
+
+		if err := migration.Apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %s: %v", migration.Name, err)
+		}
+		if err := tx.Create(&models.SchemaMigration{Name: migration.Name, AppliedAt: time.Now()}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %s: %v", migration.Name, err)
+		}
+		if err := tx.Commit().Error; err != nil {
+			return fmt.Errorf("failed to apply migration %s: %v", migration.Name, err)
+		}
+		logrus.Infof("Applied migration %s", migration.Name)
+	}
+	return nil
+}
+
+// defaultVitalTypes are the vital types the system shipped with before the
+// catalog was stored in the database.
+var defaultVitalTypes = []models.VitalType{
+	{VitalID: "HeartRate", Name: "Heart rate", Unit: "bpm", MinValue: 20, MaxValue: 300, NormalLow: floatPtr(60), NormalHigh: floatPtr(100), Precision: 0, Active: true, LoincCode: "8867-4"},
+	{VitalID: "Temperature", Name: "Body temperature", Unit: "°C", MinValue: 25, MaxValue: 45, NormalLow: floatPtr(36.1), NormalHigh: floatPtr(37.8), Precision: 1, Active: true, LoincCode: "8310-5"},
+	{VitalID: "BloodPressure", Name: "Blood pressure", Active: true, LoincCode: "85354-9", Components: []models.VitalComponent{
+		{Name: "systolic", Unit: "mmHg", MinValue: 40, MaxValue: 300, NormalLow: floatPtr(90), NormalHigh: floatPtr(140), LoincCode: "8480-6"},
+		{Name: "diastolic", Unit: "mmHg", MinValue: 20, MaxValue: 200, NormalLow: floatPtr(60), NormalHigh: floatPtr(90), LoincCode: "8462-4"},
+	}},
+	{VitalID: "PulseOximetry", Name: "Pulse oximetry", Active: true, LoincCode: "59408-5", Components: []models.VitalComponent{
+		{Name: "spo2", Unit: "%", MinValue: 50, MaxValue: 100, NormalLow: floatPtr(95), LoincCode: "59408-5"},
+		{Name: "pulse", Unit: "bpm", MinValue: 20, MaxValue: 300, NormalLow: floatPtr(60), NormalHigh: floatPtr(100), LoincCode: "8889-8"},
+	}},
+}
+
+// seedVitalTypes inserts the default vital types that are missing, leaving
+// any definitions already edited through the API untouched apart from adding
+// LOINC codes and normal ranges to types seeded before they were tracked.
+func seedVitalTypes(db *gorm.DB) error {
+	for _, defaults := range defaultVitalTypes {
+		vitalType := defaults
+		err := db.Where(models.VitalType{VitalID: vitalType.VitalID}).FirstOrCreate(&vitalType).Error
+		if err != nil {
+			return fmt.Errorf("failed to seed vital type %s: %v", vitalType.VitalID, err)
+		}
+
+		err = db.Model(&models.VitalType{}).Where("id = ? AND (loinc_code IS NULL OR loinc_code = '')", vitalType.ID).
+			Update("loinc_code", defaults.LoincCode).Error
+		if err != nil {
+			return fmt.Errorf("failed to seed LOINC code of %s: %v", vitalType.VitalID, err)
+		}
+		err = db.Model(&models.VitalType{}).Where("id = ? AND normal_low IS NULL AND normal_high IS NULL", vitalType.ID).
+			Updates(map[string]interface{}{"normal_low": defaults.NormalLow, "normal_high": defaults.NormalHigh}).Error
+		if err != nil {
+			return fmt.Errorf("failed to seed normal range of %s: %v", vitalType.VitalID, err)
+		}
+		for _, component := range defaults.Components {
+			err = db.Model(&models.VitalComponent{}).
+				Where("vital_type_id = ? AND name = ? AND (loinc_code IS NULL OR loinc_code = '')", vitalType.ID, component.Name).
+				Update("loinc_code", component.LoincCode).Error
+			if err != nil {
+				return fmt.Errorf("failed to seed LOINC code of %s %s: %v", vitalType.VitalID, component.Name, err)
+			}
+			err = db.Model(&models.VitalComponent{}).
+				Where("vital_type_id = ? AND name = ? AND normal_low IS NULL AND normal_high IS NULL", vitalType.ID, component.Name).
+				Updates(map[string]interface{}{"normal_low": component.NormalLow, "normal_high": component.NormalHigh}).Error
+			if err != nil {
+				return fmt.Errorf("failed to seed normal range of %s %s: %v", vitalType.VitalID, component.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
+
+// patientPermissions are what patients may do with their own records, and
+// clinicians with those of the patients assigned to them.
+var patientPermissions = []string{
+	models.PermReadUsers, models.PermUpdateUsers,
+	models.PermReadVitals, models.PermWriteVitals, models.PermIngestVitals, models.PermReadVitalTypes,
+	models.PermReadInsights, models.PermReadPopulation, models.PermReadAlerts,
+}
+
+// defaultRoles are the roles every deployment has, with their permissions.
+// Admins manage users and the catalog but do not read anyone's vitals.
+var defaultRoles = []struct {
+	Name        string
+	Description string
+	Permissions []string
+}{
+	{models.RolePatient, "Sees and records their own vitals", patientPermissions},
+	{models.RoleClinician, "Sees and records the vitals of the patients assigned to them and handles their alerts", append([]string{models.PermAccessAssigned, models.PermManageAlerts}, patientPermissions...)},
+	{models.RoleAdmin, "Manages users, devices, vital types, global alert rules and the audit trail", []string{
+		models.PermReadUsers, models.PermUpdateUsers, models.PermManageUsers, models.PermAccessAll,
+		models.PermReadVitalTypes, models.PermManageVitalTypes,
+		models.PermReadAudit, models.PermReadDeadLetters, models.PermManageDevices, models.PermManageAlertRules,
+	}},
+}
+
+// seedRoles inserts the default roles and gives them any of their default
+// permissions they lack.
+func seedRoles(db *gorm.DB) error {
+	for _, defaults := range defaultRoles {
+		role := models.Role{Name: defaults.Name, Description: defaults.Description}
+		if err := db.Where(models.Role{Name: role.Name}).FirstOrCreate(&role).Error; err != nil {
+			return fmt.Errorf("failed to seed role %s: %v", defaults.Name, err)
+		}
+
+		for _, name := range defaults.Permissions {
+			permission := models.Permission{Name: name}
+			if err := db.Where(permission).FirstOrCreate(&permission).Error; err != nil {
+				return fmt.Errorf("failed to seed permission %s: %v", name, err)
+			}
+			if err := db.Model(&role).Association("Permissions").Append(&permission).Error; err != nil {
+				return fmt.Errorf("failed to grant %s to role %s: %v", name, defaults.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// protectAppendOnly installs triggers that reject updates and deletes of the
+// rows of tables, so that entries can only be appended even by clients that
+// bypass the API.
+func protectAppendOnly(db *gorm.DB, tables ...string) error {
+	err := db.Exec(`CREATE OR REPLACE FUNCTION reject_append_only_change() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql`).Error
+	if err != nil {
+		return fmt.Errorf("failed to create append-only trigger function: %v", err)
+	}
+
+	for _, table := range tables {
+		trigger := table + "_append_only"
+		if err := db.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", trigger, table)).Error; err != nil {
+			return fmt.Errorf("failed to protect %s: %v", table, err)
+		}
+		err := db.Exec(fmt.Sprintf("CREATE TRIGGER %s BEFORE UPDATE OR DELETE OR TRUNCATE ON %s FOR EACH STATEMENT EXECUTE PROCEDURE reject_append_only_change()", trigger, table)).Error
+		if err != nil {
+			return fmt.Errorf("failed to protect %s: %v", table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"fmt"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// CreateAlertRuleHandler adds an alert rule for the patient named by the
+// :username path parameter or, on /alert-rules, a global rule for everyone.
+func CreateAlertRuleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request models.AlertRuleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		patient := c.Param("username")
+		if patient == "" {
+			if !authorize(c, models.PermManageAlertRules) {
+				return
+			}
+		} else {
+			var err error
+			if patient, err = actingOn(c, db, models.PermManageAlerts, patient); err != nil {
+				forbid(c, err)
+				return
+			}
+		}
+
+		principal, _ := currentPrincipal(c)
+		rule, err := app.CreateAlertRule(db, patient, request, principal.Username)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to create alert rule: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "success",
+			"message": fmt.Sprintf("Alert rule %s created.", rule.Name),
+			"data":    rule,
+		})
+	}
+}
+
+// GetAlertRulesHandler lists the global alert rules or, with a :username
+// path parameter, the rules that apply to the patient: their own followed
+// by the global ones.
+func GetAlertRulesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		patient := c.Param("username")
+		if patient == "" {
+			if !authorize(c, models.PermManageAlertRules) {
+				return
+			}
+		} else {
+			var err error
+			if patient, err = actingOn(c, db, models.PermReadAlerts, patient); err != nil {
+				forbid(c, err)
+				return
+			}
+		}
+
+		rules, err := app.GetAlertRules(db, patient)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get alert rules: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": rules})
+	}
+}
+
+func UpdateAlertRuleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := pathID(c, "alert rule")
+		if !ok {
+			return
+		}
+
+		var request models.AlertRuleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		if !authorizeAlertRule(c, db, id) {
+			return
+		}
+
+		rule, err := app.UpdateAlertRule(db, id, request)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to update alert rule: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": fmt.Sprintf("Alert rule %d updated.", id),
+			"data":    rule,
+		})
+	}
+}
+
+// DeleteAlertRuleHandler deletes an alert rule. The alerts it raised are
+// kept.
+func DeleteAlertRuleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := pathID(c, "alert rule")
+		if !ok {
+			return
+		}
+		if !authorizeAlertRule(c, db, id) {
+			return
+		}
+
+		if err := app.DeleteAlertRule(db, id); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to delete alert rule: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": fmt.Sprintf("Alert rule %d deleted.", id)})
+	}
+}
+
+// authorizeAlertRule checks that the caller may change the alert rule id:
+// a global rule needs PermManageAlertRules, a patient's rule PermManageAlerts
+// over the patient. It responds with an error and returns false otherwise.
+func authorizeAlertRule(c *gin.Context, db *gorm.DB, id uint) bool {
+	rule, err := app.GetAlertRule(db, id)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get alert rule: %v", err)})
+		return false
+	}
+	if rule.Patient == "" {
+		return authorize(c, models.PermManageAlertRules)
+	}
+	if _, err := actingOn(c, db, models.PermManageAlerts, rule.Patient); err != nil {
+		forbid(c, err)
+		return false
+	}
+	return true
+}
+
+// GetAlertsHandler lists alerts, newest first: those of the patient named
+// by the :username path parameter or, on /alerts, of every patient the
+// caller may access. The status and severity query parameters filter the
+// alerts, and before_id continues from the next_before_id of a previous
+// page.
+func GetAlertsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := models.AlertQuery{
+			Status:   c.Query("status"),
+			Severity: c.Query("severity"),
+		}
+
+		if username := c.Param("username"); username != "" {
+			patient, err := actingOn(c, db, models.PermReadAlerts, username)
+			if err != nil {
+				forbid(c, err)
+				return
+			}
+			query.Patients = []string{patient}
+		} else {
+			if !authorize(c, models.PermReadAlerts) {
+				return
+			}
+			principal, _ := currentPrincipal(c)
+			patients, err := app.AccessiblePatients(db, principal)
+			if err != nil {
+				c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get alerts: %v", err)})
+				return
+			}
+			query.Patients = patients
+		}
+
+		if beforeID := c.Query("before_id"); beforeID != "" {
+			id, err := strconv.ParseUint(beforeID, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: invalid before_id"})
+				return
+			}
+			query.BeforeID = uint(id)
+		}
+		if limit := c.Query("limit"); limit != "" {
+			var err error
+			if query.Limit, err = strconv.Atoi(limit); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: invalid limit"})
+				return
+			}
+		}
+
+		alerts, err := app.GetAlerts(db, query)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get alerts: %v", err)})
+			return
+		}
+
+		response := gin.H{"status": "success", "data": alerts}
+		if len(alerts) > 0 {
+			response["next_before_id"] = alerts[len(alerts)-1].ID
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// AcknowledgeAlertHandler marks an open alert as seen by the caller, with an
+// optional note.
+func AcknowledgeAlertHandler(db *gorm.DB) gin.HandlerFunc {
+	return alertActionHandler(db, "acknowledge", app.AcknowledgeAlert)
+}
+
+// ResolveAlertHandler closes an alert, with an optional note. Once
+// resolved, the rule that raised it may raise a new alert for the patient.
+func ResolveAlertHandler(db *gorm.DB) gin.HandlerFunc {
+	return alertActionHandler(db, "resolve", app.ResolveAlert)
+}
+
+// alertActionHandler applies action, named verb, to the alert named by the
+// :id path parameter on behalf of a caller who may manage the alerts of its
+// patient.
+func alertActionHandler(db *gorm.DB, verb string, action func(*gorm.DB, uint, string, string) (models.Alert, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := pathID(c, "alert")
+		if !ok {
+			return
+		}
+
+		var request models.AlertActionRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+				return
+			}
+		}
+
+		alert, err := app.GetAlert(db, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to %s alert: %v", verb, err)})
+			return
+		}
+		if _, err := actingOn(c, db, models.PermManageAlerts, alert.Patient); err != nil {
+			forbid(c, err)
+			return
+		}
+
+		principal, _ := currentPrincipal(c)
+		alert, err = action(db, id, principal.Username, request.Note)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to %s alert: %v", verb, err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": fmt.Sprintf("Alert %d is %s.", id, alert.Status),
+			"data":    alert,
+		})
+	}
+}
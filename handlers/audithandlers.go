@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// auditPatientKey is the context key under which handlers name the patient
+// a request concerns when it is not in the path or query string.
+const auditPatientKey = "audit.patient"
+
+// maxRequestIDLength bounds the length of a request ID supplied by a client
+const maxRequestIDLength = 64
+
+// requestIDPattern is what a request ID supplied by a client may contain
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// Audit records every request in the audit log once it has been handled,
+// including requests that fail or panic. Each request is given the ID in its
+// X-Request-ID header, or a new one if it has none or an ID that is too long
+// or holds other than letters, digits and ._:- characters. The ID is echoed
+// in the response.
+func Audit(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if len(requestID) > maxRequestIDLength || !requestIDPattern.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		c.Header("X-Request-ID", requestID)
+
+		defer func() {
+			status := c.Writer.Status()
+			recovered := recover()
+			if recovered != nil {
+				status = http.StatusInternalServerError
+			}
+			recordAudit(db, c, requestID, status)
+			if recovered != nil {
+				panic(recovered)
+			}
+		}()
+		c.Next()
+	}
+}
+
+func recordAudit(db *gorm.DB, c *gin.Context, requestID string, status int) {
+	resource := c.FullPath()
+	if resource == "" {
+		resource = c.Request.URL.Path
+	}
+
+	entry := models.AuditEntry{
+		Time:      time.Now(),
+		Actor:     auditActor(c),
+		Patient:   auditPatient(c),
+		Action:    auditAction(c.Request.Method),
+		Resource:  c.Request.Method + " " + resource,
+		RequestID: requestID,
+		ClientIP:  c.ClientIP(),
+		Status:    status,
+		Outcome:   auditOutcome(status),
+	}
+	if _, err := app.AppendAuditEntry(db, entry); err != nil {
+		logrus.WithFields(logrus.Fields{"request_id": requestID, "resource": entry.Resource}).Errorf("Failed to audit request: %v", err)
+	}
+}
+
+// setAuditPatient names the patient a request concerns, for handlers that
+// read the username from the request body.
+func setAuditPatient(c *gin.Context, username string) {
+	c.Set(auditPatientKey, username)
+}
+
+// auditPatient returns the patient named by the handler or, failing that,
+// by the username path or query parameter.
+func auditPatient(c *gin.Context) string {
+	if patient := c.GetString(auditPatientKey); patient != "" {
+		return patient
+	}
+	return paramOrQuery(c, "username")
+}
+
+// auditActor names the authenticated caller
+func auditActor(c *gin.Context) string {
+	if principal, ok := currentPrincipal(c); ok {
+		return principal.Username
+	}
+	return "anonymous"
+}
+
+func auditAction(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return "read"
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut, http.MethodPatch:
+		return "update"
+	case http.MethodDelete:
+		return "delete"
+	default:
+		return strings.ToLower(method)
+	}
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "denied"
+	case status >= http.StatusBadRequest:
+		return "failure"
+	default:
+		return "success"
+	}
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// GetAuditEntriesHandler lists audit entries, newest first. The actor,
+// patient, action, outcome and request_id query parameters filter the
+// entries, from and to bound their time, and before_id continues from the
+// next_before_id of a previous page.
+func GetAuditEntriesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermReadAudit) {
+			return
+		}
+
+		query := models.AuditQuery{
+			Actor:     c.Query("actor"),
+			Patient:   c.Query("patient"),
+			Action:    c.Query("action"),
+			Outcome:   c.Query("outcome"),
+			RequestID: c.Query("request_id"),
+		}
+
+		var err error
+		if query.From, err = optionalTime(c.Query("from")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: invalid from timestamp format"})
+			return
+		}
+		if query.To, err = optionalTime(c.Query("to")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: invalid to timestamp format"})
+			return
+		}
+		if beforeID := c.Query("before_id"); beforeID != "" {
+			id, err := strconv.ParseUint(beforeID, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: invalid before_id"})
+				return
+			}
+			query.BeforeID = uint(id)
+		}
+		if limit := c.Query("limit"); limit != "" {
+			if query.Limit, err = strconv.Atoi(limit); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: invalid limit"})
+				return
+			}
+		}
+
+		entries, err := app.GetAuditEntries(db, query)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get audit entries: %v", err)})
+			return
+		}
+
+		response := gin.H{"status": "success", "data": entries}
+		if len(entries) > 0 {
+			response["next_before_id"] = entries[len(entries)-1].ID
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"fmt"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// principalKey is the context key of the authenticated caller
+const principalKey = "auth.principal"
+
+// Authenticate requires a valid bearer access token, or the API key of a
+// registered device, and attaches the principal it identifies to the context
+// for the handlers that follow.
+func Authenticate(db *gorm.DB, settings app.AuthSettings) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if key := apiKey(c); key != "" {
+			principal, err := app.AuthenticateDevice(db, key)
+			if err != nil {
+				c.AbortWithStatusJSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Authentication failed: %v", err)})
+				return
+			}
+			c.Set(principalKey, principal)
+			c.Next()
+			return
+		}
+
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		if header == "" || token == header {
+			c.Header("WWW-Authenticate", `Bearer realm="medical-vitals-management-system"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "error", "message": "Authentication required"})
+			return
+		}
+
+		principal, err := app.ParseAccessToken(db, settings, token)
+		if err != nil {
+			status := errorStatus(err)
+			if status == http.StatusUnauthorized {
+				c.Header("WWW-Authenticate", `Bearer realm="medical-vitals-management-system", error="invalid_token"`)
+			}
+			c.AbortWithStatusJSON(status, gin.H{"status": "error", "message": fmt.Sprintf("Authentication failed: %v", err)})
+			return
+		}
+
+		c.Set(principalKey, principal)
+		c.Next()
+	}
+}
+
+// apiKey returns the device API key of the request, sent in the X-API-Key
+// header or as an ApiKey authorization, if any.
+func apiKey(c *gin.Context) string {
+	if key := strings.TrimSpace(c.GetHeader("X-API-Key")); key != "" {
+		return key
+	}
+	header := c.GetHeader("Authorization")
+	if key := strings.TrimPrefix(header, "ApiKey "); key != header {
+		return strings.TrimSpace(key)
+	}
+	return ""
+}
+
+// currentPrincipal returns the caller attached by Authenticate, if any
+func currentPrincipal(c *gin.Context) (models.Principal, bool) {
+	value, ok := c.Get(principalKey)
+	if !ok {
+		return models.Principal{}, false
+	}
+	principal, ok := value.(models.Principal)
+	return principal, ok
+}
+
+// actingOn resolves the user whose records the request concerns, named by
+// username or, if that is empty, the caller, and checks that the caller has
+// permission over them. The user is recorded as the patient of the audit
+// entry.
+func actingOn(c *gin.Context, db *gorm.DB, permission, username string) (string, error) {
+	principal, _ := currentPrincipal(c)
+	username, err := app.AuthorizePatient(db, principal, permission, username)
+	setAuditPatient(c, username)
+	return username, err
+}
+
+// authorize checks that the caller's role grants permission, responding with
+// 403 and returning false if it does not.
+func authorize(c *gin.Context, permission string) bool {
+	principal, _ := currentPrincipal(c)
+	if err := app.Authorize(principal, permission); err != nil {
+		forbid(c, err)
+		return false
+	}
+	return true
+}
+
+func LoginHandler(db *gorm.DB, settings app.AuthSettings) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request models.LoginRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+		setAuditPatient(c, request.Username)
+
+		tokens, err := app.Login(db, settings, request)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Login failed: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": tokens})
+	}
+}
+
+func RefreshHandler(db *gorm.DB, settings app.AuthSettings) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request models.RefreshRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		tokens, err := app.RefreshTokens(db, settings, request.RefreshToken)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to refresh tokens: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": tokens})
+	}
+}
+
+// LogoutHandler revokes the caller's access token, and the refresh token in
+// the body or, with "all": true, every refresh token of the caller.
+func LogoutHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request models.LogoutRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+				return
+			}
+		}
+
+		principal, _ := currentPrincipal(c)
+		if err := app.Logout(db, principal, request); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to log out: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Logged out."})
+	}
+}
+
+func ChangePasswordHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request models.ChangePasswordRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		principal, _ := currentPrincipal(c)
+		if err := app.ChangePassword(db, principal.Username, request); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to change password: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Password changed."})
+	}
+}
+
+// ResetPasswordHandler sets the password of the user named by the :username
+// path parameter, such as one created before logins were required, and
+// signs them out everywhere.
+func ResetPasswordHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request models.ResetPasswordRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		username, err := actingOn(c, db, models.PermManageUsers, c.Param("username"))
+		if err != nil {
+			forbid(c, err)
+			return
+		}
+
+		if err := app.ResetPassword(db, username, request.Password); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to reset password: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": fmt.Sprintf("Password of %s reset.", username)})
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"fmt"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+func CreateCareTeamHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageUsers) {
+			return
+		}
+
+		var request models.CareTeamRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		if err := app.CreateCareTeam(db, models.CareTeam{Name: request.Name, Description: request.Description}); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to create care team: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"status": "success", "message": fmt.Sprintf("Care team %s created.", request.Name)})
+	}
+}
+
+func GetCareTeamsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermReadUsers) {
+			return
+		}
+
+		teams, err := app.GetCareTeams(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to get care teams: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": teams})
+	}
+}
+
+// GetAssignmentsHandler lists the clinicians a patient has been assigned,
+// most recent first, or only the current ones with active=true.
+func GetAssignmentsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, err := actingOn(c, db, models.PermReadUsers, c.Param("username"))
+		if err != nil {
+			forbid(c, err)
+			return
+		}
+
+		exists, err := app.UserExists(db, username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
+			return
+		} else if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "User not found"})
+			return
+		}
+
+		assignments, err := app.GetAssignments(db, username, c.Query("active") == "true")
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get clinician assignments: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": assignments})
+	}
+}
+
+func AssignClinicianHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request models.AssignmentRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		username, err := actingOn(c, db, models.PermManageUsers, c.Param("username"))
+		if err != nil {
+			forbid(c, err)
+			return
+		}
+
+		exists, err := app.UserExists(db, username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
+			return
+		} else if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "User not found"})
+			return
+		}
+
+		principal, _ := currentPrincipal(c)
+		assignment, err := app.AssignClinician(db, username, request, principal.Username)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to assign clinician: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "success",
+			"message": fmt.Sprintf("%s assigned to %s.", request.Clinician, username),
+			"data":    assignment,
+		})
+	}
+}
+
+// UnassignClinicianHandler ends a clinician's care of a patient now, or at
+// the end_date query parameter.
+func UnassignClinicianHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, err := actingOn(c, db, models.PermManageUsers, c.Param("username"))
+		if err != nil {
+			forbid(c, err)
+			return
+		}
+
+		endDate := time.Now()
+		if value := c.Query("end_date"); value != "" {
+			if endDate, err = time.Parse(time.RFC3339, value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: invalid end_date format"})
+				return
+			}
+		}
+
+		clinician := c.Param("clinician")
+		if err := app.UnassignClinician(db, username, clinician, endDate); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to unassign clinician: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": fmt.Sprintf("%s unassigned from %s.", clinician, username)})
+	}
+}
+
+// GetClinicianPanelHandler lists the patients in a clinician's care with
+// their latest vitals, flagging those outside the normal range.
+func GetClinicianPanelHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clinician, err := actingOn(c, db, models.PermReadVitals, c.Param("username"))
+		if err != nil {
+			forbid(c, err)
+			return
+		}
+		if !authorize(c, models.PermAccessAssigned) {
+			return
+		}
+
+		panel, err := app.GetClinicianPanel(db, clinician)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get clinician panel: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": panel})
+	}
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// ImportVitalsCSVHandler imports vitals from a CSV file, uploaded as the
+// "file" field of a multipart form or sent as the request body. The layout is
+// described by query parameters: columns[field]=header maps a column to each
+// field, vital_id applies to rows without a vital_id column, and
+// timestamp_format and timezone control how timestamps are read. With
+// dry_run=true the rows are only validated.
+func ImportVitalsCSVHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		options := models.CSVImportOptions{
+			Username:        c.Param("username"),
+			VitalID:         c.Query("vital_id"),
+			Columns:         c.QueryMap("columns"),
+			TimestampFormat: c.Query("timestamp_format"),
+			Timezone:        c.Query("timezone"),
+			DryRun:          c.Query("dry_run") == "true",
+		}
+
+		// Rows naming anyone but this user are rejected.
+		var err error
+		if options.Username, err = actingOn(c, db, models.PermWriteVitals, options.Username); err != nil {
+			forbid(c, err)
+			return
+		}
+		exists, err := app.UserExists(db, options.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
+			return
+		} else if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "User not found"})
+			return
+		}
+
+		var body io.Reader = c.Request.Body
+		if c.ContentType() == "multipart/form-data" {
+			file, err := c.FormFile("file")
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+				return
+			}
+			upload, err := file.Open()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to read upload: %v", err)})
+				return
+			}
+			defer upload.Close()
+			body = upload
+		}
+
+		report, err := app.ImportVitalsCSV(db, body, options)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to import vitals: %v", err)})
+			return
+		}
+
+		message := fmt.Sprintf("%d of %d rows imported.", report.Accepted, len(report.Results))
+		if options.DryRun {
+			message = fmt.Sprintf("Dry run: %d of %d rows are valid.", report.Accepted, len(report.Results))
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": message, "data": report})
+	}
+}
+
+// ExportVitalsCSVHandler streams a user's vitals as CSV. It takes the same
+// query parameters as ListUserVitalsHandler, except that every page is
+// exported.
+func ExportVitalsCSVHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, err := vitalQueryFromParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		if query.Username, err = actingOn(c, db, models.PermReadVitals, query.Username); err != nil {
+			forbid(c, err)
+			return
+		}
+		exists, err := app.UserExists(db, query.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
+			return
+		} else if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "User not found"})
+			return
+		}
+
+		writer := &csvResponseWriter{c: c, filename: fmt.Sprintf("%s-vitals.csv", query.Username)}
+		if err := app.ExportVitalsCSV(db, query, c.QueryMap("units"), writer); err != nil {
+			if !writer.started {
+				c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to export vitals: %v", err)})
+				return
+			}
+			// The status has been sent, so the client can only see a truncated file.
+			logrus.Errorf("Failed to export vitals for %s: %v", query.Username, err)
+		}
+	}
+}
+
+// csvResponseWriter sends the CSV headers on the first write, so an error
+// before any data is ready can still be reported as JSON.
+type csvResponseWriter struct {
+	c        *gin.Context
+	filename string
+	started  bool
+}
+
+func (w *csvResponseWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.c.Header("Content-Type", "text/csv; charset=utf-8")
+		w.c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", w.filename))
+		w.c.Status(http.StatusOK)
+	}
+	return w.c.Writer.Write(p)
+}
+
+func (w *csvResponseWriter) Flush() {
+	if w.started {
+		w.c.Writer.Flush()
+	}
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"fmt"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// RegisterDeviceHandler registers a device and responds with its API key,
+// which is not shown again.
+func RegisterDeviceHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageDevices) {
+			return
+		}
+
+		var request models.DeviceRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		principal, _ := currentPrincipal(c)
+		key, err := app.RegisterDevice(db, request, principal.Username)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to register device: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "success",
+			"message": fmt.Sprintf("Device %s registered. Store the API key now; it cannot be shown again.", key.Device.Name),
+			"data":    key,
+		})
+	}
+}
+
+func GetDevicesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageDevices) {
+			return
+		}
+
+		devices, err := app.GetDevices(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to get devices: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": devices})
+	}
+}
+
+func GetDeviceHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageDevices) {
+			return
+		}
+		id, ok := pathID(c, "device")
+		if !ok {
+			return
+		}
+
+		device, err := app.GetDevice(db, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get device: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": device})
+	}
+}
+
+func UpdateDeviceHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageDevices) {
+			return
+		}
+		id, ok := pathID(c, "device")
+		if !ok {
+			return
+		}
+
+		var request models.DeviceRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		device, err := app.UpdateDevice(db, id, request)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to update device: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": fmt.Sprintf("Device %d updated.", id), "data": device})
+	}
+}
+
+// RotateDeviceKeyHandler issues a device a new API key, invalidating the old
+// one.
+func RotateDeviceKeyHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageDevices) {
+			return
+		}
+		id, ok := pathID(c, "device")
+		if !ok {
+			return
+		}
+
+		key, err := app.RotateDeviceKey(db, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to rotate device key: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": fmt.Sprintf("API key of device %d rotated. Store the new key now; it cannot be shown again.", id),
+			"data":    key,
+		})
+	}
+}
+
+func RevokeDeviceHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageDevices) {
+			return
+		}
+		id, ok := pathID(c, "device")
+		if !ok {
+			return
+		}
+
+		if err := app.RevokeDevice(db, id); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to revoke device: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": fmt.Sprintf("Device %d revoked.", id)})
+	}
+}
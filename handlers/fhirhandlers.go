@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"fmt"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const fhirContentType = "application/fhir+json; charset=utf-8"
+
+// SearchObservationsHandler searches a patient's Observations, returning a
+// searchset Bundle. It supports the patient (or subject), code, date, _sort
+// and _count parameters; further pages are linked from the Bundle.
+func SearchObservationsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		search := models.FHIRObservationSearch{
+			Patient: c.Query("patient"),
+			Codes:   c.QueryArray("code"),
+			Dates:   c.QueryArray("date"),
+			Sort:    c.Query("_sort"),
+			Cursor:  c.Query("_cursor"),
+		}
+		if search.Patient == "" {
+			search.Patient = c.Query("subject")
+		}
+		patient, err := actingOn(c, db, models.PermReadVitals, fhirPatientID(search.Patient))
+		if err != nil {
+			fhirError(c, errorStatus(err), err)
+			return
+		}
+		search.Patient = patient
+		if count := c.Query("_count"); count != "" {
+			if search.Count, err = strconv.Atoi(count); err != nil {
+				fhirError(c, http.StatusBadRequest, fmt.Errorf("invalid _count %q", count))
+				return
+			}
+		}
+
+		page, err := app.SearchObservations(db, search)
+		if err != nil {
+			fhirError(c, errorStatus(err), err)
+			return
+		}
+
+		base := fhirBaseURL(c)
+		bundle := models.FHIRBundle{
+			ResourceType: "Bundle",
+			Type:         "searchset",
+			Link:         []models.FHIRBundleLink{{Relation: "self", URL: base + "/Observation?" + c.Request.URL.RawQuery}},
+			Entry:        []models.FHIRBundleEntry{},
+		}
+		if page.HasMore {
+			next := c.Request.URL.Query()
+			next.Set("_cursor", page.NextCursor)
+			bundle.Link = append(bundle.Link, models.FHIRBundleLink{Relation: "next", URL: base + "/Observation?" + next.Encode()})
+		}
+		for _, observation := range page.Observations {
+			bundle.Entry = append(bundle.Entry, models.FHIRBundleEntry{
+				FullURL:  base + "/Observation/" + observation.ID,
+				Resource: observation,
+				Search:   &models.FHIRBundleSearch{Mode: "match"},
+			})
+		}
+
+		fhirJSON(c, http.StatusOK, bundle)
+	}
+}
+
+func GetObservationHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, _ := currentPrincipal(c)
+		if err := app.Authorize(principal, models.PermReadVitals); err != nil {
+			fhirError(c, errorStatus(err), err)
+			return
+		}
+
+		observation, err := app.GetObservation(db, c.Param("id"))
+		if err != nil {
+			fhirError(c, errorStatus(err), err)
+			return
+		}
+		var subject string
+		if observation.Subject != nil {
+			subject = fhirPatientID(observation.Subject.Reference)
+		}
+		if _, err := actingOn(c, db, models.PermReadVitals, subject); err != nil {
+			// Observations of patients the caller may not read are reported
+			// as missing, so that their IDs cannot be probed.
+			if app.IsForbiddenError(err) {
+				fhirError(c, http.StatusNotFound, fmt.Errorf("Observation/%s not found", c.Param("id")))
+				return
+			}
+			fhirError(c, errorStatus(err), err)
+			return
+		}
+
+		fhirJSON(c, http.StatusOK, observation)
+	}
+}
+
+// CreateObservationHandler records an Observation as a vital reading and
+// returns it as stored.
+func CreateObservationHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var observation models.FHIRObservation
+		if err := c.ShouldBindJSON(&observation); err != nil {
+			fhirError(c, http.StatusBadRequest, fmt.Errorf("invalid Observation: %v", err))
+			return
+		}
+		if observation.Subject != nil {
+			if _, err := actingOn(c, db, models.PermWriteVitals, fhirPatientID(observation.Subject.Reference)); err != nil {
+				fhirError(c, errorStatus(err), err)
+				return
+			}
+		}
+
+		created, err := app.CreateObservation(db, observation)
+		if err != nil {
+			fhirError(c, errorStatus(err), err)
+			return
+		}
+
+		c.Header("Location", fhirBaseURL(c)+"/Observation/"+created.ID)
+		fhirJSON(c, http.StatusCreated, created)
+	}
+}
+
+func GetPatientHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, err := actingOn(c, db, models.PermReadUsers, c.Param("id"))
+		if err != nil {
+			fhirError(c, errorStatus(err), err)
+			return
+		}
+		exists, err := app.UserExists(db, username)
+		if err != nil {
+			fhirError(c, http.StatusInternalServerError, err)
+			return
+		} else if !exists {
+			fhirError(c, http.StatusNotFound, fmt.Errorf("Patient/%s not found", username))
+			return
+		}
+
+		user, err := app.GetUser(db, username)
+		if err != nil {
+			fhirError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		fhirJSON(c, http.StatusOK, app.PatientFromUser(user))
+	}
+}
+
+func fhirJSON(c *gin.Context, status int, resource interface{}) {
+	c.Header("Content-Type", fhirContentType)
+	c.JSON(status, resource)
+}
+
+// fhirError reports err as an OperationOutcome
+func fhirError(c *gin.Context, status int, err error) {
+	code := "exception"
+	switch status {
+	case http.StatusBadRequest:
+		code = "invalid"
+	case http.StatusForbidden:
+		code = "forbidden"
+	case http.StatusNotFound:
+		code = "not-found"
+	}
+
+	fhirJSON(c, status, models.FHIROperationOutcome{
+		ResourceType: "OperationOutcome",
+		Issue:        []models.FHIROutcomeIssue{{Severity: "error", Code: code, Diagnostics: err.Error()}},
+	})
+}
+
+// fhirBaseURL is the absolute URL of the FHIR endpoint the request was made to
+func fhirBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if forwarded := c.GetHeader("X-Forwarded-Proto"); forwarded != "" {
+		scheme = forwarded
+	}
+	return (&url.URL{Scheme: scheme, Host: c.Request.Host, Path: "/fhir"}).String()
+}
+
+// fhirPatientID returns the username of a Patient reference
+func fhirPatientID(reference string) string {
+	return strings.TrimPrefix(reference, "Patient/")
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"fmt"
+	"medical-vitals-management-system/app"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// errorStatus maps an error returned by the app package to an HTTP status,
+// so rejected input is reported as a client error rather than a server one.
+func errorStatus(err error) int {
+	if app.IsValidationError(err) {
+		return http.StatusBadRequest
+	}
+	if app.IsPrivacyError(err) {
+		return http.StatusForbidden
+	}
+	if app.IsNotFoundError(err) {
+		return http.StatusNotFound
+	}
+	if app.IsAuthError(err) {
+		return http.StatusUnauthorized
+	}
+	if app.IsForbiddenError(err) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// Deprecated marks a legacy route, pointing clients at the route that
+// replaces it through the Deprecation and Link headers.
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		logrus.WithFields(logrus.Fields{"route": c.FullPath(), "successor": successor}).Warn("Deprecated route called")
+		c.Next()
+	}
+}
+
+// pathID parses the :id path parameter, responding with 400 and returning
+// false if it is not the ID of a resource.
+func pathID(c *gin.Context, resource string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: invalid %s id", resource)})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// paramOrQuery returns the path parameter key, falling back to the query
+// parameter of the same name on legacy routes that have no path parameter.
+func paramOrQuery(c *gin.Context, key string) string {
+	if value := c.Param(key); value != "" {
+		return value
+	}
+	return c.Query(key)
+}
+
+// paramOrBody reconciles a path parameter with the same field of the request
+// body. On routes without the parameter the body's value is used; otherwise
+// the body may omit the field but must not contradict the path.
+func paramOrBody(c *gin.Context, key, bodyValue string) (string, error) {
+	param := c.Param(key)
+	if param == "" {
+		return bodyValue, nil
+	}
+	if bodyValue != "" && bodyValue != param {
+		return "", fmt.Errorf("%s %q in the body does not match %q in the path", key, bodyValue, param)
+	}
+	return param, nil
+}
+
+// forbid writes the response to a request for records the caller may not
+// access.
+func forbid(c *gin.Context, err error) {
+	c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Access denied: %v", err)})
+}
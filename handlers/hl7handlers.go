@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"fmt"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// GetDeadLettersHandler lists the most recent HL7 messages that could not be
+// processed, newest first, up to the limit query parameter.
+func GetDeadLettersHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermReadDeadLetters) {
+			return
+		}
+
+		limit, _ := strconv.Atoi(c.Query("limit"))
+
+		deadLetters, err := app.GetDeadLetters(db, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to get dead letters: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": deadLetters})
+	}
+}
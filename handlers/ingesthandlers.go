@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// maxIngestReadings is the largest number of readings one bulk insert
+	// may carry.
+	maxIngestReadings = 10000
+	// maxIngestLine is the longest NDJSON line accepted, in bytes.
+	maxIngestLine = 1 << 20
+)
+
+// errTooManyReadings is returned when a bulk insert exceeds maxIngestReadings
+var errTooManyReadings = fmt.Errorf("at most %d readings may be inserted at once", maxIngestReadings)
+
+// ingestItem is one reading of a bulk insert, or the reason it could not be
+// parsed.
+type ingestItem struct {
+	line    int
+	request vitalRequest
+	err     error
+}
+
+// BulkCreateVitalsHandler inserts many readings in one request. The body is
+// either a JSON array of readings or NDJSON, one reading per line, which is
+// assumed for the application/x-ndjson content type or any body that does not
+// start with '['. Readings may omit the username, which is that of the caller,
+// and readings of patients the caller may not record vitals for are rejected.
+func BulkCreateVitalsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, _ := currentPrincipal(c)
+		if c.Param("username") == "" && principal.DeviceID != 0 {
+			// Devices name the patient of every reading, checked below.
+			if !authorize(c, models.PermIngestVitals) {
+				return
+			}
+		} else if _, err := actingOn(c, db, models.PermIngestVitals, c.Param("username")); err != nil {
+			forbid(c, err)
+			return
+		}
+		// Readings of the same user, or vital, share the outcome of the policy check.
+		checked := make(map[string]error)
+		checkedTypes := make(map[string]error)
+
+		items, err := parseIngestBody(c.Request.Body, c.ContentType())
+		if err == errTooManyReadings {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"status": "error", "message": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		results := make([]models.IngestResult, len(items))
+		var readings []models.VitalReading
+		var positions []int
+		for i, item := range items {
+			if item.err == nil {
+				item.request.Username, item.err = paramOrBody(c, "username", item.request.Username)
+			}
+			if item.err == nil {
+				if item.request.Username == "" {
+					item.request.Username = principal.Username
+				}
+				err, ok := checked[item.request.Username]
+				if !ok {
+					_, err = app.AuthorizePatient(db, principal, models.PermIngestVitals, item.request.Username)
+					checked[item.request.Username] = err
+				}
+				item.err = err
+			}
+			if item.err == nil {
+				err, ok := checkedTypes[item.request.VitalID]
+				if !ok {
+					err = app.AuthorizeVitalType(db, principal, item.request.VitalID)
+					checkedTypes[item.request.VitalID] = err
+				}
+				item.err = err
+			}
+			var reading models.VitalReading
+			if item.err == nil {
+				reading, item.err = item.request.reading()
+			}
+			if item.err != nil {
+				results[i] = app.RejectedIngest(i, item.err.Error())
+				continue
+			}
+			setDeviceSource(&reading, principal)
+			readings = append(readings, reading)
+			positions = append(positions, i)
+		}
+
+		created, err := app.CreateVitals(db, readings)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to insert vitals: %v", err)})
+			return
+		}
+		for j, result := range created {
+			result.Index = positions[j]
+			results[positions[j]] = result
+		}
+		for i := range results {
+			results[i].Line = items[i].line
+		}
+
+		report := app.SummarizeIngest(results)
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": fmt.Sprintf("%d of %d readings inserted.", report.Accepted, len(results)),
+			"data":    report,
+		})
+	}
+}
+
+// parseIngestBody reads the readings of a bulk insert. A malformed NDJSON
+// line only rejects that reading, but a malformed JSON array cannot be read
+// past and fails the whole request.
+func parseIngestBody(body io.Reader, contentType string) ([]ingestItem, error) {
+	reader := bufio.NewReader(body)
+	if !strings.Contains(contentType, "ndjson") && startsWithArray(reader) {
+		return parseJSONArray(reader)
+	}
+	return parseNDJSON(reader)
+}
+
+func startsWithArray(reader *bufio.Reader) bool {
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			return false
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			return b[0] == '['
+		}
+		reader.ReadByte()
+	}
+}
+
+func parseJSONArray(reader io.Reader) ([]ingestItem, error) {
+	decoder := json.NewDecoder(reader)
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	var items []ingestItem
+	for decoder.More() {
+		if len(items) == maxIngestReadings {
+			return nil, errTooManyReadings
+		}
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		var item ingestItem
+		item.err = json.Unmarshal(raw, &item.request)
+		items = append(items, item)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func parseNDJSON(reader io.Reader) ([]ingestItem, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxIngestLine)
+
+	var items []ingestItem
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if len(items) == maxIngestReadings {
+			return nil, errTooManyReadings
+		}
+		item := ingestItem{line: line}
+		item.err = json.Unmarshal(text, &item.request)
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
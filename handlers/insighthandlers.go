@@ -18,6 +18,11 @@ func AggregateVitalsHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		var err error
+		if aggregateRequest.Username, err = actingOn(c, db, models.PermReadInsights, aggregateRequest.Username); err != nil {
+			forbid(c, err)
+			return
+		}
 		userExists, err := app.UserExists(db, aggregateRequest.Username)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
@@ -29,19 +34,16 @@ func AggregateVitalsHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		aggregatedValues, err := app.AggregateVitals(db, aggregateRequest)
+		aggregateData, err := app.AggregateVitals(db, aggregateRequest)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to calculate aggregate values: %v", err)})
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to calculate aggregate values: %v", err)})
 			return
 		}
 
 		response := models.AggregateResponse{
-			Status:  "success",
-			Message: "Aggregate fetched successfully",
-			Data: models.AggregateData{
-				Username:   aggregateRequest.Username,
-				Aggregates: aggregatedValues,
-			},
+			Status:         "success",
+			Message:        "Aggregate fetched successfully",
+			Data:           aggregateData,
 			StartTimestamp: aggregateRequest.StartTimestamp,
 			EndTimestamp:   aggregateRequest.EndTimestamp,
 		}
@@ -58,6 +60,11 @@ func PopulationInsightHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		var err error
+		if insightRequest.Username, err = actingOn(c, db, models.PermReadPopulation, insightRequest.Username); err != nil {
+			forbid(c, err)
+			return
+		}
 		userExists, err := app.UserExists(db, insightRequest.Username)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
@@ -69,21 +76,60 @@ func PopulationInsightHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		insight, err := app.GetPopulationInsight(db, insightRequest.Username, insightRequest.VitalID, insightRequest.StartTimestamp, insightRequest.EndTimestamp)
+		insightData, err := app.GetPopulationInsight(db, insightRequest)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to calculate population insight: %v", err)})
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to calculate population insight: %v", err)})
 			return
 		}
 
 		response := models.PopulationInsightResponse{
 			Status:  "success",
 			Message: "Population insight fetched successfully",
-			Data: models.PopulationInsightData{
-				Username:       insightRequest.Username,
-				VitalID:        insightRequest.VitalID,
-				StartTimestamp: insightRequest.StartTimestamp,
-				EndTimestamp:   insightRequest.EndTimestamp,
-				Insight:        insight,
+			Data:    insightData,
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func BatchPopulationInsightHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var batchRequest models.BatchPopulationInsightRequest
+		if err := c.ShouldBindJSON(&batchRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		var err error
+		if batchRequest.Username, err = actingOn(c, db, models.PermReadPopulation, batchRequest.Username); err != nil {
+			forbid(c, err)
+			return
+		}
+		userExists, err := app.UserExists(db, batchRequest.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
+			return
+		}
+
+		if !userExists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": fmt.Sprintf("User not found: %s", batchRequest.Username)})
+			return
+		}
+
+		insights, err := app.CalculatePopulationInsights(db, batchRequest)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to calculate population insights: %v", err)})
+			return
+		}
+
+		response := models.BatchPopulationInsightResponse{
+			Status:  "success",
+			Message: "Population insights fetched successfully",
+			Data: models.BatchPopulationInsightData{
+				Username:       batchRequest.Username,
+				StartTimestamp: batchRequest.StartTimestamp,
+				EndTimestamp:   batchRequest.EndTimestamp,
+				Insights:       insights,
 			},
 		}
 
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"fmt"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// GetVitalHistoryHandler lists the revisions of the reading of a user's vital
+// at the timestamp query parameter, oldest first.
+func GetVitalHistoryHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, err := actingOn(c, db, models.PermReadVitals, c.Param("username"))
+		if err != nil {
+			forbid(c, err)
+			return
+		}
+		timestamp, err := time.Parse(time.RFC3339, c.Query("timestamp"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: timestamp is required in RFC 3339 format"})
+			return
+		}
+
+		exists, err := app.UserExists(db, username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
+			return
+		} else if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "User not found"})
+			return
+		}
+
+		revisions, err := app.GetVitalHistory(db, username, c.Param("vital_id"), timestamp)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get vital history: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": revisions})
+	}
+}
+
+// GetVitalsAsOfHandler lists a user's vitals as they were stored at the as_of
+// query parameter. Repeated vital_id parameters and the from and to
+// parameters narrow the readings, and units are requested as
+// units[VitalID]=unit, as when listing current vitals.
+func GetVitalsAsOfHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := models.VitalAsOfQuery{Username: c.Param("username"), VitalIDs: c.QueryArray("vital_id")}
+
+		asOf, err := time.Parse(time.RFC3339, c.Query("as_of"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: as_of is required in RFC 3339 format"})
+			return
+		}
+		query.AsOf = asOf
+		if query.Username, err = actingOn(c, db, models.PermReadVitals, query.Username); err != nil {
+			forbid(c, err)
+			return
+		}
+		if query.From, err = optionalTime(c.Query("from")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: invalid from timestamp format"})
+			return
+		}
+		if query.To, err = optionalTime(c.Query("to")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: invalid to timestamp format"})
+			return
+		}
+
+		exists, err := app.UserExists(db, query.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
+			return
+		} else if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "User not found"})
+			return
+		}
+
+		vitals, err := app.GetVitalsAsOf(db, query)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get vitals: %v", err)})
+			return
+		}
+		if vitals, err = app.ConvertVitals(db, vitals, c.QueryMap("units")); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to convert vitals: %v", err)})
+			return
+		}
+		codes, err := app.LOINCCodes(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to get vitals: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "as_of": query.AsOf, "data": transformVitals(vitals, codes)})
+	}
+}
@@ -10,14 +10,20 @@ import (
 	"github.com/jinzhu/gorm"
 )
 
+// CreateUserHandler registers a user, who then logs in with the password in
+// the request.
 func CreateUserHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var newUser models.User
+		var newUser struct {
+			models.User
+			Password string `json:"password" binding:"required"`
+		}
 		if err := c.ShouldBindJSON(&newUser); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
 			return
 		}
 
+		setAuditPatient(c, newUser.Username)
 		exists, err := app.UserExists(db, newUser.Username)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
@@ -27,8 +33,8 @@ func CreateUserHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		if err := app.CreateUser(db, newUser); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to create user: %v", err)})
+		if err := app.RegisterUser(db, newUser.User, newUser.Password); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to create user: %v", err)})
 			return
 		}
 
@@ -38,7 +44,11 @@ func CreateUserHandler(db *gorm.DB) gin.HandlerFunc {
 
 func GetUserHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		username := c.Param("username")
+		username, err := actingOn(c, db, models.PermReadUsers, paramOrQuery(c, "username"))
+		if err != nil {
+			forbid(c, err)
+			return
+		}
 
 		exists, err := app.UserExists(db, username)
 		if err != nil {
@@ -68,6 +78,15 @@ func UpdateUserHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		username, err := paramOrBody(c, "username", updatedUser.Username)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+		if updatedUser.Username, err = actingOn(c, db, models.PermUpdateUsers, username); err != nil {
+			forbid(c, err)
+			return
+		}
 		exists, err := app.UserExists(db, updatedUser.Username)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
@@ -88,7 +107,11 @@ func UpdateUserHandler(db *gorm.DB) gin.HandlerFunc {
 
 func DeleteUserHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		username := c.Param("username")
+		username, err := actingOn(c, db, models.PermManageUsers, paramOrQuery(c, "username"))
+		if err != nil {
+			forbid(c, err)
+			return
+		}
 
 		exists, err := app.UserExists(db, username)
 		if err != nil {
@@ -107,3 +130,43 @@ func DeleteUserHandler(db *gorm.DB) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{"status": "success", "message": fmt.Sprintf("User %s deleted.", username)})
 	}
 }
+
+// GetRolesHandler lists the roles users can be given, with their permissions
+func GetRolesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageUsers) {
+			return
+		}
+
+		roles, err := app.GetRoles(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to get roles: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": roles})
+	}
+}
+
+func SetUserRoleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request models.RoleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		username, err := actingOn(c, db, models.PermManageUsers, c.Param("username"))
+		if err != nil {
+			forbid(c, err)
+			return
+		}
+
+		if err := app.SetUserRole(db, username, request.Role); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to set role: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": fmt.Sprintf("User %s is now a %s.", username, request.Role)})
+	}
+}
@@ -5,26 +5,83 @@ import (
 	"medical-vitals-management-system/app"
 	"medical-vitals-management-system/models"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 )
 
+// vitalRequest is a reading as submitted to the insert endpoints
+type vitalRequest struct {
+	Username       string             `json:"username"`
+	VitalID        string             `json:"vital_id"`
+	Value          *float64           `json:"value"`
+	Unit           string             `json:"unit"`
+	Components     map[string]float64 `json:"components"`
+	ComponentUnits map[string]string  `json:"component_units"`
+	Timestamp      string             `json:"timestamp"`
+	Source         models.VitalSource `json:"source"`
+}
+
+// reading converts the request to a VitalReading, parsing its timestamp. The
+// device of the source is not taken from the request.
+func (r vitalRequest) reading() (models.VitalReading, error) {
+	timestamp, err := time.Parse(time.RFC3339, r.Timestamp)
+	if err != nil {
+		return models.VitalReading{}, fmt.Errorf("invalid timestamp format: %q", r.Timestamp)
+	}
+
+	return models.VitalReading{
+		Username:       r.Username,
+		VitalID:        r.VitalID,
+		Value:          r.Value,
+		Unit:           r.Unit,
+		Components:     r.Components,
+		ComponentUnits: r.ComponentUnits,
+		Timestamp:      timestamp,
+		Source: models.VitalSource{
+			Type:     r.Source.Type,
+			Firmware: r.Source.Firmware,
+			Method:   r.Source.Method,
+			BodySite: r.Source.BodySite,
+		},
+	}, nil
+}
+
+// setDeviceSource attributes reading to the device making the request, if
+// the caller is a device, with the device's source type.
+func setDeviceSource(reading *models.VitalReading, principal models.Principal) {
+	if principal.DeviceID == 0 {
+		return
+	}
+	reading.Source.Type = principal.DeviceSource
+	reading.Source.DeviceID = &principal.DeviceID
+}
+
 func CreateVitalHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var request struct {
-			Username  string  `json:"username"`
-			VitalID   string  `json:"vital_id"`
-			Value     float64 `json:"value"`
-			Timestamp string  `json:"timestamp"`
-		}
-
+		var request vitalRequest
 		if err := c.ShouldBindJSON(&request); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request format", "status": "error"})
 			return
 		}
 
+		username, err := paramOrBody(c, "username", request.Username)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+		if request.Username, err = actingOn(c, db, models.PermIngestVitals, username); err != nil {
+			forbid(c, err)
+			return
+		}
+		principal, _ := currentPrincipal(c)
+		if err := app.AuthorizeVitalType(db, principal, request.VitalID); err != nil {
+			forbid(c, err)
+			return
+		}
+
 		exists, err := app.UserExists(db, request.Username)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
@@ -34,19 +91,15 @@ func CreateVitalHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		timestamp, err := time.Parse(time.RFC3339, request.Timestamp)
+		reading, err := request.reading()
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid timestamp format"})
 			return
 		}
+		setDeviceSource(&reading, principal)
 
-		if err := app.CreateVital(db, models.Vital{
-			Username:  request.Username,
-			VitalID:   request.VitalID,
-			Value:     request.Value,
-			Timestamp: timestamp,
-		}); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to insert vital: %v", err)})
+		if err := app.CreateVital(db, reading); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to insert vital: %v", err)})
 			return
 		}
 
@@ -57,57 +110,251 @@ func CreateVitalHandler(db *gorm.DB) gin.HandlerFunc {
 func GetVitalsHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var getData struct {
-			Username string   `json:"username"`
-			Period   []string `json:"period"`
+			Username string            `json:"username"`
+			Period   []string          `json:"period"`
+			VitalIDs []string          `json:"vital_ids"`
+			MinValue *float64          `json:"min_value"`
+			MaxValue *float64          `json:"max_value"`
+			Sort     string            `json:"sort"`
+			Limit    int               `json:"limit"`
+			Cursor   string            `json:"cursor"`
+			Units    map[string]string `json:"units"`
+			models.SourceFilter
 		}
 		if err := c.ShouldBindJSON(&getData); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
 			return
 		}
 
-		username := getData.Username
-		period := getData.Period
-
-		if len(period) != 2 {
+		if len(getData.Period) != 2 {
 			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid period"})
 			return
 		}
 
-		exists, err := app.UserExists(db, username)
+		from, err := parsePeriodBound(getData.Period[0])
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid period"})
 			return
-		} else if !exists {
-			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "User not found"})
+		}
+		to, err := parsePeriodBound(getData.Period[1])
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid period"})
 			return
 		}
 
-		vitals, err := app.GetVitals(db, username, period)
+		respondVitalPage(c, db, models.VitalQuery{
+			Username: getData.Username,
+			VitalIDs: getData.VitalIDs,
+			From:     &from,
+			To:       &to,
+			MinValue: getData.MinValue,
+			MaxValue: getData.MaxValue,
+			Source:   getData.SourceFilter,
+			Sort:     getData.Sort,
+			Limit:    getData.Limit,
+			Cursor:   getData.Cursor,
+		}, getData.Units)
+	}
+}
+
+// ListUserVitalsHandler lists a page of a user's vitals. The from, to,
+// min_value and max_value query parameters bound the results, repeated
+// vital_id parameters select vital types by vital ID or LOINC code, sort is asc or desc, and cursor
+// continues from the next_cursor of a previous page. Units are requested as
+// units[VitalID]=unit. Repeated source, exclude_source, device_id, method and
+// body_site parameters filter the readings by provenance.
+func ListUserVitalsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, err := vitalQueryFromParams(c)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to get vitals: %v", err)})
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
 			return
 		}
 
-		var transformedVitals []map[string]interface{}
-		for _, vital := range vitals {
-			transformedVitals = append(transformedVitals, map[string]interface{}{
-				"vitalID":   vital.VitalID,
-				"value":     vital.Value,
-				"timestamp": vital.Timestamp,
-			})
+		respondVitalPage(c, db, query, c.QueryMap("units"))
+	}
+}
+
+// vitalQueryFromParams reads a VitalQuery from the path and query parameters
+// of a user's vitals route.
+func vitalQueryFromParams(c *gin.Context) (models.VitalQuery, error) {
+	query := models.VitalQuery{
+		Username: c.Param("username"),
+		VitalIDs: c.QueryArray("vital_id"),
+		Source: models.SourceFilter{
+			Sources:        c.QueryArray("source"),
+			ExcludeSources: c.QueryArray("exclude_source"),
+			Methods:        c.QueryArray("method"),
+			BodySites:      c.QueryArray("body_site"),
+		},
+		Sort:   c.Query("sort"),
+		Cursor: c.Query("cursor"),
+	}
+
+	var err error
+	if query.From, err = optionalTime(c.Query("from")); err != nil {
+		return query, fmt.Errorf("invalid from timestamp format")
+	}
+	if query.To, err = optionalTime(c.Query("to")); err != nil {
+		return query, fmt.Errorf("invalid to timestamp format")
+	}
+	if query.MinValue, err = optionalFloat(c.Query("min_value")); err != nil {
+		return query, fmt.Errorf("invalid min_value")
+	}
+	if query.MaxValue, err = optionalFloat(c.Query("max_value")); err != nil {
+		return query, fmt.Errorf("invalid max_value")
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return query, fmt.Errorf("invalid limit")
+		}
+	}
+	for _, value := range c.QueryArray("device_id") {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return query, fmt.Errorf("invalid device_id %q", value)
 		}
+		query.Source.DeviceIDs = append(query.Source.DeviceIDs, uint(id))
+	}
+	return query, nil
+}
+
+// respondVitalPage writes the page of vitals matching query, converted to
+// units, along with the page metadata and the cursor of the next page.
+func respondVitalPage(c *gin.Context, db *gorm.DB, query models.VitalQuery, units map[string]string) {
+	var err error
+	if query.Username, err = actingOn(c, db, models.PermReadVitals, query.Username); err != nil {
+		forbid(c, err)
+		return
+	}
+	exists, err := app.UserExists(db, query.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check user existence: %v", err)})
+		return
+	} else if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "User not found"})
+		return
+	}
+
+	page, err := app.GetVitals(db, query)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to get vitals: %v", err)})
+		return
+	}
+
+	vitals, err := app.ConvertVitals(db, page.Vitals, units)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to convert vitals: %v", err)})
+		return
+	}
+
+	codes, err := app.LOINCCodes(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to get vitals: %v", err)})
+		return
+	}
+
+	data := transformVitals(vitals, codes)
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"data":        data,
+		"next_cursor": page.NextCursor,
+		"page": models.PageInfo{
+			Sort:       page.Sort,
+			Limit:      page.Limit,
+			Count:      len(data),
+			HasMore:    page.HasMore,
+			NextCursor: page.NextCursor,
+		},
+	})
+}
+
+// transformVitals groups stored rows into readings in the shape returned by
+// the API, with the LOINC codes, keyed by series, and UCUM units of each.
+func transformVitals(vitals []models.Vital, codes map[string]string) []map[string]interface{} {
+	var transformedVitals []map[string]interface{}
+	for _, reading := range app.GroupVitalReadings(vitals) {
+		transformedVital := map[string]interface{}{
+			"vitalID":   reading.VitalID,
+			"timestamp": reading.Timestamp,
+		}
+		if code := codes[reading.VitalID]; code != "" {
+			transformedVital["loinc_code"] = code
+		}
+		transformedVital["source"] = reading.Source
+		if reading.Components != nil {
+			componentCodes := make(map[string]string)
+			componentUCUMUnits := make(map[string]string)
+			for component, unit := range reading.ComponentUnits {
+				if code := codes[reading.VitalID+"."+component]; code != "" {
+					componentCodes[component] = code
+				}
+				if ucum := app.UCUMCode(unit); ucum != "" {
+					componentUCUMUnits[component] = ucum
+				}
+			}
+			transformedVital["components"] = reading.Components
+			transformedVital["component_units"] = reading.ComponentUnits
+			transformedVital["component_loinc_codes"] = componentCodes
+			transformedVital["component_ucum_units"] = componentUCUMUnits
+		} else {
+			transformedVital["value"] = reading.Value
+			transformedVital["unit"] = reading.Unit
+			if ucum := app.UCUMCode(reading.Unit); ucum != "" {
+				transformedVital["ucum_unit"] = ucum
+			}
+		}
+		transformedVitals = append(transformedVitals, transformedVital)
+	}
+	return transformedVitals
+}
+
+// parsePeriodBound parses a bound of the legacy period, which accepts plain
+// dates and SQL-style timestamps as well as RFC 3339.
+func parsePeriodBound(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if timestamp, err := time.Parse(layout, value); err == nil {
+			return timestamp, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+}
+
+// optionalFloat parses a number, returning nil for an empty string
+func optionalFloat(value string) (*float64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &number, nil
+}
 
-		c.JSON(http.StatusOK, gin.H{"status": "success", "data": transformedVitals})
+// optionalTime parses an RFC 3339 timestamp, returning nil for an empty one
+func optionalTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
 	}
+	return &timestamp, nil
 }
 
 func UpdateVitalHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var updateData struct {
-			Username  string  `json:"username"`
-			VitalID   string  `json:"vitalID"`
-			Timestamp string  `json:"timestamp"`
-			NewValue  float64 `json:"newValue"`
+			Username       string             `json:"username"`
+			VitalID        string             `json:"vitalID"`
+			Timestamp      string             `json:"timestamp"`
+			NewValue       *float64           `json:"newValue"`
+			Unit           string             `json:"unit"`
+			Components     map[string]float64 `json:"components"`
+			ComponentUnits map[string]string  `json:"component_units"`
+			Reason         string             `json:"reason"`
 		}
 
 		if err := c.ShouldBindJSON(&updateData); err != nil {
@@ -115,9 +362,41 @@ func UpdateVitalHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		err := app.UpdateVital(db, updateData.Username, updateData.VitalID, updateData.Timestamp, updateData.NewValue)
+		var err error
+		if updateData.Username, err = paramOrBody(c, "username", updateData.Username); err == nil {
+			updateData.VitalID, err = paramOrBody(c, "vital_id", updateData.VitalID)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		if updateData.Username, err = actingOn(c, db, models.PermWriteVitals, updateData.Username); err != nil {
+			forbid(c, err)
+			return
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, updateData.Timestamp)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to edit vital: %v", err)})
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid timestamp format"})
+			return
+		}
+
+		principal, _ := currentPrincipal(c)
+		err = app.UpdateVital(db, models.VitalReading{
+			Username:       updateData.Username,
+			VitalID:        updateData.VitalID,
+			Value:          updateData.NewValue,
+			Unit:           updateData.Unit,
+			Components:     updateData.Components,
+			ComponentUnits: updateData.ComponentUnits,
+			Timestamp:      timestamp,
+		}, models.VitalChange{
+			Actor:  principal.Username,
+			Reason: updateData.Reason,
+		})
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to edit vital: %v", err)})
 			return
 		}
 
@@ -128,13 +407,31 @@ func UpdateVitalHandler(db *gorm.DB) gin.HandlerFunc {
 func DeleteVitalHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var deleteRequest models.DeleteVitalRequest
-		if err := c.ShouldBindJSON(&deleteRequest); err != nil {
+		if c.Param("username") != "" {
+			deleteRequest = models.DeleteVitalRequest{
+				Username:  c.Param("username"),
+				VitalID:   c.Param("vital_id"),
+				Timestamp: c.Query("timestamp"),
+				Reason:    c.Query("reason"),
+			}
+			if deleteRequest.Timestamp == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid request: timestamp is required"})
+				return
+			}
+		} else if err := c.ShouldBindJSON(&deleteRequest); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
 			return
 		}
 
+		var err error
+		if deleteRequest.Username, err = actingOn(c, db, models.PermWriteVitals, deleteRequest.Username); err != nil {
+			forbid(c, err)
+			return
+		}
+		principal, _ := currentPrincipal(c)
+		deleteRequest.Actor = principal.Username
 		if err := app.DeleteVital(db, deleteRequest); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to delete vital: %v", err)})
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to delete vital: %v", err)})
 			return
 		}
 
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"fmt"
+	"medical-vitals-management-system/app"
+	"medical-vitals-management-system/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+func CreateVitalTypeHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageVitalTypes) {
+			return
+		}
+
+		var request models.VitalTypeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		if err := app.CreateVitalType(db, vitalTypeFromRequest(request)); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to create vital type: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"status": "success", "message": fmt.Sprintf("Vital type %s created.", request.VitalID)})
+	}
+}
+
+func GetVitalTypesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermReadVitalTypes) {
+			return
+		}
+
+		activeOnly := c.Query("active") == "true"
+
+		vitalTypes, err := app.GetVitalTypes(db, activeOnly)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to get vital types: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": vitalTypes})
+	}
+}
+
+func GetVitalTypeHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermReadVitalTypes) {
+			return
+		}
+
+		vitalID := c.Param("vital_id")
+
+		exists, err := app.VitalTypeExists(db, vitalID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check vital type existence: %v", err)})
+			return
+		} else if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "Vital type not found"})
+			return
+		}
+
+		vitalType, err := app.GetVitalType(db, vitalID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to get vital type: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": vitalType})
+	}
+}
+
+func UpdateVitalTypeHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageVitalTypes) {
+			return
+		}
+
+		var request models.VitalTypeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		if _, err := paramOrBody(c, "vital_id", request.VitalID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		exists, err := app.VitalTypeExists(db, request.VitalID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check vital type existence: %v", err)})
+			return
+		} else if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "Vital type not found"})
+			return
+		}
+
+		if err := app.UpdateVitalType(db, vitalTypeFromRequest(request)); err != nil {
+			c.JSON(errorStatus(err), gin.H{"status": "error", "message": fmt.Sprintf("Failed to update vital type: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": fmt.Sprintf("Vital type %s updated.", request.VitalID)})
+	}
+}
+
+func DeleteVitalTypeHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, models.PermManageVitalTypes) {
+			return
+		}
+
+		vitalID := c.Param("vital_id")
+
+		exists, err := app.VitalTypeExists(db, vitalID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to check vital type existence: %v", err)})
+			return
+		} else if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "Vital type not found"})
+			return
+		}
+
+		if err := app.DeleteVitalType(db, vitalID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("Failed to delete vital type: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": fmt.Sprintf("Vital type %s deleted.", vitalID)})
+	}
+}
+
+// vitalTypeFromRequest builds a VitalType from an API request. Types are
+// active unless the request says otherwise.
+func vitalTypeFromRequest(request models.VitalTypeRequest) models.VitalType {
+	active := true
+	if request.Active != nil {
+		active = *request.Active
+	}
+
+	var components []models.VitalComponent
+	for _, component := range request.Components {
+		components = append(components, models.VitalComponent{
+			Name:       component.Name,
+			Unit:       component.Unit,
+			MinValue:   component.MinValue,
+			MaxValue:   component.MaxValue,
+			NormalLow:  component.NormalLow,
+			NormalHigh: component.NormalHigh,
+			Precision:  component.Precision,
+			LoincCode:  component.LoincCode,
+		})
+	}
+
+	return models.VitalType{
+		VitalID:    request.VitalID,
+		Name:       request.Name,
+		Unit:       request.Unit,
+		MinValue:   request.MinValue,
+		MaxValue:   request.MaxValue,
+		NormalLow:  request.NormalLow,
+		NormalHigh: request.NormalHigh,
+		Precision:  request.Precision,
+		Active:     active,
+		LoincCode:  request.LoincCode,
+		Components: components,
+	}
+}
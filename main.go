@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"medical-vitals-management-system/app"
 	"medical-vitals-management-system/database"
+	"medical-vitals-management-system/mllp"
 	"medical-vitals-management-system/routes"
 	"os"
+	"strings"
 
+	"github.com/jinzhu/gorm"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 )
@@ -23,6 +29,96 @@ func main() {
 		logrus.Fatalf("Failed to connect to the database: %v", err)
 	}
 
+	// "verify-audit" checks the audit log's hash chain instead of serving.
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(verifyAudit(db))
+	}
+
+	// "grant-role <username> <role>" gives a user a role, which is how the
+	// first admin is made.
+	if len(os.Args) > 1 && os.Args[1] == "grant-role" {
+		os.Exit(grantRole(db, os.Args[2:]))
+	}
+
+	// "set-password <username>" sets a user's password, read from standard
+	// input, which is how users created before logins were required get one.
+	if len(os.Args) > 1 && os.Args[1] == "set-password" {
+		os.Exit(setPassword(db, os.Args[2:]))
+	}
+
+	// The HL7 listener is only started when an address is configured, and
+	// only accepts the peers in MLLP_ALLOWED_PEERS.
+	if addr := os.Getenv("MLLP_ADDR"); addr != "" {
+		peers, err := mllp.ParsePeers(os.Getenv("MLLP_ALLOWED_PEERS"))
+		if err != nil {
+			logrus.Fatalf("Invalid MLLP_ALLOWED_PEERS: %v", err)
+		}
+		if len(peers) == 0 {
+			logrus.Fatal("MLLP_ALLOWED_PEERS must list the interface engines allowed to send HL7 messages")
+		}
+		server := &mllp.Server{Addr: addr, AllowedPeers: peers, Handler: func(message, remoteAddr string) string {
+			return app.ProcessHL7Message(db, message, remoteAddr)
+		}}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				logrus.Fatalf("MLLP listener failed: %v", err)
+			}
+		}()
+	}
+
 	router := routes.SetUpRouter(db)
 	router.Run(":8080")
 }
+
+// verifyAudit checks the audit chain, reports the result and returns the
+// process exit status: 0 if the chain is intact, 1 if it is broken and 2 if
+// it could not be checked.
+func verifyAudit(db *gorm.DB) int {
+	verification, err := app.VerifyAuditChain(db)
+	if err != nil {
+		logrus.Errorf("Failed to verify the audit log: %v", err)
+		return 2
+	}
+	if !verification.Valid {
+		fmt.Printf("Audit log is broken at entry %d after %d valid entries: %s\n",
+			verification.BrokenAt, verification.Entries, verification.Reason)
+		return 1
+	}
+	fmt.Printf("Audit log is intact: %d entries verified\n", verification.Entries)
+	return 0
+}
+
+// grantRole gives the user named by args[0] the role named by args[1] and
+// returns the process exit status.
+func grantRole(db *gorm.DB, args []string) int {
+	if len(args) != 2 {
+		fmt.Println("Usage: grant-role <username> <role>")
+		return 2
+	}
+	if err := app.SetUserRole(db, args[0], args[1]); err != nil {
+		logrus.Errorf("Failed to grant role: %v", err)
+		return 1
+	}
+	fmt.Printf("User %s is now a %s\n", args[0], args[1])
+	return 0
+}
+
+// setPassword sets the password of the user named by args[0] to the first
+// line of standard input and returns the process exit status.
+func setPassword(db *gorm.DB, args []string) int {
+	if len(args) != 1 {
+		fmt.Println("Usage: set-password <username> < password-file")
+		return 2
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		logrus.Errorf("Failed to read the password: %v", err)
+		return 1
+	}
+	if err := app.ResetPassword(db, args[0], strings.TrimRight(password, "\r\n")); err != nil {
+		logrus.Errorf("Failed to set password: %v", err)
+		return 1
+	}
+	fmt.Printf("Password of %s set\n", args[0])
+	return 0
+}
@@ -0,0 +1,218 @@
+// Package mllp receives HL7 v2 messages over the Minimal Lower Layer
+// Protocol, in which each message is framed as <VT> message <FS><CR>.
+package mllp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	startBlock     = 0x0b
+	endBlock       = 0x1c
+	carriageReturn = 0x0d
+
+	// maxMessageSize bounds the size of one framed message
+	maxMessageSize = 1 << 20
+	// idleTimeout closes connections that send nothing for this long
+	idleTimeout = 5 * time.Minute
+)
+
+// Handler processes a message received from remoteAddr and returns the reply
+// to send back.
+type Handler func(message string, remoteAddr string) string
+
+// Server accepts MLLP connections and answers each message with the reply of
+// its handler. MLLP has no authentication of its own, so connections are only
+// accepted from AllowedPeers; any other peer is disconnected before anything
+// it sends is read. No peer is allowed if AllowedPeers is empty.
+type Server struct {
+	Addr         string
+	Handler      Handler
+	AllowedPeers []*net.IPNet
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+// ListenAndServe listens on Addr and serves connections until Close is
+// called.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves connections accepted by listener until Close is called
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	logrus.Infof("MLLP listener accepting HL7 messages on %s", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	if !s.allowed(conn.RemoteAddr()) {
+		logrus.Warnf("Refusing MLLP connection from %s: not an allowed peer", remoteAddr)
+		return
+	}
+	reader := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		message, err := ReadMessage(reader)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				logrus.Warnf("Closing MLLP connection from %s: %v", remoteAddr, err)
+			}
+			return
+		}
+
+		reply := s.Handler(message, remoteAddr)
+		if _, err := conn.Write(Frame(reply)); err != nil {
+			logrus.Warnf("Failed to reply to %s: %v", remoteAddr, err)
+			return
+		}
+	}
+}
+
+// allowed reports whether addr is in one of the allowed peer networks
+func (s *Server) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range s.AllowedPeers {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePeers parses a comma-separated list of IP addresses and CIDR ranges
+// into the networks they cover, for Server.AllowedPeers.
+func ParsePeers(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, peer := range strings.Split(list, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		if !strings.Contains(peer, "/") {
+			ip := net.ParseIP(peer)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid peer address %q", peer)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer range %q", peer)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ReadMessage reads the next framed message. Bytes before the start block
+// are discarded. Frames, or runs of bytes before them, longer than
+// maxMessageSize are rejected as soon as they cross it, so a peer cannot
+// make the server buffer an unbounded stream.
+func ReadMessage(reader *bufio.Reader) (string, error) {
+	for skipped := 0; ; skipped++ {
+		if skipped > maxMessageSize {
+			return "", fmt.Errorf("no start block within %d bytes", maxMessageSize)
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == startBlock {
+			break
+		}
+	}
+
+	var message bytes.Buffer
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b == endBlock {
+			next, err := reader.ReadByte()
+			if err != nil {
+				return "", io.ErrUnexpectedEOF
+			}
+			if next == carriageReturn {
+				return message.String(), nil
+			}
+			// An FS not followed by CR is part of the message.
+			reader.UnreadByte()
+		}
+		if message.Len() >= maxMessageSize {
+			return "", fmt.Errorf("message exceeds %d bytes", maxMessageSize)
+		}
+		message.WriteByte(b)
+	}
+}
+
+// Frame wraps a message in MLLP start and end blocks
+func Frame(message string) []byte {
+	framed := make([]byte, 0, len(message)+3)
+	framed = append(framed, startBlock)
+	framed = append(framed, message...)
+	return append(framed, endBlock, carriageReturn)
+}
@@ -0,0 +1,118 @@
+package mllp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMessage(t *testing.T) {
+	stream := "noise" + string(Frame("MSH|^~\\&|A\rPID|1")) + string(Frame("MSH|second"))
+	reader := bufio.NewReader(strings.NewReader(stream))
+
+	message, err := ReadMessage(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "MSH|^~\\&|A\rPID|1", message, "Bytes before the start block should be discarded")
+
+	message, err = ReadMessage(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "MSH|second", message)
+
+	_, err = ReadMessage(reader)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = ReadMessage(bufio.NewReader(strings.NewReader("\x0bMSH|truncated")))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	message, err = ReadMessage(bufio.NewReader(strings.NewReader("\x0bOBX|\x1cstill\x1c\r")))
+	assert.NoError(t, err)
+	assert.Equal(t, "OBX|\x1cstill", message, "An FS not followed by CR should be kept")
+}
+
+// endless yields the same byte forever, like a peer that never stops sending
+type endless byte
+
+func (b endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+	return len(p), nil
+}
+
+func TestReadMessageLimit(t *testing.T) {
+	_, err := ReadMessage(bufio.NewReader(endless('x')))
+	assert.EqualError(t, err, "no start block within 1048576 bytes", "Bytes before the start block should be bounded")
+
+	_, err = ReadMessage(bufio.NewReader(io.MultiReader(strings.NewReader("\x0b"), endless('x'))))
+	assert.EqualError(t, err, "message exceeds 1048576 bytes")
+}
+
+func TestServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	loopback, err := ParsePeers("127.0.0.1")
+	assert.NoError(t, err)
+	server := &Server{AllowedPeers: loopback, Handler: func(message, remoteAddr string) string {
+		return "ACK for " + message
+	}}
+	done := make(chan error)
+	go func() { done <- server.Serve(listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for _, message := range []string{"first", "second"} {
+		_, err = conn.Write(Frame(message))
+		assert.NoError(t, err)
+		reply, err := ReadMessage(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "ACK for "+message, reply, "Each message on a connection should be answered in turn")
+	}
+
+	assert.NoError(t, server.Close())
+	assert.NoError(t, <-done)
+}
+
+func TestServerRefusesUnknownPeers(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	handled := make(chan string, 1)
+	server := &Server{Handler: func(message, remoteAddr string) string {
+		handled <- message
+		return "ACK"
+	}}
+	server.AllowedPeers, err = ParsePeers("10.0.0.0/8")
+	assert.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write(Frame("MSH|unwelcome"))
+
+	_, err = ReadMessage(bufio.NewReader(conn))
+	assert.Error(t, err, "The connection should be closed without a reply")
+	assert.Empty(t, handled, "Messages from unknown peers should not be handled")
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers(" 192.0.2.10, 10.1.0.0/16 ,::1")
+	assert.NoError(t, err)
+	assert.Len(t, peers, 3)
+	assert.True(t, peers[0].Contains(net.ParseIP("192.0.2.10")))
+	assert.False(t, peers[0].Contains(net.ParseIP("192.0.2.11")), "A single address should not allow its neighbours")
+	assert.True(t, peers[1].Contains(net.ParseIP("10.1.200.3")))
+	assert.True(t, peers[2].Contains(net.ParseIP("::1")))
+
+	_, err = ParsePeers("monitor.local")
+	assert.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package models
+
+// The types below are the subset of FHIR R4 resources the FHIR facade reads
+// and writes. Field names follow the FHIR JSON representation.
+
+type FHIRCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type FHIRCodeableConcept struct {
+	Coding []FHIRCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+type FHIRQuantity struct {
+	Value  *float64 `json:"value,omitempty"`
+	Unit   string   `json:"unit,omitempty"`
+	System string   `json:"system,omitempty"`
+	Code   string   `json:"code,omitempty"`
+}
+
+type FHIRReference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type FHIRIdentifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type FHIRMeta struct {
+	LastUpdated string `json:"lastUpdated,omitempty"`
+}
+
+// FHIRObservation is an Observation resource. A simple vital carries
+// ValueQuantity; a composite one carries a Component per component. BodySite,
+// Method and Device carry the provenance of the reading.
+type FHIRObservation struct {
+	ResourceType      string                     `json:"resourceType"`
+	ID                string                     `json:"id,omitempty"`
+	Meta              *FHIRMeta                  `json:"meta,omitempty"`
+	Status            string                     `json:"status"`
+	Category          []FHIRCodeableConcept      `json:"category,omitempty"`
+	Code              FHIRCodeableConcept        `json:"code"`
+	Subject           *FHIRReference             `json:"subject,omitempty"`
+	EffectiveDateTime string                     `json:"effectiveDateTime,omitempty"`
+	EffectiveInstant  string                     `json:"effectiveInstant,omitempty"`
+	ValueQuantity     *FHIRQuantity              `json:"valueQuantity,omitempty"`
+	BodySite          *FHIRCodeableConcept       `json:"bodySite,omitempty"`
+	Method            *FHIRCodeableConcept       `json:"method,omitempty"`
+	Device            *FHIRReference             `json:"device,omitempty"`
+	Component         []FHIRObservationComponent `json:"component,omitempty"`
+}
+
+type FHIRObservationComponent struct {
+	Code          FHIRCodeableConcept `json:"code"`
+	ValueQuantity *FHIRQuantity       `json:"valueQuantity,omitempty"`
+}
+
+type FHIRHumanName struct {
+	Text string `json:"text,omitempty"`
+}
+
+// FHIRPatient is a Patient resource, identified by username
+type FHIRPatient struct {
+	ResourceType string           `json:"resourceType"`
+	ID           string           `json:"id"`
+	Meta         *FHIRMeta        `json:"meta,omitempty"`
+	Identifier   []FHIRIdentifier `json:"identifier,omitempty"`
+	Name         []FHIRHumanName  `json:"name,omitempty"`
+	Gender       string           `json:"gender,omitempty"`
+}
+
+// FHIRBundle is a searchset Bundle of search results
+type FHIRBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Total        *int              `json:"total,omitempty"`
+	Link         []FHIRBundleLink  `json:"link,omitempty"`
+	Entry        []FHIRBundleEntry `json:"entry"`
+}
+
+type FHIRBundleLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
+type FHIRBundleEntry struct {
+	FullURL  string            `json:"fullUrl,omitempty"`
+	Resource interface{}       `json:"resource"`
+	Search   *FHIRBundleSearch `json:"search,omitempty"`
+}
+
+type FHIRBundleSearch struct {
+	Mode string `json:"mode"`
+}
+
+// FHIROperationOutcome reports an error from the FHIR facade
+type FHIROperationOutcome struct {
+	ResourceType string             `json:"resourceType"`
+	Issue        []FHIROutcomeIssue `json:"issue"`
+}
+
+type FHIROutcomeIssue struct {
+	Severity    string `json:"severity"`
+	Code        string `json:"code"`
+	Diagnostics string `json:"diagnostics,omitempty"`
+}
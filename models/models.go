@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 )
 
 type User struct {
@@ -11,7 +12,9 @@ type User struct {
 	Username string `gorm:"column:username;not null"`
 	Age      int    `gorm:"column:age"`
 	Gender   string `gorm:"column:gender"`
-	Vitals   []Vital
+	// Role names the Role that grants the user's permissions.
+	Role   string `gorm:"column:role;not null;default:'patient'"`
+	Vitals []Vital
 }
 
 type Vital struct {
@@ -19,20 +22,284 @@ type Vital struct {
 	UserID    uint      `gorm:"column:user_id;constraint:OnDelete:CASCADE"`
 	Username  string    `gorm:"column:username;not null"`
 	VitalID   string    `gorm:"column:vital_id;not null"`
+	Component string    `gorm:"column:component"`
 	Value     float64   `gorm:"column:value"`
+	Unit      string    `gorm:"column:unit"`
 	Timestamp time.Time `gorm:"column:timestamp"`
+	// SourceType, DeviceID, Firmware, Method and BodySite record where the
+	// reading came from, as given by its VitalSource.
+	SourceType string `gorm:"column:source_type;not null;default:'manual';index"`
+	DeviceID   *uint  `gorm:"column:device_id;index"`
+	Firmware   string `gorm:"column:firmware"`
+	Method     string `gorm:"column:method"`
+	BodySite   string `gorm:"column:body_site"`
+}
+
+// Source types of vital readings
+const (
+	SourceManual          = "manual"
+	SourceSmartwatch      = "smartwatch"
+	SourceHospitalMonitor = "hospital_monitor"
+	SourceImport          = "import"
+)
+
+// VitalSource is the provenance of a reading: the kind of source it came
+// from, the registered Device that pushed it, if any, the firmware of the
+// measuring device and how and where on the body it was measured. Type
+// defaults to SourceManual.
+type VitalSource struct {
+	Type     string `json:"type,omitempty"`
+	DeviceID *uint  `json:"device_id,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	Method   string `json:"method,omitempty"`
+	BodySite string `json:"body_site,omitempty"`
+}
+
+// SourceFilter selects vitals by provenance. Each non-empty list keeps the
+// readings matching any of its values, and ExcludeSources drops readings of
+// those source types.
+type SourceFilter struct {
+	Sources        []string `json:"sources,omitempty"`
+	ExcludeSources []string `json:"exclude_sources,omitempty"`
+	DeviceIDs      []uint   `json:"device_ids,omitempty"`
+	Methods        []string `json:"methods,omitempty"`
+	BodySites      []string `json:"body_sites,omitempty"`
+}
+
+// VitalReading is a single measurement of a vital as exchanged over the API.
+// Simple vitals carry Value; composite vitals such as blood pressure carry one
+// value per named component instead, each stored as its own Vital row.
+type VitalReading struct {
+	Username       string             `json:"username"`
+	VitalID        string             `json:"vital_id"`
+	Value          *float64           `json:"value,omitempty"`
+	Unit           string             `json:"unit,omitempty"`
+	Components     map[string]float64 `json:"components,omitempty"`
+	ComponentUnits map[string]string  `json:"component_units,omitempty"`
+	Timestamp      time.Time          `json:"timestamp"`
+	// Source.DeviceID is set from the API key of the device pushing the
+	// reading, never from the request body.
+	Source VitalSource `json:"source"`
+}
+
+// VitalType describes a kind of vital the system accepts, along with the
+// unit values are stored in and the range a reading must fall within.
+// Composite vitals list their Components, each with its own unit and range,
+// and the type-level unit and range are unused. NormalLow and NormalHigh
+// bound the clinically normal values, outside of which readings are flagged.
+// LoincCode identifies the type, or the panel of a composite type, in LOINC;
+// UCUMUnit is derived from Unit when the type is read and is not stored.
+type VitalType struct {
+	gorm.Model
+	VitalID    string           `gorm:"column:vital_id;unique_index;not null" json:"vital_id"`
+	Name       string           `gorm:"column:name" json:"name"`
+	Unit       string           `gorm:"column:unit" json:"unit"`
+	MinValue   float64          `gorm:"column:min_value" json:"min_value"`
+	MaxValue   float64          `gorm:"column:max_value" json:"max_value"`
+	NormalLow  *float64         `gorm:"column:normal_low" json:"normal_low,omitempty"`
+	NormalHigh *float64         `gorm:"column:normal_high" json:"normal_high,omitempty"`
+	Precision  int              `gorm:"column:precision" json:"precision"`
+	Active     bool             `gorm:"column:active" json:"active"`
+	LoincCode  string           `gorm:"column:loinc_code;index" json:"loinc_code,omitempty"`
+	UCUMUnit   string           `gorm:"-" json:"ucum_unit,omitempty"`
+	Components []VitalComponent `json:"components,omitempty"`
+}
+
+// VitalComponent is one named value of a composite vital type, such as the
+// systolic pressure of a blood pressure reading.
+type VitalComponent struct {
+	gorm.Model
+	VitalTypeID uint     `gorm:"column:vital_type_id;not null" json:"-"`
+	Name        string   `gorm:"column:name;not null" json:"name"`
+	Unit        string   `gorm:"column:unit" json:"unit"`
+	MinValue    float64  `gorm:"column:min_value" json:"min_value"`
+	MaxValue    float64  `gorm:"column:max_value" json:"max_value"`
+	NormalLow   *float64 `gorm:"column:normal_low" json:"normal_low,omitempty"`
+	NormalHigh  *float64 `gorm:"column:normal_high" json:"normal_high,omitempty"`
+	Precision   int      `gorm:"column:precision" json:"precision"`
+	LoincCode   string   `gorm:"column:loinc_code" json:"loinc_code,omitempty"`
+	UCUMUnit    string   `gorm:"-" json:"ucum_unit,omitempty"`
+}
+
+type VitalTypeRequest struct {
+	VitalID    string                  `json:"vital_id" binding:"required"`
+	Name       string                  `json:"name"`
+	Unit       string                  `json:"unit"`
+	MinValue   float64                 `json:"min_value"`
+	MaxValue   float64                 `json:"max_value"`
+	NormalLow  *float64                `json:"normal_low"`
+	NormalHigh *float64                `json:"normal_high"`
+	Precision  int                     `json:"precision"`
+	Active     *bool                   `json:"active"`
+	LoincCode  string                  `json:"loinc_code"`
+	Components []VitalComponentRequest `json:"components"`
+}
+
+type VitalComponentRequest struct {
+	Name       string   `json:"name" binding:"required"`
+	Unit       string   `json:"unit"`
+	MinValue   float64  `json:"min_value"`
+	MaxValue   float64  `json:"max_value"`
+	NormalLow  *float64 `json:"normal_low"`
+	NormalHigh *float64 `json:"normal_high"`
+	Precision  int      `json:"precision"`
+	LoincCode  string   `json:"loinc_code"`
+}
+
+// IngestResult reports whether one reading of a bulk insert was stored.
+// Index is the reading's position in the request, counting from zero, and
+// Line its line number in an NDJSON body.
+type IngestResult struct {
+	Index  int    `json:"index"`
+	Line   int    `json:"line,omitempty"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// IngestReport summarizes a bulk insert
+type IngestReport struct {
+	Accepted int            `json:"accepted"`
+	Rejected int            `json:"rejected"`
+	Results  []IngestResult `json:"results"`
+}
+
+// CSVImportOptions describes the layout of an uploaded CSV file of vitals.
+// Columns maps each field (username, vital_id, component, value, unit,
+// timestamp, firmware, method and body_site) to the header of the column
+// holding it, defaulting to the field name. Username and VitalID apply to every row that has no column of its
+// own. TimestampFormat is "rfc3339", "unix", "unix_ms" or a Go time layout,
+// read in Timezone when the layout carries no offset.
+type CSVImportOptions struct {
+	Username        string
+	VitalID         string
+	Columns         map[string]string
+	TimestampFormat string
+	Timezone        string
+	DryRun          bool
+}
+
+// FHIRObservationSearch is a search of the FHIR Observation endpoint. Codes
+// and Dates hold the raw code and date search parameters; Patient is a
+// username, with or without the "Patient/" prefix.
+type FHIRObservationSearch struct {
+	Patient string
+	Codes   []string
+	Dates   []string
+	Sort    string
+	Count   int
+	Cursor  string
+}
+
+// FHIRObservationPage is a page of Observation search results
+type FHIRObservationPage struct {
+	Observations []FHIRObservation
+	HasMore      bool
+	NextCursor   string
+}
+
+// HL7DeadLetter is an HL7 v2 message that could not be processed, kept with
+// the reason it was refused.
+type HL7DeadLetter struct {
+	gorm.Model
+	RemoteAddr string `gorm:"column:remote_addr" json:"remote_addr"`
+	ControlID  string `gorm:"column:control_id" json:"control_id"`
+	Message    string `gorm:"column:message;type:text" json:"message"`
+	Error      string `gorm:"column:error;type:text" json:"error"`
+}
+
+// VitalQuery selects a page of a user's vitals. Empty VitalIDs matches every
+// vital type, and a nil bound leaves that end of the time or value range open.
+// Values are compared in the canonical unit of each vital type. Cursor is the
+// NextCursor of the previous page, or empty for the first page.
+type VitalQuery struct {
+	Username string
+	VitalIDs []string
+	From     *time.Time
+	To       *time.Time
+	MinValue *float64
+	MaxValue *float64
+	Source   SourceFilter
+	Sort     string
+	Limit    int
+	Cursor   string
+}
+
+// VitalPage is one page of the vitals matching a VitalQuery. A composite
+// reading is never split across pages.
+type VitalPage struct {
+	Vitals     []Vital
+	Sort       string
+	Limit      int
+	HasMore    bool
+	NextCursor string
+}
+
+// PageInfo describes a page of results in an API response
+type PageInfo struct {
+	Sort       string `json:"sort"`
+	Limit      int    `json:"limit"`
+	Count      int    `json:"count"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type DeleteVitalRequest struct {
-	Username  string `json:"username" binding:"required"`
+	Username  string `json:"username"`
 	VitalID   string `json:"vital_id" binding:"required"`
 	Timestamp string `json:"timestamp" binding:"required"`
+	// Actor is the authenticated caller, never read from the request.
+	Actor  string `json:"-"`
+	Reason string `json:"reason"`
+}
+
+// VitalChange says who is changing a vital and why, for its revision history
+type VitalChange struct {
+	Actor  string
+	Reason string
+}
+
+// VitalRevision records one change to a stored vital row: its value and unit
+// before and after the change, who made it, why and when. Revisions are only
+// ever inserted. A deletion has no new value.
+type VitalRevision struct {
+	ID         uint      `gorm:"primary_key" json:"id"`
+	VitalRowID uint      `gorm:"column:vital_row_id;not null;index" json:"vital_row_id"`
+	Username   string    `gorm:"column:username;not null;index" json:"username"`
+	VitalID    string    `gorm:"column:vital_id;not null" json:"vital_id"`
+	Component  string    `gorm:"column:component" json:"component,omitempty"`
+	Timestamp  time.Time `gorm:"column:timestamp" json:"timestamp"`
+	Action     string    `gorm:"column:action;not null" json:"action"`
+	OldValue   *float64  `gorm:"column:old_value" json:"old_value"`
+	OldUnit    string    `gorm:"column:old_unit" json:"old_unit"`
+	NewValue   *float64  `gorm:"column:new_value" json:"new_value"`
+	NewUnit    string    `gorm:"column:new_unit" json:"new_unit,omitempty"`
+	Actor      string    `gorm:"column:actor;not null" json:"actor"`
+	Reason     string    `gorm:"column:reason" json:"reason"`
+	RevisedAt  time.Time `gorm:"column:revised_at;not null;index" json:"revised_at"`
+}
+
+// VitalAsOfQuery selects a user's vitals as they were stored at AsOf. Empty
+// VitalIDs matches every vital type, and a nil bound leaves that end of the
+// reading time range open.
+type VitalAsOfQuery struct {
+	Username string
+	AsOf     time.Time
+	VitalIDs []string
+	From     *time.Time
+	To       *time.Time
 }
 type AggregateRequest struct {
-	Username       string    `json:"username"`
-	VitalIDs       []string  `json:"vital_ids"`
-	StartTimestamp time.Time `json:"start_timestamp"`
-	EndTimestamp   time.Time `json:"end_timestamp"`
+	Username       string            `json:"username"`
+	VitalIDs       []string          `json:"vital_ids"`
+	Units          map[string]string `json:"units"`
+	Statistics     []string          `json:"statistics"`
+	Interval       string            `json:"interval"`
+	Timezone       string            `json:"timezone"`
+	StartTimestamp time.Time         `json:"start_timestamp"`
+	EndTimestamp   time.Time         `json:"end_timestamp"`
+	// Only readings matching the filter are aggregated, for example to leave
+	// out manual entries with "exclude_sources": ["manual"].
+	SourceFilter
 }
 
 type AggregateResponse struct {
@@ -44,33 +311,552 @@ type AggregateResponse struct {
 }
 
 type AggregateData struct {
-	Username   string             `json:"username"`
-	Aggregates map[string]float64 `json:"aggregates"`
+	Username   string                       `json:"username"`
+	Aggregates map[string]VitalStatistics   `json:"aggregates"`
+	Interval   string                       `json:"interval,omitempty"`
+	Timezone   string                       `json:"timezone,omitempty"`
+	Series     map[string][]AggregateBucket `json:"series,omitempty"`
+}
+
+// AggregateBucket holds the statistics of the readings in [Start, End).
+// Buckets without readings are included with Empty set.
+type AggregateBucket struct {
+	Start      time.Time        `json:"start"`
+	End        time.Time        `json:"end"`
+	Empty      bool             `json:"empty"`
+	Statistics *VitalStatistics `json:"statistics,omitempty"`
+}
+
+// VitalStatistics summarizes the readings of one vital, or one component of a
+// composite vital. Only the statistics requested are set.
+type VitalStatistics struct {
+	LoincCode   string             `json:"loinc_code,omitempty"`
+	Unit        string             `json:"unit"`
+	UCUMUnit    string             `json:"ucum_unit,omitempty"`
+	Count       int                `json:"count"`
+	Mean        *float64           `json:"mean,omitempty"`
+	Min         *float64           `json:"min,omitempty"`
+	Max         *float64           `json:"max,omitempty"`
+	Median      *float64           `json:"median,omitempty"`
+	StdDev      *float64           `json:"stddev,omitempty"`
+	First       *float64           `json:"first,omitempty"`
+	Last        *float64           `json:"last,omitempty"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
 }
 
 type PopulationInsightRequest struct {
-	Username       string    `json:"username"`
-	VitalID        string    `json:"vital_id"`
-	StartTimestamp time.Time `json:"start_timestamp"`
-	EndTimestamp   time.Time `json:"end_timestamp"`
+	Username       string        `json:"username"`
+	VitalID        string        `json:"vital_id"`
+	Component      string        `json:"component"`
+	Unit           string        `json:"unit"`
+	Cohort         *CohortFilter `json:"cohort"`
+	StartTimestamp time.Time     `json:"start_timestamp"`
+	EndTimestamp   time.Time     `json:"end_timestamp"`
+}
+
+// CohortFilter restricts the population a user is compared against. LikeMe
+// matches users of the same gender within AgeBand years of the user's age;
+// explicit bounds or gender override what LikeMe derives.
+type CohortFilter struct {
+	MinAge  *int   `json:"min_age"`
+	MaxAge  *int   `json:"max_age"`
+	Gender  string `json:"gender"`
+	LikeMe  bool   `json:"like_me"`
+	AgeBand int    `json:"age_band"`
+}
+
+// CohortDefinition is the resolved cohort a population insight was computed
+// against. Size counts the users matching it, with or without readings.
+type CohortDefinition struct {
+	MinAge      *int   `json:"min_age,omitempty"`
+	MaxAge      *int   `json:"max_age,omitempty"`
+	Gender      string `json:"gender,omitempty"`
+	Description string `json:"description"`
+	Size        int    `json:"size"`
 }
 
 type PopulationInsightResponse struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
-	Data    struct {
-		Username       string    `json:"username"`
-		VitalID        string    `json:"vital_id"`
-		StartTimestamp time.Time `json:"start_timestamp"`
-		EndTimestamp   time.Time `json:"end_timestamp"`
-		Insight        string    `json:"insight"`
-	} `json:"data"`
+	Status  string                `json:"status"`
+	Message string                `json:"message"`
+	Data    PopulationInsightData `json:"data"`
 }
 
 type PopulationInsightData struct {
-	Username       string    `json:"username"`
-	VitalID        string    `json:"vital_id"`
-	StartTimestamp time.Time `json:"start_timestamp"`
-	EndTimestamp   time.Time `json:"end_timestamp"`
-	Insight        string    `json:"insight"`
+	Username       string                        `json:"username"`
+	VitalID        string                        `json:"vital_id"`
+	LoincCode      string                        `json:"loinc_code,omitempty"`
+	Unit           string                        `json:"unit"`
+	UCUMUnit       string                        `json:"ucum_unit,omitempty"`
+	StartTimestamp time.Time                     `json:"start_timestamp"`
+	EndTimestamp   time.Time                     `json:"end_timestamp"`
+	Insight        string                        `json:"insight"`
+	Cohort         CohortDefinition              `json:"cohort"`
+	Privacy        PrivacyReport                 `json:"privacy"`
+	Standing       *PopulationStanding           `json:"standing,omitempty"`
+	Components     map[string]PopulationStanding `json:"components,omitempty"`
+}
+
+// BatchPopulationInsightRequest asks for population standings for several
+// vitals at once. Units maps vital IDs to the unit their standings are
+// reported in.
+type BatchPopulationInsightRequest struct {
+	Username       string            `json:"username"`
+	VitalIDs       []string          `json:"vital_ids"`
+	Units          map[string]string `json:"units"`
+	Cohort         *CohortFilter     `json:"cohort"`
+	StartTimestamp time.Time         `json:"start_timestamp"`
+	EndTimestamp   time.Time         `json:"end_timestamp"`
+}
+
+type BatchPopulationInsightResponse struct {
+	Status  string                     `json:"status"`
+	Message string                     `json:"message"`
+	Data    BatchPopulationInsightData `json:"data"`
+}
+
+type BatchPopulationInsightData struct {
+	Username       string                             `json:"username"`
+	StartTimestamp time.Time                          `json:"start_timestamp"`
+	EndTimestamp   time.Time                          `json:"end_timestamp"`
+	Insights       map[string]PopulationInsightResult `json:"insights"`
+}
+
+// PopulationInsightResult is the outcome of one vital in a batch: either its
+// population insight or the error that prevented computing it.
+type PopulationInsightResult struct {
+	Status  string                 `json:"status"`
+	Message string                 `json:"message,omitempty"`
+	Data    *PopulationInsightData `json:"data,omitempty"`
+}
+
+// PopulationStanding places a user's mean value of a vital, or of one
+// component of a composite vital, within the means of all users. Only
+// aggregates of the population are reported: no statistic, such as a median,
+// that is the value of one of its members.
+type PopulationStanding struct {
+	Component        string   `json:"component,omitempty"`
+	LoincCode        string   `json:"loinc_code,omitempty"`
+	Unit             string   `json:"unit"`
+	UCUMUnit         string   `json:"ucum_unit,omitempty"`
+	UserValue        float64  `json:"user_value"`
+	Percentile       float64  `json:"percentile"`
+	PopulationSize   int      `json:"population_size"`
+	PopulationMean   float64  `json:"population_mean"`
+	PopulationMedian *float64 `json:"population_median,omitempty"`
+	Insight          string   `json:"insight"`
+}
+
+// PrivacyReport describes the privacy protections applied to a population
+// insight and the differential privacy budget it consumed.
+type PrivacyReport struct {
+	Mechanism       string   `json:"mechanism"`
+	MinCohortSize   int      `json:"min_cohort_size"`
+	EpsilonSpent    float64  `json:"epsilon_spent"`
+	BudgetRemaining *float64 `json:"budget_remaining,omitempty"`
+}
+
+// PrivacyDisclosure records a population standing disclosed to a user, the
+// population it was computed against and the privacy budget it consumed.
+type PrivacyDisclosure struct {
+	gorm.Model
+	Username       string  `gorm:"column:username;not null;index" json:"username"`
+	VitalID        string  `gorm:"column:vital_id;not null" json:"vital_id"`
+	Component      string  `gorm:"column:component" json:"component,omitempty"`
+	Cohort         string  `gorm:"column:cohort" json:"cohort"`
+	PopulationSize int     `gorm:"column:population_size" json:"population_size"`
+	Mechanism      string  `gorm:"column:mechanism" json:"mechanism"`
+	Epsilon        float64 `gorm:"column:epsilon" json:"epsilon"`
+}
+
+// AuditEntry records one request handled by the API: who made it, whose data
+// it concerned, what it did and how it ended. Entries are only ever appended,
+// and each is chained to the one before it by PrevHash, so that altering or
+// removing an entry breaks the chain.
+type AuditEntry struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	Time      time.Time `gorm:"column:time;not null;index" json:"time"`
+	Actor     string    `gorm:"column:actor;not null;index" json:"actor"`
+	Patient   string    `gorm:"column:patient;index" json:"patient,omitempty"`
+	Action    string    `gorm:"column:action;not null" json:"action"`
+	Resource  string    `gorm:"column:resource;not null" json:"resource"`
+	RequestID string    `gorm:"column:request_id;not null" json:"request_id"`
+	ClientIP  string    `gorm:"column:client_ip" json:"client_ip"`
+	Status    int       `gorm:"column:status" json:"status"`
+	Outcome   string    `gorm:"column:outcome;not null" json:"outcome"`
+	PrevHash  string    `gorm:"column:prev_hash" json:"prev_hash"`
+	Hash      string    `gorm:"column:hash;not null;unique_index" json:"hash"`
+}
+
+// AuditQuery selects audit entries, newest first. Empty fields and nil bounds
+// match every entry. BeforeID continues from the last entry of a previous
+// page.
+type AuditQuery struct {
+	Actor     string
+	Patient   string
+	Action    string
+	Outcome   string
+	RequestID string
+	From      *time.Time
+	To        *time.Time
+	BeforeID  uint
+	Limit     int
+}
+
+// AuditVerification is the result of checking the audit chain. If the chain
+// is broken, BrokenAt is the ID of the first entry that does not match.
+type AuditVerification struct {
+	Entries  int    `json:"entries"`
+	Valid    bool   `json:"valid"`
+	BrokenAt uint   `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Credential holds the password hash a user logs in with
+type Credential struct {
+	gorm.Model
+	Username     string `gorm:"column:username;not null;unique_index"`
+	PasswordHash string `gorm:"column:password_hash;not null"`
+}
+
+// RefreshToken is an issued refresh token, stored by the SHA-256 hash of its
+// value. A refresh token is used once: refreshing revokes it and issues a new
+// one in the same family, and presenting a revoked token revokes the family.
+type RefreshToken struct {
+	gorm.Model
+	Username  string     `gorm:"column:username;not null;index"`
+	TokenHash string     `gorm:"column:token_hash;not null;unique_index"`
+	Family    string     `gorm:"column:family;not null;index"`
+	ExpiresAt time.Time  `gorm:"column:expires_at;not null"`
+	RevokedAt *time.Time `gorm:"column:revoked_at"`
+}
+
+// RevokedToken is an access token revoked before it expired, identified by
+// its JWT ID. It can be forgotten once ExpiresAt has passed.
+type RevokedToken struct {
+	gorm.Model
+	TokenID   string    `gorm:"column:token_id;not null;unique_index"`
+	ExpiresAt time.Time `gorm:"column:expires_at;not null;index"`
+}
+
+// Principal is the authenticated caller of a request, as identified by its
+// access token, with the permissions of the caller's role. Devices calling
+// with an API key have a DeviceID and are limited to the patients and vital
+// types of their scope; their readings get the DeviceSource source type.
+type Principal struct {
+	Username         string
+	Role             string
+	Permissions      []string
+	TokenID          string
+	ExpiresAt        time.Time
+	DeviceID         uint
+	DeviceSource     string
+	DevicePatients   []string
+	DeviceVitalTypes []string
+}
+
+// Roles every deployment has. Users registering themselves are patients.
+const (
+	RolePatient   = "patient"
+	RoleClinician = "clinician"
+	RoleAdmin     = "admin"
+	// RoleDevice is the role of devices calling with an API key. It is not
+	// stored: devices may only ingest vitals, within their scope.
+	RoleDevice = "device"
+)
+
+// Permissions granted by roles. Permissions over a user's records apply to
+// the caller's own records, to those of assigned patients with
+// PermAccessAssigned and to everyone's with PermAccessAll.
+const (
+	PermReadUsers        = "users:read"
+	PermUpdateUsers      = "users:update"
+	PermManageUsers      = "users:manage"
+	PermReadVitals       = "vitals:read"
+	PermWriteVitals      = "vitals:write"
+	PermIngestVitals     = "vitals:ingest"
+	PermReadVitalTypes   = "vital_types:read"
+	PermManageVitalTypes = "vital_types:manage"
+	PermReadInsights     = "insights:read"
+	PermReadPopulation   = "insights:population"
+	PermReadAudit        = "audit:read"
+	PermReadDeadLetters  = "hl7:read"
+	PermManageDevices    = "devices:manage"
+	PermReadAlerts       = "alerts:read"
+	PermManageAlerts     = "alerts:manage"
+	PermManageAlertRules = "alert_rules:manage"
+	PermAccessAssigned   = "patients:assigned"
+	PermAccessAll        = "patients:all"
+)
+
+// Role is a named set of permissions that users are given
+type Role struct {
+	gorm.Model
+	Name        string       `gorm:"column:name;not null;unique_index" json:"name"`
+	Description string       `gorm:"column:description" json:"description"`
+	Permissions []Permission `gorm:"many2many:role_permissions" json:"permissions"`
+}
+
+// Permission is an action a role may take, such as PermReadVitals
+type Permission struct {
+	gorm.Model
+	Name string `gorm:"column:name;not null;unique_index" json:"name"`
+}
+
+// ClinicianAssignment puts a patient in the care of a clinician from
+// StartDate until EndDate, if set, giving the clinician access to the
+// patient's records meanwhile. CareTeam names the team the clinician cares
+// for the patient as part of, if any. Ended assignments are kept as history.
+type ClinicianAssignment struct {
+	gorm.Model
+	Clinician  string     `gorm:"column:clinician;not null;index" json:"clinician"`
+	Patient    string     `gorm:"column:patient;not null;index" json:"patient"`
+	CareTeam   string     `gorm:"column:care_team;index" json:"care_team,omitempty"`
+	StartDate  time.Time  `gorm:"column:start_date" json:"start_date"`
+	EndDate    *time.Time `gorm:"column:end_date" json:"end_date,omitempty"`
+	AssignedBy string     `gorm:"column:assigned_by" json:"assigned_by"`
+}
+
+// CareTeam is a group of clinicians, such as a ward or a practice, that
+// patients are assigned to the care of.
+type CareTeam struct {
+	gorm.Model
+	Name        string `gorm:"column:name;not null;unique_index" json:"name"`
+	Description string `gorm:"column:description" json:"description"`
+}
+
+type CareTeamRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+// AssignmentRequest assigns a clinician to a patient. The assignment starts
+// now unless StartDate is given and lasts until unassigned unless EndDate is
+// given.
+type AssignmentRequest struct {
+	Clinician string     `json:"clinician" binding:"required"`
+	CareTeam  string     `json:"care_team"`
+	StartDate *time.Time `json:"start_date"`
+	EndDate   *time.Time `json:"end_date"`
+}
+
+// ClinicianPanel lists the patients in the care of a clinician
+type ClinicianPanel struct {
+	Clinician string         `json:"clinician"`
+	AsOf      time.Time      `json:"as_of"`
+	Patients  []PanelPatient `json:"patients"`
+}
+
+// PanelPatient is a patient on a clinician's panel with the latest reading
+// of each of their vitals. OutOfRange is set if any of them is flagged.
+type PanelPatient struct {
+	Username      string       `json:"username"`
+	Age           int          `json:"age"`
+	Gender        string       `json:"gender"`
+	CareTeams     []string     `json:"care_teams,omitempty"`
+	AssignedSince time.Time    `json:"assigned_since"`
+	OutOfRange    bool         `json:"out_of_range"`
+	LatestVitals  []PanelVital `json:"latest_vitals"`
+}
+
+// PanelVital is the latest value of a vital, or of one component of a
+// composite vital, with Flag "low" or "high" if it is outside the normal
+// range.
+type PanelVital struct {
+	VitalID    string    `json:"vital_id"`
+	Component  string    `json:"component,omitempty"`
+	LoincCode  string    `json:"loinc_code,omitempty"`
+	Value      float64   `json:"value"`
+	Unit       string    `json:"unit"`
+	Timestamp  time.Time `json:"timestamp"`
+	NormalLow  *float64  `json:"normal_low,omitempty"`
+	NormalHigh *float64  `json:"normal_high,omitempty"`
+	Flag       string    `json:"flag,omitempty"`
+}
+
+// Device is a wearable or bedside gateway that pushes vitals with an API
+// key instead of logging in. Keys look like vmk_<KeyID>_<secret> and are
+// stored by the SHA-256 hash of the whole key. A device may only record
+// vitals of the types in VitalTypes for the users in Patients, and its
+// readings have the source type SourceType.
+type Device struct {
+	gorm.Model
+	Name         string         `gorm:"column:name;not null" json:"name"`
+	SourceType   string         `gorm:"column:source_type;not null;default:'smartwatch'" json:"source_type"`
+	KeyID        string         `gorm:"column:key_id;not null;unique_index" json:"key_id"`
+	KeyHash      string         `gorm:"column:key_hash;not null" json:"-"`
+	Patients     pq.StringArray `gorm:"column:patients;type:text[]" json:"patients"`
+	VitalTypes   pq.StringArray `gorm:"column:vital_types;type:text[]" json:"vital_types"`
+	RegisteredBy string         `gorm:"column:registered_by" json:"registered_by"`
+	RotatedAt    *time.Time     `gorm:"column:rotated_at" json:"rotated_at,omitempty"`
+	LastSeenAt   *time.Time     `gorm:"column:last_seen_at" json:"last_seen_at,omitempty"`
+	RevokedAt    *time.Time     `gorm:"column:revoked_at" json:"revoked_at,omitempty"`
+}
+
+// DeviceRequest registers a device or changes its name and scope. Vital
+// types may be given by vital ID or LOINC code. SourceType is smartwatch, the
+// default, or hospital_monitor.
+type DeviceRequest struct {
+	Name       string   `json:"name" binding:"required"`
+	SourceType string   `json:"source_type"`
+	Patients   []string `json:"patients" binding:"required"`
+	VitalTypes []string `json:"vital_types" binding:"required"`
+}
+
+// DeviceKey is a device with its API key, which is only ever shown when the
+// device is registered or its key rotated.
+type DeviceKey struct {
+	Device Device `json:"device"`
+	APIKey string `json:"api_key"`
+}
+
+// Kinds of alert rule
+const (
+	// AlertThreshold fires on a reading below Low or above High.
+	AlertThreshold = "threshold"
+	// AlertRateOfChange fires on a reading that differs by Delta or more
+	// from a reading of the previous WindowMinutes.
+	AlertRateOfChange = "rate_of_change"
+	// AlertOutOfRangeCount fires once Count readings of the last
+	// WindowMinutes, the new one included, are outside Low to High.
+	AlertOutOfRangeCount = "out_of_range_count"
+)
+
+// Alert severities, from least to most urgent
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alert statuses. Alerts are raised open and may be acknowledged before
+// they are resolved.
+const (
+	AlertOpen         = "open"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// AlertRule describes readings of one vital series that raise an alert.
+// Rules without a Patient apply to everyone, except patients with a rule of
+// their own of the same kind for the series. Bounds and Delta are in Unit,
+// the canonical unit of the series. An out of range count rule created
+// without bounds takes the normal range of the series.
+type AlertRule struct {
+	gorm.Model
+	Name          string   `gorm:"column:name;not null" json:"name"`
+	Kind          string   `gorm:"column:kind;not null" json:"kind"`
+	Patient       string   `gorm:"column:patient;index" json:"patient,omitempty"`
+	VitalID       string   `gorm:"column:vital_id;not null;index" json:"vital_id"`
+	Component     string   `gorm:"column:component" json:"component,omitempty"`
+	Unit          string   `gorm:"column:unit" json:"unit"`
+	Low           *float64 `gorm:"column:low" json:"low,omitempty"`
+	High          *float64 `gorm:"column:high" json:"high,omitempty"`
+	Delta         *float64 `gorm:"column:delta" json:"delta,omitempty"`
+	Count         int      `gorm:"column:count" json:"count,omitempty"`
+	WindowMinutes int      `gorm:"column:window_minutes" json:"window_minutes,omitempty"`
+	Severity      string   `gorm:"column:severity;not null" json:"severity"`
+	Active        bool     `gorm:"column:active" json:"active"`
+	CreatedBy     string   `gorm:"column:created_by" json:"created_by"`
+}
+
+// AlertRuleRequest creates or replaces an alert rule. VitalID may be a
+// LOINC code, and Component names the series of a composite vital. Severity
+// defaults to warning and Active to true.
+type AlertRuleRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	Kind          string   `json:"kind" binding:"required"`
+	VitalID       string   `json:"vital_id" binding:"required"`
+	Component     string   `json:"component"`
+	Low           *float64 `json:"low"`
+	High          *float64 `json:"high"`
+	Delta         *float64 `json:"delta"`
+	Count         int      `json:"count"`
+	WindowMinutes int      `json:"window_minutes"`
+	Severity      string   `json:"severity"`
+	Active        *bool    `json:"active"`
+}
+
+// Alert is raised when a reading triggers an alert rule. While an alert of
+// a rule is unresolved, the rule raises no further alerts for the patient.
+type Alert struct {
+	gorm.Model
+	RuleID         uint       `gorm:"column:rule_id;not null;index" json:"rule_id"`
+	Patient        string     `gorm:"column:patient;not null;index" json:"patient"`
+	VitalID        string     `gorm:"column:vital_id;not null" json:"vital_id"`
+	Component      string     `gorm:"column:component" json:"component,omitempty"`
+	VitalRowID     uint       `gorm:"column:vital_row_id" json:"vital_row_id"`
+	Value          float64    `gorm:"column:value" json:"value"`
+	Unit           string     `gorm:"column:unit" json:"unit"`
+	ObservedAt     time.Time  `gorm:"column:observed_at" json:"observed_at"`
+	Severity       string     `gorm:"column:severity;not null" json:"severity"`
+	Message        string     `gorm:"column:message" json:"message"`
+	Status         string     `gorm:"column:status;not null;index" json:"status"`
+	AcknowledgedBy string     `gorm:"column:acknowledged_by" json:"acknowledged_by,omitempty"`
+	AcknowledgedAt *time.Time `gorm:"column:acknowledged_at" json:"acknowledged_at,omitempty"`
+	ResolvedBy     string     `gorm:"column:resolved_by" json:"resolved_by,omitempty"`
+	ResolvedAt     *time.Time `gorm:"column:resolved_at" json:"resolved_at,omitempty"`
+	Note           string     `gorm:"column:note" json:"note,omitempty"`
+}
+
+// AlertQuery selects alerts, newest first. Nil Patients matches every
+// patient; empty Status and Severity match any.
+type AlertQuery struct {
+	Patients []string
+	Status   string
+	Severity string
+	BeforeID uint
+	Limit    int
+}
+
+// AlertActionRequest acknowledges or resolves an alert, with an optional
+// note
+type AlertActionRequest struct {
+	Note string `json:"note"`
+}
+
+// RoleRequest changes the role of a user
+type RoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type LoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// LogoutRequest revokes the caller's access token along with RefreshToken,
+// if given, or every refresh token of the caller if All is set.
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	All          bool   `json:"all"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ResetPasswordRequest sets a user's password on their behalf
+type ResetPasswordRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// TokenPair is issued on login and refresh. ExpiresIn is the lifetime of the
+// access token in seconds.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// SchemaMigration records a one-off change to stored data that has been
+// applied, so that it is not applied again.
+type SchemaMigration struct {
+	Name      string    `gorm:"column:name;primary_key"`
+	AppliedAt time.Time `gorm:"column:applied_at;not null"`
 }
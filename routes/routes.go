@@ -1,44 +1,201 @@
 package routes
 
 import (
+	"medical-vitals-management-system/app"
 	"medical-vitals-management-system/handlers"
+	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
 )
 
 func SetUpRouter(db *gorm.DB) *gin.Engine {
 	router := gin.Default()
+	// Client IPs in the audit log are only taken from X-Forwarded-For when
+	// the request comes through one of the proxies in TRUSTED_PROXIES.
+	if err := router.SetTrustedProxies(trustedProxies()); err != nil {
+		logrus.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	router.Use(handlers.Audit(db))
 
 	router.GET("/", func(c *gin.Context) {
 		c.String(200, "Welcome To Medical Vital Management System")
 	})
 
+	auth := app.AuthSettingsFromEnv()
+	requireAuth := handlers.Authenticate(db, auth)
+
+	// Signing up and in are the only routes open to anonymous callers
+	public := router.Group("/api/v1")
+	{
+		public.POST("/users", handlers.CreateUserHandler(db))
+		public.POST("/auth/login", handlers.LoginHandler(db, auth))
+		public.POST("/auth/refresh", handlers.RefreshHandler(db, auth))
+	}
+
+	api := router.Group("/api/v1", requireAuth)
+
+	// Sessions of the caller
+	api.POST("/auth/logout", handlers.LogoutHandler(db))
+	api.PUT("/auth/password", handlers.ChangePasswordHandler(db))
+
+	// User resources
+	users := api.Group("/users")
+	{
+		users.GET("/:username", handlers.GetUserHandler(db))
+		users.PUT("/:username", handlers.UpdateUserHandler(db))
+		users.DELETE("/:username", handlers.DeleteUserHandler(db))
+		users.PUT("/:username/role", handlers.SetUserRoleHandler(db))
+		users.PUT("/:username/password", handlers.ResetPasswordHandler(db))
+
+		users.GET("/:username/clinicians", handlers.GetAssignmentsHandler(db))
+		users.POST("/:username/clinicians", handlers.AssignClinicianHandler(db))
+		users.DELETE("/:username/clinicians/:clinician", handlers.UnassignClinicianHandler(db))
+
+		users.GET("/:username/vitals", handlers.ListUserVitalsHandler(db))
+		users.POST("/:username/vitals", handlers.CreateVitalHandler(db))
+		users.POST("/:username/vitals/batch", handlers.BulkCreateVitalsHandler(db))
+		users.POST("/:username/vitals/import", handlers.ImportVitalsCSVHandler(db))
+		users.GET("/:username/vitals/export", handlers.ExportVitalsCSVHandler(db))
+		users.GET("/:username/vitals/as-of", handlers.GetVitalsAsOfHandler(db))
+		users.GET("/:username/vitals/:vital_id/history", handlers.GetVitalHistoryHandler(db))
+		users.PUT("/:username/vitals/:vital_id", handlers.UpdateVitalHandler(db))
+		users.DELETE("/:username/vitals/:vital_id", handlers.DeleteVitalHandler(db))
+
+		users.GET("/:username/alert-rules", handlers.GetAlertRulesHandler(db))
+		users.POST("/:username/alert-rules", handlers.CreateAlertRuleHandler(db))
+		users.GET("/:username/alerts", handlers.GetAlertsHandler(db))
+	}
+
+	// Roles users can be given
+	api.GET("/roles", handlers.GetRolesHandler(db))
+
+	// Care teams and the patients in each clinician's care
+	api.POST("/care-teams", handlers.CreateCareTeamHandler(db))
+	api.GET("/care-teams", handlers.GetCareTeamsHandler(db))
+	api.GET("/clinicians/:username/panel", handlers.GetClinicianPanelHandler(db))
+
+	// Devices pushing vitals with an API key
+	devices := api.Group("/devices")
+	{
+		devices.POST("", handlers.RegisterDeviceHandler(db))
+		devices.GET("", handlers.GetDevicesHandler(db))
+		devices.GET("/:id", handlers.GetDeviceHandler(db))
+		devices.PUT("/:id", handlers.UpdateDeviceHandler(db))
+		devices.POST("/:id/rotate", handlers.RotateDeviceKeyHandler(db))
+		devices.POST("/:id/revoke", handlers.RevokeDeviceHandler(db))
+	}
+
+	// Alert rules evaluated on every reading, and the alerts they raise
+	alertRules := api.Group("/alert-rules")
+	{
+		alertRules.POST("", handlers.CreateAlertRuleHandler(db))
+		alertRules.GET("", handlers.GetAlertRulesHandler(db))
+		alertRules.PUT("/:id", handlers.UpdateAlertRuleHandler(db))
+		alertRules.DELETE("/:id", handlers.DeleteAlertRuleHandler(db))
+	}
+	alerts := api.Group("/alerts")
+	{
+		alerts.GET("", handlers.GetAlertsHandler(db))
+		alerts.POST("/:id/acknowledge", handlers.AcknowledgeAlertHandler(db))
+		alerts.POST("/:id/resolve", handlers.ResolveAlertHandler(db))
+	}
+
+	// Vitals of any user
+	api.POST("/vitals/batch", handlers.BulkCreateVitalsHandler(db))
+	api.POST("/vitals/import", handlers.ImportVitalsCSVHandler(db))
+
+	// Vital type resources
+	vitalTypes := api.Group("/vital-types")
+	{
+		vitalTypes.POST("", handlers.CreateVitalTypeHandler(db))
+		vitalTypes.GET("", handlers.GetVitalTypesHandler(db))
+		vitalTypes.GET("/:vital_id", handlers.GetVitalTypeHandler(db))
+		vitalTypes.PUT("/:vital_id", handlers.UpdateVitalTypeHandler(db))
+		vitalTypes.DELETE("/:vital_id", handlers.DeleteVitalTypeHandler(db))
+	}
+
+	// Insights
+	insights := api.Group("/insights")
+	{
+		insights.POST("/aggregate", handlers.AggregateVitalsHandler(db))
+		insights.POST("/population", handlers.PopulationInsightHandler(db))
+		insights.POST("/population/batch", handlers.BatchPopulationInsightHandler(db))
+	}
+
+	// Audit trail of every request
+	api.GET("/audit", handlers.GetAuditEntriesHandler(db))
+
+	// HL7 v2 messages that could not be processed
+	api.GET("/hl7/dead-letters", handlers.GetDeadLettersHandler(db))
+
+	// FHIR R4 facade
+	fhir := router.Group("/fhir", requireAuth)
+	{
+		fhir.GET("/Observation", handlers.SearchObservationsHandler(db))
+		fhir.POST("/Observation", handlers.CreateObservationHandler(db))
+		fhir.GET("/Observation/:id", handlers.GetObservationHandler(db))
+		fhir.GET("/Patient/:id", handlers.GetPatientHandler(db))
+	}
+
+	setUpLegacyRoutes(router, db, requireAuth)
+
+	return router
+}
+
+// trustedProxies reads the comma-separated IPs and CIDR ranges of the
+// reverse proxies in front of the API from TRUSTED_PROXIES. None are trusted
+// if it is not set.
+func trustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// setUpLegacyRoutes registers the original verb-style routes as deprecated
+// aliases of the /api/v1 resources. Routes that identify a resource read it
+// from the query string, e.g. /users/get_user?username=JohnDoe.
+func setUpLegacyRoutes(router *gin.Engine, db *gorm.DB, requireAuth gin.HandlerFunc) {
+	router.POST("/users/create_user", handlers.Deprecated("/api/v1/users"), handlers.CreateUserHandler(db))
+
 	// User routes
-	userGroup := router.Group("/users")
+	userGroup := router.Group("/users", requireAuth)
 	{
-		userGroup.GET("/get_user", handlers.GetUserHandler(db))
-		userGroup.POST("/create_user", handlers.CreateUserHandler(db))
-		userGroup.PUT("/update_user", handlers.UpdateUserHandler(db))
-		userGroup.DELETE("/delete_user", handlers.DeleteUserHandler(db))
+		userGroup.GET("/get_user", handlers.Deprecated("/api/v1/users/{username}"), handlers.GetUserHandler(db))
+		userGroup.PUT("/update_user", handlers.Deprecated("/api/v1/users/{username}"), handlers.UpdateUserHandler(db))
+		userGroup.DELETE("/delete_user", handlers.Deprecated("/api/v1/users/{username}"), handlers.DeleteUserHandler(db))
 	}
 
 	// Vital routes
-	vitalGroup := router.Group("/vitals")
+	vitalGroup := router.Group("/vitals", requireAuth)
 	{
-		vitalGroup.POST("/insert_vital", handlers.CreateVitalHandler(db))
-		vitalGroup.GET("/get_vitals", handlers.GetVitalsHandler(db))
-		vitalGroup.PUT("/edit_vital", handlers.UpdateVitalHandler(db))
-		vitalGroup.DELETE("/delete_vital", handlers.DeleteVitalHandler(db))
+		vitalGroup.POST("/insert_vital", handlers.Deprecated("/api/v1/users/{username}/vitals"), handlers.CreateVitalHandler(db))
+		vitalGroup.GET("/get_vitals", handlers.Deprecated("/api/v1/users/{username}/vitals"), handlers.GetVitalsHandler(db))
+		vitalGroup.PUT("/edit_vital", handlers.Deprecated("/api/v1/users/{username}/vitals/{vital_id}"), handlers.UpdateVitalHandler(db))
+		vitalGroup.DELETE("/delete_vital", handlers.Deprecated("/api/v1/users/{username}/vitals/{vital_id}"), handlers.DeleteVitalHandler(db))
+	}
 
+	// Vital type routes
+	vitalTypeGroup := router.Group("/vital_types", requireAuth)
+	{
+		vitalTypeGroup.POST("/create_vital_type", handlers.Deprecated("/api/v1/vital-types"), handlers.CreateVitalTypeHandler(db))
+		vitalTypeGroup.GET("/get_vital_types", handlers.Deprecated("/api/v1/vital-types"), handlers.GetVitalTypesHandler(db))
+		vitalTypeGroup.GET("/get_vital_type/:vital_id", handlers.Deprecated("/api/v1/vital-types/{vital_id}"), handlers.GetVitalTypeHandler(db))
+		vitalTypeGroup.PUT("/update_vital_type", handlers.Deprecated("/api/v1/vital-types/{vital_id}"), handlers.UpdateVitalTypeHandler(db))
+		vitalTypeGroup.DELETE("/delete_vital_type/:vital_id", handlers.Deprecated("/api/v1/vital-types/{vital_id}"), handlers.DeleteVitalTypeHandler(db))
 	}
 
 	//Insight routes
-	insightGroup := router.Group("/insights")
+	insightGroup := router.Group("/insights", requireAuth)
 	{
-		insightGroup.POST("/aggregate", handlers.AggregateVitalsHandler(db))
-		insightGroup.POST("/population_insight", handlers.PopulationInsightHandler(db))
+		insightGroup.POST("/aggregate", handlers.Deprecated("/api/v1/insights/aggregate"), handlers.AggregateVitalsHandler(db))
+		insightGroup.POST("/population_insight", handlers.Deprecated("/api/v1/insights/population"), handlers.PopulationInsightHandler(db))
+		insightGroup.POST("/population_insights", handlers.Deprecated("/api/v1/insights/population/batch"), handlers.BatchPopulationInsightHandler(db))
 	}
-
-	return router
 }